@@ -18,127 +18,396 @@
 package godynstruct
 
 import (
+	"io"
 	"reflect"
-	"sort"
-	"strings"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
 )
 
 // DynMarshalBSON return the BSON encoding of the dynamic struct _struct
+// The fields of the struct are encoded in declaration order, followed by the extra fields sorted by key, or in their order if they are OrderedExtras
+// If an extra field has the same name of a field of the struct, the value of the extra field is used in place of the field
 // _struct contains the reflect.Value of the struct
-// extraFields is the map that contains the extra fields
-// extraFieldsName is the name of the field in the struct that contains the extra fields
-func DynMarshalBSON(_struct reflect.Value, extraFields map[string]interface{}, extraFieldsName string) ([]byte, error) {
-	// out is the document that will be marshalled
-	out := make(bson.D, 0)
+// extraFields contains the extra fields, it can be a map[string]interface{}, Extras or OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func DynMarshalBSON(_struct reflect.Value, extraFields interface{}, extraFieldsName string) ([]byte, error) {
+	return Options{}.DynMarshalBSON(_struct, extraFields, extraFieldsName)
+}
 
-	if _struct.Kind() == reflect.Ptr {
-		_struct = _struct.Elem()
+// DynMarshalBSON is like the function DynMarshalBSON, but it uses the options o
+func (o Options) DynMarshalBSON(_struct reflect.Value, extraFields interface{}, extraFieldsName string) ([]byte, error) {
+	members, err := o.dynMembers(_struct, extraFields, extraFieldsName, "bson")
+	if err != nil {
+		return nil, err
 	}
 
-	// add each field except extraFieldsName into out
-	typ := _struct.Type()
-	for i := 0; i < _struct.NumField(); i++ {
-		fi := typ.Field(i)
-
-		if fi.Name != extraFieldsName {
-			val, _ := fi.Tag.Lookup("bson")
-			fi, err := buildFieldInfo(fi.Name, _struct.Field(i), val)
+	// out is the document that will be marshalled
+	out := make(bson.D, 0, len(members))
+	for _, m := range members {
+		if m.field.minSize && !m.extra {
+			// the value is encoded in the same way of the mongo driver, that applies minsize also to the nested values
+			t, data, err := bson.MarshalValueWithContext(bsoncodec.EncodeContext{Registry: bson.DefaultRegistry, MinSize: true}, m.value)
 			if err != nil {
 				return nil, err
 			}
-
-			if !fi.omitted && (!fi.omitEmpty || !fi.fieldValue.IsZero()) {
-				out = append(out, bson.E{Key: fi.actualFieldName, Value: fi.fieldValue.Interface()})
-			}
+			out = append(out, bson.E{Key: m.key, Value: bson.RawValue{Type: t, Value: data}})
+		} else {
+			out = append(out, bson.E{Key: m.key, Value: m.value})
 		}
 	}
 
-	// add the missing extra fields
-	tempList := make(bson.D, 0)
-	for v, k := range extraFields {
-		tempList = append(tempList, bson.E{Key: v, Value: k})
+	return bson.Marshal(out)
+}
+
+// ToBSON return the BSON encoding of the dynamic struct v, that can be a struct, a Dyn or a pointer to one of them
+// The extra fields are the ones in the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func ToBSON(v interface{}) ([]byte, error) {
+	return Options{}.ToBSON(v)
+}
+
+// ToBSON is like the function ToBSON, but it uses the options o
+func (o Options) ToBSON(v interface{}) ([]byte, error) {
+	ptrStruct, err := dynStruct(v)
+	if err != nil {
+		return nil, err
 	}
-	sort.Slice(tempList, func(i, j int) bool {
-		return strings.Compare(tempList[i].Key, tempList[j].Key) < 0
-	})
 
-	out = append(out, tempList...)
+	extraFields, name, err := extrasField(ptrStruct.Elem(), "bson")
+	if err != nil {
+		return nil, err
+	}
 
-	return bson.Marshal(out)
+	return o.DynMarshalBSON(ptrStruct, extraFields.Interface(), name)
+}
+
+// DynEncodeBSON writes the BSON encoding of the dynamic struct _struct to w
+// The document is written at once, because it starts with its length
+// w is the writer where the BSON encoding is written
+// _struct contains the reflect.Value of the struct
+// extraFields contains the extra fields, it can be a map[string]interface{}, Extras or OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func DynEncodeBSON(w io.Writer, _struct reflect.Value, extraFields interface{}, extraFieldsName string) error {
+	return Options{}.DynEncodeBSON(w, _struct, extraFields, extraFieldsName)
+}
+
+// DynEncodeBSON is like the function DynEncodeBSON, but it uses the options o
+func (o Options) DynEncodeBSON(w io.Writer, _struct reflect.Value, extraFields interface{}, extraFieldsName string) error {
+	data, err := o.DynMarshalBSON(_struct, extraFields, extraFieldsName)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
 }
 
 // DynUnmarshalBSON parses the BSON encoded data and store the result into ptrStruct. The fields that aren't part of the struct are set inside extraFieldsPtr
 // data contains the BSON encoded rappresentation of the data
 // ptrStruct contains a reflect.Value pointer to the struct
-// extraFieldsPtr is the pointer to the extraFields map
-func DynUnmarshalBSON(data []byte, ptrStruct reflect.Value, extraFieldsPtr *map[string]interface{}, extraFieldsName string) error {
-	// initialize the map that contains the extra fields
-	*extraFieldsPtr = make(map[string]interface{})
-
-	// get the list of key/value pairs of the document
-	var document map[string]bson.RawValue
-	err := bson.Unmarshal(data, &document)
+// extraFieldsPtr is the pointer to the extra fields, it can be a *map[string]interface{}, *Extras or *OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func DynUnmarshalBSON(data []byte, ptrStruct reflect.Value, extraFieldsPtr interface{}, extraFieldsName string) error {
+	return Options{}.DynUnmarshalBSON(data, ptrStruct, extraFieldsPtr, extraFieldsName)
+}
+
+// DynUnmarshalBSON is like the function DynUnmarshalBSON, but it uses the options o
+func (o Options) DynUnmarshalBSON(data []byte, ptrStruct reflect.Value, extraFieldsPtr interface{}, extraFieldsName string) error {
+	dest, err := newDynDest(ptrStruct, extraFieldsPtr, extraFieldsName, "bson", o.Merge)
 	if err != nil {
 		return err
 	}
 
-	// create a map of every struct fields
-	structFields := make(map[string]fieldInfo)
-
-	typ := reflect.Indirect(ptrStruct).Type()
-	for i := 0; i < typ.NumField(); i++ {
-		fi := typ.Field(i)
-
-		if fi.Name != extraFieldsName {
-			val, _ := fi.Tag.Lookup("bson")
-			info, err := buildFieldInfo(fi.Name, ptrStruct.Elem().Field(i), val)
-			if err != nil {
-				return err
-			}
+	// the whole document is validated before reading it, because the mongo driver doesn't check the lengths of the values it decodes
+	err = validateBSONDocument(data)
+	if err != nil {
+		return err
+	}
 
-			structFields[info.actualFieldName] = info
+	if o.DisallowUnknownFields {
+		paths, err := unknownBSONStructFields(data, dest.fields, dest.extraFieldsName, "", nil)
+		if err != nil {
+			return err
+		}
+		if len(paths) > 0 {
+			return &UnknownFieldsError{Paths: paths}
 		}
 	}
 
-	var othersList bson.D = []primitive.E{}
+	// the extra fields are decoded as they would be inside a map[string]interface{} or a bson.D
+	extrasContext := bsoncodec.DecodeContext{Registry: bson.DefaultRegistry, Ancestor: bsonMapType}
+	if dest.extras.isOrdered() {
+		extrasContext.Ancestor = bsonDocumentType
+	}
 
-	// for each key/value pair set it to a field of struct or add it to othersList
-	for k, v := range document {
-		field := structFields[k]
+	// for each key/value pair, read in a single pass over data, set it to a field of struct or to extras
+	return forEachBSONElement(data, func(k string, v bson.RawValue) error {
+		if field, ok := dest.field(k); ok {
+			// the field k is part of the struct, so the value will be set inside
+			fieldValue, err := dest.fieldValue(field)
+			if err != nil {
+				return err
+			}
 
-		if field.fieldValue.IsValid() {
-			if !field.omitted {
-				// the field k is part of the struct, so the value will be set inside
-				if v.Type == bson.TypeNull && field.fieldValue.Type().Kind() == reflect.Ptr && field.fieldValue.Type().Elem().Kind() == reflect.Struct {
-					nilValue := reflect.Zero(field.fieldValue.Type())
-					field.fieldValue.Set(nilValue)
-				} else {
-					err = v.Unmarshal(field.fieldValue.Addr().Interface())
-					if err != nil {
-						return err
-					}
+			if v.Type == bson.TypeNull && fieldValue.Type().Kind() == reflect.Ptr && fieldValue.Type().Elem().Kind() == reflect.Struct {
+				nilValue := reflect.Zero(fieldValue.Type())
+				fieldValue.Set(nilValue)
+			} else if d, ok := nestedDyn(fieldValue, v.Type == bson.TypeEmbeddedDocument); ok {
+				// the nested dynamic struct is unmarshalled with the same options
+				err = d.unmarshalBSON(v.Value, o)
+				if err != nil {
+					return err
+				}
+			} else {
+				err = v.UnmarshalWithContext(&bsoncodec.DecodeContext{Registry: bson.DefaultRegistry, Truncate: field.truncate}, fieldValue.Addr().Interface())
+				if err != nil {
+					return err
 				}
 			}
+		} else if o.RawExtras {
+			// the value is copied because data can be reused by the caller
+			dest.extras.set(k, bson.RawValue{Type: v.Type, Value: append([]byte(nil), v.Value...)})
 		} else {
-			// the field k is not part of the struct, so the kv is added to othersList
-			othersList = append(othersList, bson.E{Key: k, Value: v})
+			// the field k is not part of the struct, so the value is decoded into extras
+			out, ok := bsonScalarValue(v)
+			if !ok {
+				err := v.UnmarshalWithContext(&extrasContext, &out)
+				if err != nil {
+					return err
+				}
+				if dest.extras.isOrdered() {
+					out = orderedFromBSON(out)
+				}
+			}
+			dest.extras.set(k, out)
 		}
-	}
 
-	// marshal otherList to BSON.
-	tempOthersListRaw, err := bson.Marshal(othersList)
+		return nil
+	})
+}
+
+// FromBSON parses the BSON encoded data and store the result into the dynamic struct pointed by v, that can be a pointer to a struct or to a Dyn
+// The fields that aren't part of the struct are set inside the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func FromBSON(data []byte, v interface{}) error {
+	return Options{}.FromBSON(data, v)
+}
+
+// FromBSON is like the function FromBSON, but it uses the options o
+func (o Options) FromBSON(data []byte, v interface{}) error {
+	ptrStruct, err := dynStructPtr(v)
 	if err != nil {
 		return err
 	}
 
-	// unmarshal it to extraFieldsPtr
-	err = bson.Unmarshal(tempOthersListRaw, extraFieldsPtr)
+	extraFields, name, err := extrasField(ptrStruct.Elem(), "bson")
 	if err != nil {
 		return err
 	}
 
+	return o.DynUnmarshalBSON(data, ptrStruct, extraFields.Addr().Interface(), name)
+}
+
+// unknownBSONStructFields appends to paths the path of each element of the BSON document data that isn't a field of the struct, also inside the values of the fields
+func unknownBSONStructFields(data []byte, fields *typeFields, extraFieldsName string, path string, paths []string) ([]string, error) {
+	err := forEachBSONElement(data, func(k string, v bson.RawValue) error {
+		field, ok := fields.fieldByName(k, extraFieldsName)
+		if !ok {
+			paths = append(paths, joinPath(path, k))
+			return nil
+		}
+
+		fieldType := fields.typ.FieldByIndex(field.index).Type
+		var err error
+		paths, err = unknownBSONFields(v, fieldType, joinPath(path, k), paths)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return paths, nil
+}
+
+// unknownBSONFields appends to paths the path of each field of the BSON value v that isn't part of the type typ
+// The values that don't match typ are ignored, because they are reported by the unmarshalling
+func unknownBSONFields(v bson.RawValue, typ reflect.Type, path string, paths []string) ([]string, error) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	if typ.Kind() != reflect.Struct && (typ.Implements(bsonUnmarshalerType) || reflect.PtrTo(typ).Implements(bsonUnmarshalerType)) {
+		return paths, nil
+	}
+
+	var err error
+	switch typ.Kind() {
+	case reflect.Slice, reflect.Array:
+		if v.Type != bson.TypeArray {
+			return paths, nil
+		}
+
+		i := 0
+		err = forEachBSONElement(v.Value, func(_ string, value bson.RawValue) error {
+			paths, err = unknownBSONFields(value, typ.Elem(), indexPath(path, i), paths)
+			i++
+			return err
+		})
+	case reflect.Map:
+		if v.Type != bson.TypeEmbeddedDocument {
+			return paths, nil
+		}
+
+		err = forEachBSONElement(v.Value, func(k string, value bson.RawValue) error {
+			paths, err = unknownBSONFields(value, typ.Elem(), joinPath(path, k), paths)
+			return err
+		})
+	default:
+		fields, extraFieldsName, ok, err := nestedStructFields(typ, "bson", bsonUnmarshalerType)
+		if err != nil || !ok {
+			return paths, err
+		}
+
+		if v.Type != bson.TypeEmbeddedDocument {
+			return paths, nil
+		}
+
+		return unknownBSONStructFields(v.Value, fields, extraFieldsName, path, paths)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return paths, nil
+}
+
+// forEachBSONElement calls f with the key and the value of each element of the BSON document or array data, in order
+// The elements are read directly from data, without copying them
+func forEachBSONElement(data []byte, f func(key string, value bson.RawValue) error) error {
+	length, rem, ok := bsoncore.ReadLength(data)
+	if !ok {
+		return bsoncore.NewInsufficientBytesError(data, rem)
+	}
+	if length < 5 || int(length) > len(data) {
+		return bsoncore.ErrInvalidLength
+	}
+	if data[length-1] != 0x00 {
+		return bsoncore.ErrMissingNull
+	}
+
+	// rem contains the elements, without the length and the final null byte
+	rem = data[4 : length-1]
+	for len(rem) > 0 {
+		elem, next, ok := bsoncore.ReadElement(rem)
+		if !ok {
+			return bsoncore.NewInsufficientBytesError(data, rem)
+		}
+
+		key, err := elem.KeyErr()
+		if err != nil {
+			return err
+		}
+		value, err := elem.ValueErr()
+		if err != nil {
+			return err
+		}
+
+		err = f(key, bson.RawValue{Type: value.Type, Value: value.Data})
+		if err != nil {
+			return err
+		}
+		rem = next
+	}
+
 	return nil
 }
+
+// validateBSONDocument return an error if the BSON document data, or a value nested inside it, is malformed
+func validateBSONDocument(data []byte) error {
+	return forEachBSONElement(data, func(_ string, v bson.RawValue) error {
+		err := bsoncore.Value{Type: v.Type, Data: v.Value}.Validate()
+		if err != nil {
+			return err
+		}
+
+		switch v.Type {
+		case bson.TypeEmbeddedDocument, bson.TypeArray:
+			return validateBSONDocument(v.Value)
+		case bson.TypeString, bson.TypeJavaScript, bson.TypeSymbol, bson.TypeDBPointer:
+			_, err = validateBSONString(v.Value)
+			return err
+		case bson.TypeCodeWithScope:
+			// the code is followed by the scope document
+			if len(v.Value) < 4 {
+				return bsoncore.NewInsufficientBytesError(v.Value, v.Value)
+			}
+			scope, err := validateBSONString(v.Value[4:])
+			if err != nil {
+				return err
+			}
+			return validateBSONDocument(scope)
+		}
+
+		return nil
+	})
+}
+
+// validateBSONString checks the length and the final null byte of the BSON string at the start of data, and return the bytes that follow it
+func validateBSONString(data []byte) ([]byte, error) {
+	length, rem, ok := bsoncore.ReadLength(data)
+	if !ok || length < 1 || int(length) > len(rem) {
+		return nil, bsoncore.NewInsufficientBytesError(data, rem)
+	}
+	if rem[length-1] != 0x00 {
+		return nil, bsoncore.ErrMissingNull
+	}
+
+	return rem[length:], nil
+}
+
+var (
+	bsonUnmarshalerType = reflect.TypeOf((*bson.Unmarshaler)(nil)).Elem()
+	bsonMapType         = reflect.TypeOf(map[string]interface{}(nil))
+	bsonDocumentType    = reflect.TypeOf(primitive.D(nil))
+)
+
+// bsonScalarValue return the value of the most common scalar types read from v, without the allocations of the decoder
+// The values have the same types given by the decoder into an interface{}, ok is false if v isn't of one of those types
+func bsonScalarValue(v bson.RawValue) (value interface{}, ok bool) {
+	switch v.Type {
+	case bson.TypeString:
+		return v.StringValueOK()
+	case bson.TypeInt32:
+		return v.Int32OK()
+	case bson.TypeInt64:
+		return v.Int64OK()
+	case bson.TypeDouble:
+		return v.DoubleOK()
+	case bson.TypeBoolean:
+		return v.BooleanOK()
+	case bson.TypeNull:
+		return nil, true
+	}
+
+	return nil, false
+}
+
+// orderedFromBSON return v with the documents nested inside converted to OrderedExtras
+func orderedFromBSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case primitive.D:
+		out := make(OrderedExtras, len(v))
+		for i, e := range v {
+			out[i] = ExtraField{Key: e.Key, Value: orderedFromBSON(e.Value)}
+		}
+		return out
+	case primitive.A:
+		for i := range v {
+			v[i] = orderedFromBSON(v[i])
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -18,12 +18,15 @@
 package godynstruct
 
 import (
+	"bytes"
 	"reflect"
+	"strconv"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 func (p Person) MarshalBSON() ([]byte, error) {
@@ -214,3 +217,364 @@ func TestDynUnmarshalBSONWithTags(t *testing.T) {
 
 	assert.Equal(t, expected, out)
 }
+
+type Address struct {
+	City   string `bson:"city"`
+	Street string `bson:"street,omitempty"`
+}
+
+type Contacts struct {
+	Email string `bson:"email"`
+}
+
+type Customer struct {
+	Name     string                 `bson:"name"`
+	Address  Address                `bson:",inline"`
+	Contacts *Contacts              `bson:",inline"`
+	Others   map[string]interface{} `bson:",inline"`
+}
+
+func TestDynBSONInline(t *testing.T) {
+	c := Customer{
+		Name: "amreo",
+		Address: Address{
+			City: "Milano",
+		},
+		Contacts: &Contacts{
+			Email: "amreo@example.com",
+		},
+		Others: map[string]interface{}{
+			"vip": true,
+		},
+	}
+
+	// the output must be the same of the mongo driver
+	type plainCustomer Customer
+	expected, err := bson.Marshal(plainCustomer(c))
+	require.NoError(t, err)
+
+	raw, err := DynMarshalBSON(reflect.ValueOf(c), c.Others, "")
+	require.NoError(t, err)
+	assert.Equal(t, bson.Raw(expected), bson.Raw(raw))
+
+	var out Customer
+	require.NoError(t, DynUnmarshalBSON(raw, reflect.ValueOf(&out), &out.Others, ""))
+	assert.Equal(t, c, out)
+
+	c.Contacts = nil
+	expected, err = bson.Marshal(plainCustomer(c))
+	require.NoError(t, err)
+
+	raw, err = DynMarshalBSON(reflect.ValueOf(c), c.Others, "")
+	require.NoError(t, err)
+	assert.Equal(t, bson.Raw(expected), bson.Raw(raw))
+}
+
+type address Address
+
+type Supplier struct {
+	Name      string `bson:"name"`
+	address   `bson:",inline"`
+	*Contacts `bson:",inline"`
+	Others    map[string]interface{} `bson:",inline"`
+}
+
+func TestDynBSONInlineUnexported(t *testing.T) {
+	// the unexported inline structs are ignored, like the mongo driver does
+	s := Supplier{Name: "amreo", address: address{City: "Milano"}, Contacts: &Contacts{Email: "amreo@example.com"}, Others: map[string]interface{}{"vip": true}}
+
+	type plainSupplier Supplier
+	expected, err := bson.Marshal(plainSupplier(s))
+	require.NoError(t, err)
+
+	raw, err := DynMarshalBSON(reflect.ValueOf(s), s.Others, "")
+	require.NoError(t, err)
+	assert.Equal(t, bson.Raw(expected), bson.Raw(raw))
+	assert.Equal(t, bson.Raw(expected).String(), `{"name": "amreo","email": "amreo@example.com","vip": true}`)
+
+	// the fields of the unexported struct are extra fields when they are decoded
+	data, err := bson.Marshal(bson.D{{Key: "name", Value: "amreo"}, {Key: "city", Value: "Milano"}})
+	require.NoError(t, err)
+
+	var out Supplier
+	require.NoError(t, DynUnmarshalBSON(data, reflect.ValueOf(&out), &out.Others, ""))
+	assert.Equal(t, Supplier{Name: "amreo", Others: map[string]interface{}{"city": "Milano"}}, out)
+}
+
+func TestDynBSONInlineErrors(t *testing.T) {
+	type duplicated struct {
+		City    string  `bson:"city"`
+		Address Address `bson:",inline"`
+	}
+	type wrongInline struct {
+		Name string `bson:",inline"`
+	}
+	type wrongInlineMap struct {
+		Others map[string]string `bson:",inline"`
+	}
+
+	_, err := DynMarshalBSON(reflect.ValueOf(duplicated{}), nil, "_otherInfo")
+	assert.EqualError(t, err, "(struct godynstruct.duplicated) duplicated key city")
+
+	_, err = DynMarshalBSON(reflect.ValueOf(wrongInline{}), nil, "_otherInfo")
+	assert.Error(t, err)
+
+	_, err = DynMarshalBSON(reflect.ValueOf(wrongInlineMap{}), nil, "")
+	assert.Error(t, err)
+
+	// the inline option is accepted only by the bson tag
+	type jsonInline struct {
+		Address Address `json:",inline"`
+	}
+	_, err = DynMarshalJSON(reflect.ValueOf(jsonInline{}), nil, "_otherInfo")
+	assert.Error(t, err)
+}
+
+type Measure struct {
+	Small    int64   `bson:"small,minsize"`
+	Big      int64   `bson:"big,minsize"`
+	Unsigned uint64  `bson:"unsigned,minsize"`
+	Normal   int64   `bson:"normal"`
+	List     []int64 `bson:"list,minsize"`
+	Value    int     `bson:"value,truncate"`
+	Count    int32   `bson:"count,truncate"`
+	Others   Extras  `bson:"-"`
+}
+
+func TestDynBSONMinSize(t *testing.T) {
+	m := Measure{
+		Small:    10,
+		Big:      1 << 40,
+		Unsigned: 7,
+		Normal:   10,
+		List:     []int64{1, 1 << 40},
+	}
+
+	type plainMeasure Measure
+	expected, err := bson.Marshal(plainMeasure(m))
+	require.NoError(t, err)
+
+	raw, err := DynMarshalBSON(reflect.ValueOf(m), nil, "Others")
+	require.NoError(t, err)
+	assert.Equal(t, bson.Raw(expected), bson.Raw(raw))
+
+	assert.Equal(t, bson.TypeInt32, bson.Raw(raw).Lookup("small").Type)
+	assert.Equal(t, bson.TypeInt64, bson.Raw(raw).Lookup("big").Type)
+	assert.Equal(t, bson.TypeInt64, bson.Raw(raw).Lookup("normal").Type)
+}
+
+func TestDynBSONTruncate(t *testing.T) {
+	raw, err := bson.Marshal(bson.D{
+		bson.E{Key: "value", Value: 3.7},
+		bson.E{Key: "count", Value: -2.5},
+	})
+	require.NoError(t, err)
+
+	type plainMeasure Measure
+	var expected plainMeasure
+	require.NoError(t, bson.Unmarshal(raw, &expected))
+
+	var out Measure
+	require.NoError(t, DynUnmarshalBSON(raw, reflect.ValueOf(&out), &out.Others, ""))
+	assert.Equal(t, expected.Value, out.Value)
+	assert.Equal(t, expected.Count, out.Count)
+	assert.Equal(t, 3, out.Value)
+
+	// without truncate the floats with a fractional part can't be decoded into an integer
+	raw, err = bson.Marshal(bson.D{
+		bson.E{Key: "normal", Value: 3.7},
+	})
+	require.NoError(t, err)
+
+	err = DynUnmarshalBSON(raw, reflect.ValueOf(&out), &out.Others, "")
+	assert.Error(t, err)
+	assert.Error(t, bson.Unmarshal(raw, &expected))
+
+	// minsize and truncate are options only of the bson tag
+	type jsonMinSize struct {
+		Small int64 `json:"small,minsize"`
+	}
+	_, err = DynMarshalJSON(reflect.ValueOf(jsonMinSize{}), nil, "_otherInfo")
+	assert.Error(t, err)
+}
+
+func TestDynEncodeBSON(t *testing.T) {
+	p := Person{
+		ID:         "foobar",
+		Name:       "amreo",
+		_otherInfo: map[string]interface{}{"Profession": "Gamer"},
+	}
+
+	expected, err := DynMarshalBSON(reflect.ValueOf(p), p._otherInfo, "_otherInfo")
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, DynEncodeBSON(&buf, reflect.ValueOf(p), p._otherInfo, "_otherInfo"))
+	assert.Equal(t, expected, buf.Bytes())
+
+	assert.Error(t, Options{}.DynEncodeBSON(failingWriter{}, reflect.ValueOf(p), p._otherInfo, "_otherInfo"))
+}
+
+func BenchmarkDynMarshalBSON(b *testing.B) {
+	p := Person{
+		ID:       "foobar",
+		Name:     "amreo",
+		Age:      99,
+		AltNames: []string{"bar", "foo"},
+		_otherInfo: map[string]interface{}{
+			"Profession": "Gamer",
+			"Really":     true,
+		},
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := DynMarshalBSON(reflect.ValueOf(p), p._otherInfo, "_otherInfo"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDynUnmarshalBSON(b *testing.B) {
+	data, err := bson.Marshal(bson.D{
+		bson.E{Key: "FooID", Value: "foobar"},
+		bson.E{Key: "Name", Value: "amreo"},
+		bson.E{Key: "Age", Value: 99},
+		bson.E{Key: "AltNames", Value: bson.A{"bar", "foo"}},
+		bson.E{Key: "Profession", Value: "Gamer"},
+		bson.E{Key: "Really", Value: true},
+	})
+	require.NoError(b, err)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var out Person
+		if err := DynUnmarshalBSON(data, reflect.ValueOf(&out), &out._otherInfo, "_otherInfo"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDynUnmarshalBSONManyExtras(b *testing.B) {
+	doc := bson.D{
+		bson.E{Key: "FooID", Value: "foobar"},
+		bson.E{Key: "Name", Value: "amreo"},
+	}
+	for i := 0; i < 100; i++ {
+		doc = append(doc,
+			bson.E{Key: "label" + strconv.Itoa(i), Value: "foo"},
+			bson.E{Key: "count" + strconv.Itoa(i), Value: i},
+			bson.E{Key: "extra" + strconv.Itoa(i), Value: bson.D{
+				bson.E{Key: "n", Value: i},
+				bson.E{Key: "tags", Value: bson.A{"foo", "bar"}},
+			}},
+		)
+	}
+	data, err := bson.Marshal(doc)
+	require.NoError(b, err)
+
+	b.Run("Extras", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var out Person
+			if err := DynUnmarshalBSON(data, reflect.ValueOf(&out), &out._otherInfo, "_otherInfo"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("OrderedExtras", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var out Event
+			if err := DynUnmarshalBSON(data, reflect.ValueOf(&out), &out.others, ""); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestDynUnmarshalBSONExtrasTypes(t *testing.T) {
+	data, err := bson.Marshal(bson.D{
+		bson.E{Key: "Name", Value: "amreo"},
+		bson.E{Key: "string", Value: "foo"},
+		bson.E{Key: "int32", Value: int32(1)},
+		bson.E{Key: "int64", Value: int64(2)},
+		bson.E{Key: "double", Value: 3.5},
+		bson.E{Key: "bool", Value: true},
+		bson.E{Key: "null", Value: nil},
+		bson.E{Key: "date", Value: primitive.DateTime(42)},
+		bson.E{Key: "doc", Value: bson.D{bson.E{Key: "a", Value: bson.A{1, bson.D{bson.E{Key: "b", Value: "c"}}}}}},
+	})
+	require.NoError(t, err)
+
+	// the extra fields have the same types given by the mongo driver decoding into a map
+	var expected map[string]interface{}
+	require.NoError(t, bson.Unmarshal(data, &expected))
+	delete(expected, "Name")
+
+	var out Person
+	require.NoError(t, DynUnmarshalBSON(data, reflect.ValueOf(&out), &out._otherInfo, "_otherInfo"))
+	assert.Equal(t, expected, out._otherInfo)
+}
+
+func TestDynUnmarshalBSONMalformed(t *testing.T) {
+	data, err := bson.Marshal(bson.D{
+		bson.E{Key: "Name", Value: "amreo"},
+		bson.E{Key: "Profession", Value: "Gamer"},
+	})
+	require.NoError(t, err)
+
+	var out Person
+	require.NoError(t, DynUnmarshalBSON(data, reflect.ValueOf(&out), &out._otherInfo, "_otherInfo"))
+
+	// truncated document
+	assert.Error(t, DynUnmarshalBSON(data[:len(data)-3], reflect.ValueOf(&out), &out._otherInfo, "_otherInfo"))
+	assert.Error(t, DynUnmarshalBSON(data[:3], reflect.ValueOf(&out), &out._otherInfo, "_otherInfo"))
+
+	// missing final null byte
+	wrong := append([]byte(nil), data...)
+	wrong[len(wrong)-1] = 1
+	assert.Error(t, DynUnmarshalBSON(wrong, reflect.ValueOf(&out), &out._otherInfo, "_otherInfo"))
+
+	// element longer than the document
+	wrong = append([]byte(nil), data...)
+	wrong[len(wrong)-8] = 0x7f
+	assert.Error(t, DynUnmarshalBSON(wrong, reflect.ValueOf(&out), &out._otherInfo, "_otherInfo"))
+	assert.Error(t, Options{RawExtras: true}.DynUnmarshalBSON(wrong, reflect.ValueOf(&out), &out._otherInfo, "_otherInfo"))
+}
+
+type Team struct {
+	Name    string
+	Drivers []Dyn[Driver]
+	Extras  Extras
+}
+
+func TestDynUnmarshalBSONNestedMalformed(t *testing.T) {
+	data, err := bson.Marshal(bson.D{
+		bson.E{Key: "Name", Value: "red"},
+		bson.E{Key: "Drivers", Value: bson.A{bson.D{bson.E{Key: "Name", Value: "amreo"}}}},
+	})
+	require.NoError(t, err)
+
+	var out Team
+	require.NoError(t, FromBSON(data, &out))
+	assert.Equal(t, Team{Name: "red", Drivers: []Dyn[Driver]{{Value: Driver{Name: "amreo", Extras: Extras{}}}}, Extras: Extras{}}, out)
+
+	// the length of the nested document inside the array is corrupted, so it's negative
+	wrong := append([]byte(nil), data...)
+	i := bytes.Index(wrong, []byte("\x030\x00")) + 3
+	copy(wrong[i:], []byte{0x13, 0x00, 0xfe, 0x9e})
+	assert.Error(t, bson.Unmarshal(wrong, &struct{ Drivers []Driver }{}))
+
+	out = Team{}
+	assert.Error(t, FromBSON(wrong, &out))
+	assert.Error(t, bson.Unmarshal(wrong, &Dyn[Team]{}))
+
+	// the string inside the nested document has length zero
+	wrong = append([]byte(nil), data...)
+	i = bytes.Index(wrong, []byte("amreo")) - 4
+	copy(wrong[i:], []byte{0x00, 0x00, 0x00, 0x00})
+	assert.Error(t, FromBSON(wrong, &out))
+	assert.Error(t, Options{RawExtras: true}.FromBSON(wrong, &Dyn[Car]{}))
+}
@@ -0,0 +1,577 @@
+// go-dyn-struct
+// Copyright (C) 2020  Andrea Laisa
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+// © 2020 GitHub, Inc.
+
+package godynstruct
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/x448/float16"
+)
+
+// the major types of the CBOR data items that are decoded by this package
+const (
+	cborUnsignedInt = 0
+	cborNegativeInt = 1
+	cborTextString  = 3
+	cborArray       = 4
+	cborMap         = 5
+	cborTag         = 6
+	cborSimple      = 7
+)
+
+// cborEntry is a key/value pair that will be encoded in a CBOR map, the key is a string or an int64
+type cborEntry struct {
+	key   interface{}
+	value interface{}
+}
+
+// DynMarshalCBOR return the CBOR encoding of the dynamic struct _struct
+// The fields of the struct are encoded in declaration order, followed by the extra fields sorted by key, or in their order if they are OrderedExtras
+// The fields with the keyasint option and the extra fields whose key is made by CBORIntKey are encoded with an integer key
+// The cbor.Tag values in the extra fields are encoded again with their tag, like the dates and the bignums decoded by DynUnmarshalCBOR,
+// and the CBORFloat16 values are encoded as half precision floats
+// If an extra field has the same name of a field of the struct, the value of the extra field is used in place of the field
+// _struct contains the reflect.Value of the struct
+// extraFields contains the extra fields, it can be a map[string]interface{}, Extras or OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func DynMarshalCBOR(_struct reflect.Value, extraFields interface{}, extraFieldsName string) ([]byte, error) {
+	return Options{}.DynMarshalCBOR(_struct, extraFields, extraFieldsName)
+}
+
+// DynMarshalCBOR is like the function DynMarshalCBOR, but it uses the options o
+func (o Options) DynMarshalCBOR(_struct reflect.Value, extraFields interface{}, extraFieldsName string) ([]byte, error) {
+	members, err := o.dynMembers(_struct, extraFields, extraFieldsName, "cbor")
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]cborEntry, len(members))
+	for i, m := range members {
+		key := cborKey(m.key)
+		if m.field.keyAsInt {
+			// the name of the fields with the keyasint option is always an integer
+			key, _ = strconv.ParseInt(m.key, 10, 64)
+		}
+		out[i] = cborEntry{key: key, value: m.value}
+	}
+
+	return encodeCBORMap(out)
+}
+
+// cborIntKeyPrefix is the prefix of the keys made by CBORIntKey
+// The byte 0xff isn't valid in UTF-8, so the keys made by CBORIntKey are different from all the CBOR text strings
+const cborIntKeyPrefix = "\xff"
+
+// CBORIntKey return the key of the extra fields that is encoded in CBOR as the integer key n, like the integer keys decoded by DynUnmarshalCBOR
+func CBORIntKey(n int64) string {
+	return cborIntKeyPrefix + strconv.FormatInt(n, 10)
+}
+
+// cborKey return the integer of key if it's made by CBORIntKey, otherwise it return key
+func cborKey(key string) interface{} {
+	if !strings.HasPrefix(key, cborIntKeyPrefix) {
+		return key
+	}
+
+	n, err := strconv.ParseInt(key[len(cborIntKeyPrefix):], 10, 64)
+	if err != nil || CBORIntKey(n) != key {
+		return key
+	}
+	return n
+}
+
+// CBORFloat16 is a half precision float of an extra field, that is encoded in CBOR with the same precision
+// The half precision floats in the extra fields are decoded by DynUnmarshalCBOR as CBORFloat16, so they are encoded again in the same way
+type CBORFloat16 float32
+
+// MarshalCBOR return the CBOR encoding of f as a half precision float, or as a single precision float if f can't be represented exactly
+func (f CBORFloat16) MarshalCBOR() ([]byte, error) {
+	h := float16.Fromfloat32(float32(f))
+	if !h.IsNaN() && h.Float32() != float32(f) {
+		return cborEncMode.Marshal(float32(f))
+	}
+
+	out := []byte{cborSimple<<5 | 25, 0, 0}
+	binary.BigEndian.PutUint16(out[1:], h.Bits())
+	return out, nil
+}
+
+// cborEncMode encodes the values with the keys of the maps sorted, so the same values have always the same encoding
+var cborEncMode, _ = cbor.EncOptions{Sort: cbor.SortCoreDeterministic}.EncMode()
+
+// encodeCBORMap return the CBOR encoding of the pairs as a map with the keys in order
+func encodeCBORMap(pairs []cborEntry) ([]byte, error) {
+	out := cborHead(cborMap, uint64(len(pairs)))
+	for _, p := range pairs {
+		k, err := cborEncMode.Marshal(p.key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := cborEncMode.Marshal(p.value)
+		if err != nil {
+			return nil, err
+		}
+		out = append(append(out, k...), v...)
+	}
+
+	return out, nil
+}
+
+// cborHead return the head of a CBOR data item of the major type major with the argument n
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= math.MaxUint8:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= math.MaxUint16:
+		out := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(out[1:], uint16(n))
+		return out
+	case n <= math.MaxUint32:
+		out := []byte{major<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(out[1:], uint32(n))
+		return out
+	default:
+		out := []byte{major<<5 | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(out[1:], n)
+		return out
+	}
+}
+
+// ToCBOR return the CBOR encoding of the dynamic struct v, that can be a struct, a Dyn or a pointer to one of them
+// The extra fields are the ones in the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func ToCBOR(v interface{}) ([]byte, error) {
+	return Options{}.ToCBOR(v)
+}
+
+// ToCBOR is like the function ToCBOR, but it uses the options o
+func (o Options) ToCBOR(v interface{}) ([]byte, error) {
+	ptrStruct, err := dynStruct(v)
+	if err != nil {
+		return nil, err
+	}
+
+	extraFields, name, err := extrasField(ptrStruct.Elem(), "cbor")
+	if err != nil {
+		return nil, err
+	}
+
+	return o.DynMarshalCBOR(ptrStruct, extraFields.Interface(), name)
+}
+
+// DynUnmarshalCBOR parses the CBOR encoded data and store the result into the dynamic struct pointed by ptrStruct
+// The integer keys of the map match the fields with the keyasint option, the keys that aren't part of the struct are set inside the extras,
+// in order if they are OrderedExtras, with the integer keys converted by CBORIntKey
+// The tagged values in the extra fields are decoded as cbor.Tag, so the dates, the bignums and the other tags are encoded again in the same way,
+// the half precision floats are decoded as CBORFloat16 and the single precision floats as float32
+// With the option RawExtras the values of the extra fields are stored as cbor.RawMessage
+// data is the CBOR encoded data, that must contain a map with string or integer keys, null or undefined
+// ptrStruct contains the reflect.Value of the pointer to the struct
+// extraFieldsPtr is the pointer to the extra fields, it can be a *map[string]interface{}, *Extras or *OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func DynUnmarshalCBOR(data []byte, ptrStruct reflect.Value, extraFieldsPtr interface{}, extraFieldsName string) error {
+	return Options{}.DynUnmarshalCBOR(data, ptrStruct, extraFieldsPtr, extraFieldsName)
+}
+
+// DynUnmarshalCBOR is like the function DynUnmarshalCBOR, but it uses the options o
+func (o Options) DynUnmarshalCBOR(data []byte, ptrStruct reflect.Value, extraFieldsPtr interface{}, extraFieldsName string) error {
+	dest, err := newDynDest(ptrStruct, extraFieldsPtr, extraFieldsName, "cbor", o.Merge)
+	if err != nil {
+		return err
+	}
+
+	members, err := decodeCBORMap(data)
+	if err != nil {
+		return err
+	}
+
+	if o.DisallowUnknownFields {
+		paths, err := unknownCBORStructFields(members, dest.fields, dest.extraFieldsName, "", nil)
+		if err != nil {
+			return err
+		}
+		if len(paths) > 0 {
+			return &UnknownFieldsError{Paths: paths}
+		}
+	}
+
+	// for each key/value pair, set it to a field of struct or to extras
+	for _, m := range members {
+		if field, ok := dest.field(m.key); ok {
+			// the field m.key is part of the struct, so the value will be set inside
+			fieldValue, err := dest.fieldValue(field)
+			if err != nil {
+				return err
+			}
+
+			if d, ok := nestedDyn(fieldValue, isCBORMap(m.value)); ok {
+				// the nested dynamic struct is unmarshalled with the same options
+				err = d.unmarshalCBOR(m.value, o)
+			} else {
+				err = cbor.Unmarshal(m.value, fieldValue.Addr().Interface())
+			}
+			if err != nil {
+				return err
+			}
+		} else if o.RawExtras {
+			dest.extras.set(m.extraKey(), m.value)
+		} else {
+			// the field m.key is not part of the struct, so the value is decoded into extras
+			out, err := decodeCBORValue(m.value, dest.extras.isOrdered())
+			if err != nil {
+				return err
+			}
+			dest.extras.set(m.extraKey(), out)
+		}
+	}
+
+	return nil
+}
+
+// FromCBOR parses the CBOR encoded data and store the result into the dynamic struct pointed by v, that can be a pointer to a struct or to a Dyn
+// The keys that aren't part of the struct are set inside the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func FromCBOR(data []byte, v interface{}) error {
+	return Options{}.FromCBOR(data, v)
+}
+
+// FromCBOR is like the function FromCBOR, but it uses the options o
+func (o Options) FromCBOR(data []byte, v interface{}) error {
+	ptrStruct, err := dynStructPtr(v)
+	if err != nil {
+		return err
+	}
+
+	extraFields, name, err := extrasField(ptrStruct.Elem(), "cbor")
+	if err != nil {
+		return err
+	}
+
+	return o.DynUnmarshalCBOR(data, ptrStruct, extraFields.Addr().Interface(), name)
+}
+
+// cborMember is a key/value pair of a CBOR map, with the value still encoded
+type cborMember struct {
+	// key is the string key, or the decimal representation of the integer key if intKey is true
+	key    string
+	intKey bool
+	value  cbor.RawMessage
+}
+
+// extraKey return the key of the member in the extra fields, converted by CBORIntKey if it's an integer
+func (m cborMember) extraKey() string {
+	if !m.intKey {
+		return m.key
+	}
+
+	n, _ := strconv.ParseInt(m.key, 10, 64)
+	return CBORIntKey(n)
+}
+
+// decodeCBORMap return the key/value pairs of the CBOR encoded map data, in order, with the integer keys converted to their decimal representation
+// It return no pairs if data contains null or undefined
+func decodeCBORMap(data []byte) ([]cborMember, error) {
+	// the data must be a single well formed data item
+	var raw cbor.RawMessage
+	err := cbor.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if raw[0] == 0xf6 || raw[0] == 0xf7 {
+		return nil, nil
+	}
+	if !isCBORMap(raw) {
+		return nil, errors.New("cbor: cannot unmarshal a value that isn't a map into a dynamic struct")
+	}
+
+	items, err := cborItems(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]cborMember, 0, len(items)/2)
+	for i := 0; i < len(items); i += 2 {
+		var key string
+		switch items[i][0] >> 5 {
+		case cborTextString:
+			err = cbor.Unmarshal(items[i], &key)
+		case cborUnsignedInt, cborNegativeInt:
+			var n int64
+			err = cbor.Unmarshal(items[i], &n)
+			key = strconv.FormatInt(n, 10)
+		default:
+			diag, _ := cbor.Diagnose(items[i])
+			err = errors.New("The CBOR map key " + diag + " isn't a string or an integer")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		members = append(members, cborMember{key: key, intKey: items[i][0]>>5 != cborTextString, value: items[i+1]})
+	}
+
+	return members, nil
+}
+
+// isCBORMap return true if the CBOR encoded value data is a map
+func isCBORMap(data []byte) bool {
+	return len(data) > 0 && data[0]>>5 == cborMap
+}
+
+// cborItems return the data items contained in data, a well formed CBOR array or map, in order
+// The items of a map alternate between the keys and the values
+func cborItems(data []byte) ([]cbor.RawMessage, error) {
+	major, n, indefinite, rest := parseCBORHead(data)
+	if major == cborMap {
+		n *= 2
+	}
+
+	items := make([]cbor.RawMessage, 0)
+	for i := uint64(0); indefinite || i < n; i++ {
+		// the items of indefinite length end with the break code
+		if indefinite && rest[0] == 0xff {
+			break
+		}
+
+		var item cbor.RawMessage
+		var err error
+		rest, err = cbor.UnmarshalFirst(rest, &item)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// parseCBORHead return the major type and the argument of the head of the well formed CBOR data item data, and the bytes after the head
+// indefinite is true if the data item has indefinite length
+func parseCBORHead(data []byte) (major byte, n uint64, indefinite bool, rest []byte) {
+	major = data[0] >> 5
+	info := data[0] & 0x1f
+	switch info {
+	case 24:
+		return major, uint64(data[1]), false, data[2:]
+	case 25:
+		return major, uint64(binary.BigEndian.Uint16(data[1:])), false, data[3:]
+	case 26:
+		return major, uint64(binary.BigEndian.Uint32(data[1:])), false, data[5:]
+	case 27:
+		return major, binary.BigEndian.Uint64(data[1:]), false, data[9:]
+	case 31:
+		return major, 0, true, data[1:]
+	default:
+		return major, uint64(info), false, data[1:]
+	}
+}
+
+// decodeCBORValue parses the well formed CBOR encoded data like cbor.Unmarshal into an interface{}, but it keeps the tags as cbor.Tag,
+// the half precision floats as CBORFloat16 and the single precision floats as float32
+// The maps with string keys are decoded as OrderedExtras if ordered is true, otherwise as map[string]interface{}, the other maps as map[interface{}]interface{}
+func decodeCBORValue(data []byte, ordered bool) (interface{}, error) {
+	major, n, _, rest := parseCBORHead(data)
+	switch {
+	case major == cborArray:
+		items, err := cborItems(data)
+		if err != nil {
+			return nil, err
+		}
+
+		out := make([]interface{}, len(items))
+		for i, item := range items {
+			out[i], err = decodeCBORValue(item, ordered)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case major == cborMap:
+		items, err := cborItems(data)
+		if err != nil {
+			return nil, err
+		}
+		return decodeCBORPairs(items, ordered)
+	case major == cborTag:
+		// the content of the tag is the data item after the head
+		content, err := decodeCBORValue(rest, ordered)
+		if err != nil {
+			return nil, err
+		}
+		return cbor.Tag{Number: n, Content: content}, nil
+	case data[0] == cborSimple<<5|25:
+		var f float32
+		err := cbor.Unmarshal(data, &f)
+		return CBORFloat16(f), err
+	case data[0] == cborSimple<<5|26:
+		return math.Float32frombits(uint32(n)), nil
+	default:
+		var out interface{}
+		err := cbor.Unmarshal(data, &out)
+		return out, err
+	}
+}
+
+// decodeCBORPairs decodes the keys and the values of a CBOR map, that alternate in items, like decodeCBORValue
+func decodeCBORPairs(items []cbor.RawMessage, ordered bool) (interface{}, error) {
+	keys := make([]interface{}, len(items)/2)
+	values := make([]interface{}, len(items)/2)
+	stringKeys := true
+	for i := range keys {
+		var err error
+		keys[i], err = decodeCBORValue(items[2*i], ordered)
+		if err != nil {
+			return nil, err
+		}
+		values[i], err = decodeCBORValue(items[2*i+1], ordered)
+		if err != nil {
+			return nil, err
+		}
+
+		_, ok := keys[i].(string)
+		stringKeys = stringKeys && ok
+	}
+
+	switch {
+	case !stringKeys:
+		out := make(map[interface{}]interface{}, len(keys))
+		for i, k := range keys {
+			if !isCBORHashable(k) {
+				diag, _ := cbor.Diagnose(items[2*i])
+				return nil, errors.New("The CBOR map key " + diag + " can't be decoded")
+			}
+			out[k] = values[i]
+		}
+		return out, nil
+	case ordered:
+		out := make(OrderedExtras, 0, len(keys))
+		for i, k := range keys {
+			out.Set(k.(string), values[i])
+		}
+		return out, nil
+	default:
+		out := make(map[string]interface{}, len(keys))
+		for i, k := range keys {
+			out[k.(string)] = values[i]
+		}
+		return out, nil
+	}
+}
+
+// isCBORHashable return true if the key k decoded by decodeCBORValue can be the key of a map, also if it's a tag
+func isCBORHashable(k interface{}) bool {
+	if tag, ok := k.(cbor.Tag); ok {
+		return isCBORHashable(tag.Content)
+	}
+
+	return k == nil || reflect.TypeOf(k).Comparable()
+}
+
+// decodeOrderedCBOR parses the CBOR encoded data like decodeCBORValue, with the maps with string keys decoded as OrderedExtras
+func decodeOrderedCBOR(data []byte) (interface{}, error) {
+	var raw cbor.RawMessage
+	err := cbor.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeCBORValue(raw, true)
+}
+
+// unknownCBORStructFields appends to paths the path of each member that isn't a field of the struct, also inside the values of the fields
+func unknownCBORStructFields(members []cborMember, fields *typeFields, extraFieldsName string, path string, paths []string) ([]string, error) {
+	for _, m := range members {
+		field, ok := fields.fieldByName(m.key, extraFieldsName)
+		if !ok {
+			paths = append(paths, joinPath(path, m.key))
+			continue
+		}
+
+		fieldType := fields.typ.FieldByIndex(field.index).Type
+		var err error
+		paths, err = unknownCBORFields(m.value, fieldType, joinPath(path, m.key), paths)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return paths, nil
+}
+
+// unknownCBORFields appends to paths the path of each key of the CBOR encoded data that isn't part of the type typ
+// The values that don't match typ are ignored, because they are reported by the unmarshalling
+func unknownCBORFields(data []byte, typ reflect.Type, path string, paths []string) ([]string, error) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	if typ.Kind() != reflect.Struct && (typ.Implements(cborUnmarshalerType) || reflect.PtrTo(typ).Implements(cborUnmarshalerType)) {
+		return paths, nil
+	}
+
+	switch typ.Kind() {
+	case reflect.Slice, reflect.Array:
+		var values []cbor.RawMessage
+		if cbor.Unmarshal(data, &values) != nil {
+			return paths, nil
+		}
+
+		var err error
+		for i, v := range values {
+			paths, err = unknownCBORFields(v, typ.Elem(), indexPath(path, i), paths)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case reflect.Map:
+		members, err := decodeCBORMap(data)
+		if err != nil {
+			return paths, nil
+		}
+
+		for _, m := range members {
+			paths, err = unknownCBORFields(m.value, typ.Elem(), joinPath(path, m.key), paths)
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		fields, extraFieldsName, ok, err := nestedStructFields(typ, "cbor", cborUnmarshalerType)
+		if err != nil || !ok {
+			return paths, err
+		}
+
+		members, err := decodeCBORMap(data)
+		if err != nil {
+			return paths, nil
+		}
+
+		return unknownCBORStructFields(members, fields, extraFieldsName, path, paths)
+	}
+
+	return paths, nil
+}
+
+var cborUnmarshalerType = reflect.TypeOf((*cbor.Unmarshaler)(nil)).Elem()
@@ -0,0 +1,267 @@
+// go-dyn-struct
+// Copyright (C) 2020  Andrea Laisa
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+// © 2020 GitHub, Inc.
+
+package godynstruct
+
+import (
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type Reading struct {
+	Device string  `cbor:"1,keyasint"`
+	Value  float64 `cbor:"2,keyasint"`
+	Unit   string  `cbor:"unit,omitempty"`
+	Local  string  `cbor:"-"`
+	Sensor *Dyn[Driver]
+	others OrderedExtras
+}
+
+func TestDynCBOR(t *testing.T) {
+	bignum := []byte{0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	raw, err := encodeCBORMap([]cborEntry{
+		{int64(1), "thermo-1"},
+		{int64(2), 21.5},
+		{"Sensor", OrderedExtras{{"Name", "amreo"}, {"License", "B"}}},
+		{int64(3), cbor.Tag{Number: 1, Content: uint64(1700000000)}},
+		{"energy", cbor.Tag{Number: 2, Content: bignum}},
+		{"ratio", float32(0.25)},
+		{"calibration", map[interface{}]interface{}{uint64(1): "a"}},
+	})
+	require.NoError(t, err)
+
+	var r Reading
+	require.NoError(t, DynUnmarshalCBOR(raw, reflect.ValueOf(&r), &r.others, "others"))
+	assert.Equal(t, Reading{
+		Device: "thermo-1",
+		Value:  21.5,
+		Sensor: &Dyn[Driver]{Value: Driver{Name: "amreo", Extras: Extras{"License": "B"}}},
+		others: OrderedExtras{
+			{CBORIntKey(3), cbor.Tag{Number: 1, Content: uint64(1700000000)}},
+			{"energy", cbor.Tag{Number: 2, Content: bignum}},
+			{"ratio", float32(0.25)},
+			{"calibration", map[interface{}]interface{}{uint64(1): "a"}},
+		},
+	}, r)
+
+	// the tags, the integer keys and the size of the floats are encoded again in the same way
+	r.Local = "ignored"
+	again, err := DynMarshalCBOR(reflect.ValueOf(r), r.others, "others")
+	require.NoError(t, err)
+	assert.Equal(t, raw, again)
+
+	// the tagged values are decoded like the cbor package does
+	var ts time.Time
+	require.NoError(t, r.others.Decode(CBORIntKey(3), &ts))
+	assert.True(t, time.Unix(1700000000, 0).Equal(ts))
+	var energy big.Int
+	require.NoError(t, r.others.Decode("energy", &energy))
+	assert.Equal(t, "18446744073709551616", energy.String())
+	var tag cbor.Tag
+	require.NoError(t, r.others.Decode("energy", &tag))
+	assert.Equal(t, uint64(2), tag.Number)
+
+	var d Driver
+	require.NoError(t, DynUnmarshalCBOR(raw, reflect.ValueOf(&d), &d.Extras, ""))
+	assert.Equal(t, map[string]interface{}{"Name": "amreo", "License": "B"}, d.Extras["Sensor"])
+	assert.Equal(t, "thermo-1", d.Extras[CBORIntKey(1)])
+
+	// the keys of the extra fields that look like integers are encoded as strings
+	raw, err = DynMarshalCBOR(reflect.ValueOf(Driver{Name: "amreo"}), Extras{"1": true}, "Extras")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xa2, 0x64, 'N', 'a', 'm', 'e', 0x65, 'a', 'm', 'r', 'e', 'o', 0x61, '1', 0xf5}, raw)
+
+	// null leaves the struct as it is
+	require.NoError(t, DynUnmarshalCBOR([]byte{0xf6}, reflect.ValueOf(&r), &r.others, "others"))
+	assert.Equal(t, "thermo-1", r.Device)
+
+	assert.Error(t, DynUnmarshalCBOR([]byte{0x81, 0x01}, reflect.ValueOf(&r), &r.others, "others"))
+	assert.Error(t, DynUnmarshalCBOR([]byte{0xa1, 0x41, 0x01, 0x01}, reflect.ValueOf(&r), &r.others, "others"))
+	assert.Error(t, DynUnmarshalCBOR([]byte{0xa0, 0x00}, reflect.ValueOf(&r), &r.others, "others"))
+	assert.Error(t, DynUnmarshalCBOR([]byte{0xa1, 0x61}, reflect.ValueOf(&r), &r.others, "others"))
+
+	type Invalid struct {
+		Device string `cbor:"device,keyasint"`
+		others OrderedExtras
+	}
+	_, err = DynMarshalCBOR(reflect.ValueOf(Invalid{}), nil, "others")
+	assert.EqualError(t, err, "The field Device has the keyasint option, but its name device isn't an integer")
+}
+
+func TestDynCBOROptions(t *testing.T) {
+	// an indefinite length map
+	raw := []byte{0xbf, 0x01, 0x62, 'd', '1', 0x64, 'n', 'o', 't', 'e', 0xc1, 0x1a, 0x65, 0x53, 0xf1, 0x00, 0xff}
+
+	var r Reading
+	err := Options{DisallowUnknownFields: true}.DynUnmarshalCBOR(raw, reflect.ValueOf(&r), &r.others, "others")
+	assert.Equal(t, &UnknownFieldsError{Paths: []string{"note"}}, err)
+
+	r = Reading{}
+	require.NoError(t, Options{RawExtras: true}.DynUnmarshalCBOR(raw, reflect.ValueOf(&r), &r.others, "others"))
+	assert.Equal(t, "d1", r.Device)
+	assert.Equal(t, OrderedExtras{{"note", cbor.RawMessage{0xc1, 0x1a, 0x65, 0x53, 0xf1, 0x00}}}, r.others)
+	var note time.Time
+	require.NoError(t, r.others.Decode("note", &note))
+	assert.True(t, time.Unix(1700000000, 0).Equal(note))
+
+	again, err := DynMarshalCBOR(reflect.ValueOf(r), r.others, "others")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xa4, 0x01, 0x62, 'd', '1', 0x02, 0xfb, 0, 0, 0, 0, 0, 0, 0, 0, 0x66, 'S', 'e', 'n', 's', 'o', 'r', 0xf6, 0x64, 'n', 'o', 't', 'e', 0xc1, 0x1a, 0x65, 0x53, 0xf1, 0x00}, again)
+
+	// the raw extra fields are decoded when they are encoded in another format
+	json, err := DynMarshalJSON(reflect.ValueOf(Event{Name: "login"}), OrderedExtras{{"extra", cbor.RawMessage{0x82, 0x01, 0x20}}}, "")
+	require.NoError(t, err)
+	assert.Equal(t, `{"name":"login","source":"","extra":[1,-1]}`, string(json))
+
+	var e OrderedExtras
+	require.NoError(t, cbor.Unmarshal([]byte{0xa2, 0x61, 'b', 0x01, 0x61, 'a', 0xc1, 0x00}, &e))
+	assert.Equal(t, OrderedExtras{{"b", uint64(1)}, {"a", cbor.Tag{Number: 1, Content: uint64(0)}}}, e)
+	out, err := cbor.Marshal(e)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xa2, 0x61, 'b', 0x01, 0x61, 'a', 0xc1, 0x00}, out)
+	assert.Error(t, cbor.Unmarshal([]byte{0xa1, 0x01, 0x01}, &e))
+}
+
+func TestDynCBORKeys(t *testing.T) {
+	// the integer keys and the half precision floats are decoded and encoded again in the same way, also without keyasint fields
+	raw := []byte{0xa5,
+		0x64, 'N', 'a', 'm', 'e', 0x65, 'a', 'm', 'r', 'e', 'o',
+		0x01, 0xf9, 0x3e, 0x00,
+		0x61, '1', 0xf9, 0x7c, 0x00,
+		0x38, 0x63, 0xa1, 0x01, 0xf9, 0xc0, 0x00,
+		0x1b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x82, 0xf9, 0x00, 0x01, 0xfa, 0x3f, 0xc0, 0x00, 0x00,
+	}
+
+	var d Driver
+	require.NoError(t, DynUnmarshalCBOR(raw, reflect.ValueOf(&d), &d.Extras, ""))
+	assert.Equal(t, Driver{Name: "amreo", Extras: Extras{
+		CBORIntKey(1):             CBORFloat16(1.5),
+		"1":                       CBORFloat16(float32(math.Inf(1))),
+		CBORIntKey(-100):          map[interface{}]interface{}{uint64(1): CBORFloat16(-2)},
+		CBORIntKey(math.MaxInt64): []interface{}{CBORFloat16(math.Float32frombits(0x33800000)), float32(1.5)},
+	}}, d)
+
+	var o OrderedExtras
+	require.NoError(t, DynUnmarshalCBOR(raw, reflect.ValueOf(&Driver{}), &o, "Extras"))
+	assert.Equal(t, OrderedExtras{
+		{CBORIntKey(1), CBORFloat16(1.5)},
+		{"1", CBORFloat16(float32(math.Inf(1)))},
+		{CBORIntKey(-100), map[interface{}]interface{}{uint64(1): CBORFloat16(-2)}},
+		{CBORIntKey(math.MaxInt64), []interface{}{CBORFloat16(math.Float32frombits(0x33800000)), float32(1.5)}},
+	}, o)
+
+	again, err := DynMarshalCBOR(reflect.ValueOf(Driver{Name: "amreo"}), o, "Extras")
+	require.NoError(t, err)
+	assert.Equal(t, raw, again)
+
+	again, err = cbor.Marshal(o)
+	require.NoError(t, err)
+	assert.Equal(t, raw[0x0c:], again[1:])
+
+	// the integer keys match the fields with the keyasint option
+	var r Reading
+	require.NoError(t, DynUnmarshalCBOR([]byte{0xa2, 0x01, 0x61, 'a', 0x03, 0xf9, 0x3c, 0x00}, reflect.ValueOf(&r), &r.others, "others"))
+	assert.Equal(t, "a", r.Device)
+	assert.Equal(t, OrderedExtras{{CBORIntKey(3), CBORFloat16(1)}}, r.others)
+
+	// the keys that aren't made by CBORIntKey are encoded as strings
+	again, err = DynMarshalCBOR(reflect.ValueOf(Driver{Name: "amreo"}), Extras{"\xff01": true}, "Extras")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xa2, 0x64, 'N', 'a', 'm', 'e', 0x65, 'a', 'm', 'r', 'e', 'o', 0x63, 0xff, '0', '1', 0xf5}, again)
+
+	// the half precision floats are encoded as numbers in the other formats
+	json, err := DynMarshalJSON(reflect.ValueOf(Driver{Name: "amreo"}), Extras{"half": CBORFloat16(1.5)}, "Extras")
+	require.NoError(t, err)
+	assert.Equal(t, `{"Name":"amreo","half":1.5}`, string(json))
+
+	// the keys that can't be the keys of a map are rejected, also inside a tag
+	var nested Driver
+	err = DynUnmarshalCBOR([]byte{0xa1, 0x61, 'x', 0xa1, 0xda, 0x61, 0x61, 0x01, 0x63, 0x40, 0x01}, reflect.ValueOf(&nested), &nested.Extras, "")
+	assert.EqualError(t, err, "The CBOR map key 1633747299(h'') can't be decoded")
+	err = FromCBOR([]byte{0xa1, 0x61, 'x', 0xa1, 0xd8, 0x64, 0x81, 0x01, 0xf6}, &nested)
+	assert.EqualError(t, err, "The CBOR map key 100([1]) can't be decoded")
+
+	// the tags that can be keys are kept
+	require.NoError(t, FromCBOR([]byte{0xa1, 0x61, 'x', 0xa1, 0xc1, 0x01, 0xf6}, &nested))
+	assert.Equal(t, Extras{"x": map[interface{}]interface{}{cbor.Tag{Number: 1, Content: uint64(1)}: nil}}, nested.Extras)
+
+	// the keys of the nested maps are sorted, so the encoding is always the same
+	sorted := Driver{Name: "amreo", Extras: Extras{"m": map[string]interface{}{"bb": 1, "a": 2, "c": 3, "d": 4, "e": 5}}}
+	for i := 0; i < 20; i++ {
+		again, err = ToCBOR(sorted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0xa2, 0x64, 'N', 'a', 'm', 'e', 0x65, 'a', 'm', 'r', 'e', 'o',
+			0x61, 'm', 0xa5, 0x61, 'a', 0x02, 0x61, 'c', 0x03, 0x61, 'd', 0x04, 0x61, 'e', 0x05, 0x62, 'b', 'b', 0x01}, again)
+	}
+
+	// the floats that aren't half precision are encoded with more precision
+	again, err = cbor.Marshal(CBORFloat16(0.1))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xfa, 0x3d, 0xcc, 0xcc, 0xcd}, again)
+	again, err = cbor.Marshal([]CBORFloat16{CBORFloat16(math.NaN()), 65504, -0})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x83, 0xf9, 0x7e, 0x00, 0xf9, 0x7b, 0xff, 0xf9, 0x00, 0x00}, again)
+}
+
+func TestDynCBORToOtherFormats(t *testing.T) {
+	// the integer keys and the tags are converted in the formats other than CBOR
+	raw := []byte{0xa4,
+		0x64, 'N', 'a', 'm', 'e', 0x65, 'a', 'm', 'r', 'e', 'o',
+		0x01, 0xd8, 0x64, 0x05,
+		0x61, 't', 0xc1, 0x19, 0x03, 0xe8,
+		0x61, 'm', 0xa1, 0x02, 0x82, 0x61, 'x', 0xd8, 0x64, 0xa1, 0x03, 0xf5,
+	}
+
+	var d Driver
+	require.NoError(t, FromCBOR(raw, &d))
+	assert.Equal(t, Extras{
+		CBORIntKey(1): cbor.Tag{Number: 100, Content: uint64(5)},
+		"t":           cbor.Tag{Number: 1, Content: uint64(1000)},
+		"m":           map[interface{}]interface{}{uint64(2): []interface{}{"x", cbor.Tag{Number: 100, Content: map[interface{}]interface{}{uint64(3): true}}}},
+	}, d.Extras)
+
+	json, err := ToJSON(d)
+	require.NoError(t, err)
+	assert.Equal(t, `{"Name":"amreo","m":{"2":["x",{"3":true}]},"t":1000,"1":5}`, string(json))
+
+	yaml, err := ToYAML(d)
+	require.NoError(t, err)
+	assert.Equal(t, "name: amreo\nm:\n    \"2\":\n        - x\n        - \"3\": true\nt: 1000\n\"1\": 5\n", string(yaml))
+
+	// the ordered extra fields are converted too, without changing the original values
+	var o OrderedExtras
+	require.NoError(t, DynUnmarshalCBOR(raw, reflect.ValueOf(&Driver{}), &o, "Extras"))
+	json, err = DynMarshalJSON(reflect.ValueOf(Driver{Name: "amreo"}), OrderedExtras{{"o", o}}, "Extras")
+	require.NoError(t, err)
+	assert.Equal(t, `{"Name":"amreo","o":{"1":5,"t":1000,"m":{"2":["x",{"3":true}]}}}`, string(json))
+	assert.Equal(t, ExtraField{CBORIntKey(1), cbor.Tag{Number: 100, Content: uint64(5)}}, o[0])
+
+	// CBOR keeps them
+	again, err := ToCBOR(d)
+	require.NoError(t, err)
+	assert.Equal(t, raw[:12], again[:12])
+	var back Driver
+	require.NoError(t, FromCBOR(again, &back))
+	assert.Equal(t, d, back)
+}
@@ -20,19 +20,54 @@ package godynstruct
 import (
 	"errors"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"unsafe"
 )
 
+// fieldInfo contains the informations about a field of a struct obtained from its tags
 type fieldInfo struct {
+	name            string
 	actualFieldName string
-	fieldValue      reflect.Value
+	index           []int
+	tagged          bool
 	omitted         bool
 	omitEmpty       bool
+	extras          bool
+	inline          bool
+	minSize         bool
+	truncate        bool
+	quoted          bool
+	flow            bool
+	keyAsInt        bool
+	attr            bool
+	any             bool
+	// xmlContent is the xml tag option chardata, cdata, innerxml or comment
+	xmlContent string
 }
 
-func buildFieldInfo(fieldName string, fieldValue reflect.Value, tags string) (fieldInfo, error) {
+// formatOptions contains, for each tag option that is specific to some formats, the tag keys that accept it
+var formatOptions = map[string]map[string]bool{
+	"inline":   {"bson": true, "yaml": true},
+	"flow":     {"yaml": true},
+	"minsize":  {"bson": true},
+	"truncate": {"bson": true},
+	"string":   {"json": true},
+	"keyasint": {"cbor": true},
+	"attr":     {"xml": true},
+	"any":      {"xml": true},
+	"chardata": {"xml": true},
+	"cdata":    {"xml": true},
+	"innerxml": {"xml": true},
+	"comment":  {"xml": true},
+}
+
+func buildFieldInfo(fieldName string, index []int, tagKey string, tags string) (fieldInfo, error) {
 	out := fieldInfo{
-		fieldValue: fieldValue,
+		name:  fieldName,
+		index: index,
 	}
 
 	if tags == "-" {
@@ -41,15 +76,47 @@ func buildFieldInfo(fieldName string, fieldValue reflect.Value, tags string) (fi
 	}
 
 	out.actualFieldName = fieldName
+	if tagKey == "yaml" {
+		// like the yaml package, the default key is the name of the field lowercased
+		out.actualFieldName = strings.ToLower(fieldName)
+	}
 	parts := strings.Split(tags, ",")
 	if parts[0] != "" {
 		out.actualFieldName = parts[0]
+		out.tagged = true
 	}
 
 	for _, part := range parts[1:] {
+		if tagKeys, ok := formatOptions[part]; ok && !tagKeys[tagKey] {
+			return fieldInfo{}, errors.New("Unrecognized part in field tags " + tags)
+		}
+
 		switch part {
 		case "omitempty":
 			out.omitEmpty = true
+		case "extras":
+			out.extras = true
+		case "inline":
+			out.inline = true
+		case "minsize":
+			out.minSize = true
+		case "truncate":
+			out.truncate = true
+		case "string":
+			out.quoted = true
+		case "flow":
+			out.flow = true
+		case "keyasint":
+			if _, err := strconv.ParseInt(out.actualFieldName, 10, 64); err != nil {
+				return fieldInfo{}, errors.New("The field " + fieldName + " has the keyasint option, but its name " + out.actualFieldName + " isn't an integer")
+			}
+			out.keyAsInt = true
+		case "attr":
+			out.attr = true
+		case "any":
+			out.any = true
+		case "chardata", "cdata", "innerxml", "comment":
+			out.xmlContent = part
 		default:
 			return fieldInfo{}, errors.New("Unrecognized part in field tags " + tags)
 		}
@@ -57,3 +124,520 @@ func buildFieldInfo(fieldName string, fieldValue reflect.Value, tags string) (fi
 
 	return out, nil
 }
+
+// is return true if fi is the field named name of the outer struct
+func (fi fieldInfo) is(name string) bool {
+	return len(fi.index) == 1 && fi.name == name
+}
+
+// typeFields is the precomputed list of the fields of a struct type for a tag key
+type typeFields struct {
+	typ reflect.Type
+	// list contains the fields that aren't omitted, including the ones promoted from the embedded structs, in declaration order
+	list []fieldInfo
+	// byName maps the actual name of each field to its position in list
+	byName map[string]int
+	// extras contains the fields of type Extras, OrderedExtras or marked with the extras tag option, even if omitted
+	extras []fieldInfo
+	// unexported is true if some fields in list are reached through unexported embedded structs
+	unexported bool
+}
+
+// fieldByName return the field named actualFieldName, except the field extraFieldsName
+func (tf *typeFields) fieldByName(actualFieldName string, extraFieldsName string) (fieldInfo, bool) {
+	i, ok := tf.byName[actualFieldName]
+	if !ok || tf.list[i].is(extraFieldsName) {
+		return fieldInfo{}, false
+	}
+
+	return tf.list[i], true
+}
+
+// extrasFieldName return extraFieldsName, checking that it's a field that can contain the extra fields,
+// or, if it's empty, the name of the only field that contains the extra fields
+func (tf *typeFields) extrasFieldName(extraFieldsName string) (string, error) {
+	if extraFieldsName != "" {
+		sf, ok := tf.typ.FieldByName(extraFieldsName)
+		if !ok || len(sf.Index) != 1 {
+			return "", errors.New("The struct " + tf.typ.String() + " doesn't have a field named " + extraFieldsName)
+		}
+		if !isExtrasType(sf.Type) {
+			return "", errors.New("The field " + extraFieldsName + " of " + tf.typ.String() + " isn't of type Extras, OrderedExtras or map[string]interface{}")
+		}
+		return extraFieldsName, nil
+	}
+
+	fi, err := tf.extrasField()
+	if err != nil {
+		return "", err
+	}
+
+	return fi.name, nil
+}
+
+// extrasField return the only field that contains the extra fields
+func (tf *typeFields) extrasField() (fieldInfo, error) {
+	switch len(tf.extras) {
+	case 0:
+		return fieldInfo{}, errors.New("The struct " + tf.typ.String() + ` doesn't have a field of type Extras, OrderedExtras or tagged with dyn:",extras"`)
+	case 1:
+		return tf.extras[0], nil
+	default:
+		return fieldInfo{}, errors.New("The struct " + tf.typ.String() + ` has more than one field of type Extras, OrderedExtras or tagged with dyn:",extras"`)
+	}
+}
+
+// embeddedStruct is a struct whose fields are promoted into the fields of the outer struct
+type embeddedStruct struct {
+	typ        reflect.Type
+	index      []int
+	unexported bool
+}
+
+// buildTypeFields walks the fields of typ and parses the tagKey tag of each one
+// For the json, toml, msgpack, cbor and xml tag keys the fields of the untagged embedded structs are promoted with the same rules of encoding/json
+// For the tag keys that accept the inline option the fields of the inline structs are promoted with the same rules of the mongo driver,
+// and the inline map is a field that contains the extra fields
+func buildTypeFields(typ reflect.Type, tagKey string) (*typeFields, error) {
+	if typ.Kind() != reflect.Struct {
+		return nil, errors.New("The type " + typ.String() + " isn't a struct")
+	}
+
+	out := &typeFields{
+		typ:    typ,
+		byName: make(map[string]int, typ.NumField()),
+	}
+
+	flatten := tagKey == "json" || tagKey == "toml" || tagKey == "msgpack" || tagKey == "cbor" || tagKey == "xml"
+	inline := formatOptions["inline"][tagKey]
+	fields := make([]fieldInfo, 0, typ.NumField())
+
+	// visit the embedded structs breadth first, so the fields less nested are found first
+	current := []embeddedStruct{}
+	next := []embeddedStruct{{typ: typ}}
+	var count, nextCount map[reflect.Type]int
+	visited := make(map[reflect.Type]bool)
+
+	for len(next) > 0 {
+		current, next = next, current[:0]
+		count, nextCount = nextCount, make(map[reflect.Type]int)
+
+		for _, es := range current {
+			if visited[es.typ] {
+				if inline {
+					return nil, errors.New("(struct " + typ.String() + ") the struct " + es.typ.String() + " is inlined more than once")
+				}
+				continue
+			}
+			visited[es.typ] = true
+
+			for i := 0; i < es.typ.NumField(); i++ {
+				sf := es.typ.Field(i)
+				index := make([]int, len(es.index)+1)
+				copy(index, es.index)
+				index[len(es.index)] = i
+
+				val, _ := sf.Tag.Lookup(tagKey)
+				info, err := buildFieldInfo(sf.Name, index, tagKey, val)
+				if err != nil {
+					return nil, err
+				}
+
+				// the extras field can only be a field of typ
+				if len(es.index) == 0 {
+					dynTag, _ := sf.Tag.Lookup("dyn")
+					dynInfo, err := buildFieldInfo(sf.Name, index, "dyn", dynTag)
+					if err != nil {
+						return nil, err
+					}
+
+					if info.inline && sf.Type.Kind() == reflect.Map {
+						info.extras = true
+					}
+
+					if dynInfo.extras || info.extras {
+						if !isExtrasType(sf.Type) {
+							return nil, errors.New("The extras field " + sf.Name + " of " + typ.String() + " must be a map[string]interface{} or OrderedExtras")
+						}
+						info.extras = true
+					}
+
+					if info.extras || sf.Type == extrasType || sf.Type == orderedExtrasType {
+						out.extras = append(out.extras, info)
+					}
+				}
+
+				if info.omitted {
+					continue
+				}
+
+				if sf.PkgPath != "" && inline {
+					// like the mongo driver, the unexported fields are ignored, also the inline structs
+					continue
+				}
+
+				ft := sf.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+
+				// like encoding/json, the string option is ignored if the field isn't a scalar
+				switch ft.Kind() {
+				case reflect.Bool,
+					reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+					reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+					reflect.Float32, reflect.Float64,
+					reflect.String:
+				default:
+					info.quoted = false
+				}
+				promote := flatten && sf.Anonymous && !info.tagged && ft.Kind() == reflect.Struct
+				if info.inline {
+					switch {
+					case ft.Kind() == reflect.Struct:
+						promote = true
+					case sf.Type.Kind() == reflect.Map:
+						// the inline map of the outer struct is an extras field, the others are ignored like the mongo driver does
+						continue
+					default:
+						return nil, errors.New("(struct " + typ.String() + ") inline fields must be a struct, a struct pointer, or a map")
+					}
+				}
+
+				if sf.PkgPath != "" && !promote {
+					// unexported fields are ignored, except the embedded structs
+					continue
+				}
+
+				if !promote {
+					if es.unexported {
+						out.unexported = true
+					}
+					fields = append(fields, info)
+					if count[es.typ] > 1 {
+						// the struct has been embedded more than once at the same depth,
+						// so the field is added twice to make it conflict with itself
+						fields = append(fields, info)
+					}
+					continue
+				}
+
+				nextCount[ft]++
+				if nextCount[ft] == 1 {
+					next = append(next, embeddedStruct{
+						typ:        ft,
+						index:      index,
+						unexported: es.unexported || sf.PkgPath != "",
+					})
+				}
+			}
+		}
+	}
+
+	if inline {
+		// the mongo driver doesn't allow the inline structs to have fields with the same name
+		names := make(map[string]bool, len(fields))
+		for _, fi := range fields {
+			if names[fi.actualFieldName] {
+				return nil, errors.New("(struct " + typ.String() + ") duplicated key " + fi.actualFieldName)
+			}
+			names[fi.actualFieldName] = true
+		}
+	}
+
+	// sort the fields by name, then by depth, then by the presence of the tag
+	sort.Slice(fields, func(i, j int) bool {
+		if fields[i].actualFieldName != fields[j].actualFieldName {
+			return fields[i].actualFieldName < fields[j].actualFieldName
+		}
+		if len(fields[i].index) != len(fields[j].index) {
+			return len(fields[i].index) < len(fields[j].index)
+		}
+		if fields[i].tagged != fields[j].tagged {
+			return fields[i].tagged
+		}
+		return indexLess(fields[i].index, fields[j].index)
+	})
+
+	// keep only the dominant field of each name, the names without one are dropped
+	out.list = fields[:0]
+	for advance, i := 0, 0; i < len(fields); i += advance {
+		for advance = 1; i+advance < len(fields); advance++ {
+			if fields[i+advance].actualFieldName != fields[i].actualFieldName {
+				break
+			}
+		}
+
+		if advance == 1 || len(fields[i].index) != len(fields[i+1].index) || fields[i].tagged != fields[i+1].tagged {
+			out.list = append(out.list, fields[i])
+		}
+	}
+
+	sort.Slice(out.list, func(i, j int) bool {
+		return indexLess(out.list[i].index, out.list[j].index)
+	})
+
+	for i, fi := range out.list {
+		out.byName[fi.actualFieldName] = i
+	}
+
+	return out, nil
+}
+
+// indexLess return true if the field at index a comes before the field at index b
+func indexLess(a, b []int) bool {
+	for k, x := range a {
+		if k >= len(b) {
+			return false
+		}
+		if x != b[k] {
+			return x < b[k]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// fieldByIndex return the field of _struct at index
+// ok is false if the field is inside an embedded struct pointer that is nil
+func fieldByIndex(_struct reflect.Value, index []int) (field reflect.Value, ok bool) {
+	field = _struct
+	for i, x := range index {
+		if i > 0 && field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				return reflect.Value{}, false
+			}
+			field = field.Elem()
+		}
+		field = field.Field(x)
+	}
+
+	return exportedValue(field), true
+}
+
+// fieldByIndexAlloc return the field of _struct at index, allocating the embedded struct pointers that are nil
+// _struct must be addressable
+func fieldByIndexAlloc(_struct reflect.Value, index []int) (reflect.Value, error) {
+	field := _struct
+	for i, x := range index {
+		if i > 0 && field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				if !field.CanSet() {
+					return reflect.Value{}, errors.New("Cannot set embedded pointer to unexported struct " + field.Type().Elem().String())
+				}
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			field = field.Elem()
+		}
+		field = field.Field(x)
+	}
+
+	return exportedValue(field), nil
+}
+
+// exportedValue return v or, if v has been obtained through an unexported field, a value that points to the same memory without the restrictions
+// v must be addressable if it has been obtained through an unexported field
+func exportedValue(v reflect.Value) reflect.Value {
+	if v.CanInterface() {
+		return v
+	}
+
+	return reflect.NewAt(v.Type(), unsafe.Pointer(v.UnsafeAddr())).Elem()
+}
+
+// addressableStruct return _struct or, if it isn't addressable, an addressable copy of it
+func addressableStruct(_struct reflect.Value) reflect.Value {
+	if _struct.CanAddr() {
+		return _struct
+	}
+
+	out := reflect.New(_struct.Type()).Elem()
+	out.Set(_struct)
+	return out
+}
+
+type typeFieldsKey struct {
+	typ    reflect.Type
+	tagKey string
+}
+
+// fieldCache contains the *typeFields of every struct type already seen, keyed by typeFieldsKey
+var fieldCache sync.Map
+
+// cachedTypeFields is like buildTypeFields but it computes the fields of each type and tag key only once
+func cachedTypeFields(typ reflect.Type, tagKey string) (*typeFields, error) {
+	key := typeFieldsKey{typ, tagKey}
+	if tf, ok := fieldCache.Load(key); ok {
+		return tf.(*typeFields), nil
+	}
+
+	tf, err := buildTypeFields(typ, tagKey)
+	if err != nil {
+		return nil, err
+	}
+
+	actual, _ := fieldCache.LoadOrStore(key, tf)
+	return actual.(*typeFields), nil
+}
+
+// dynDest is the destination of the unmarshalling of a dynamic struct
+type dynDest struct {
+	// ptrStruct is the pointer to the struct
+	ptrStruct       reflect.Value
+	fields          *typeFields
+	extraFieldsName string
+	extras          *extrasDest
+}
+
+// newDynDest initializes the container of the extra fields pointed by extraFieldsPtr, emptying it unless merge is true,
+// and return the destination of the unmarshalling of the struct pointed by ptrStruct for the tag key tagKey
+func newDynDest(ptrStruct reflect.Value, extraFieldsPtr interface{}, extraFieldsName string, tagKey string, merge bool) (*dynDest, error) {
+	if !ptrStruct.IsValid() || ptrStruct.Kind() != reflect.Ptr || ptrStruct.IsNil() {
+		return nil, errors.New("The value " + describeValue(ptrStruct) + " isn't a non-nil pointer to a struct")
+	}
+
+	extras, err := newExtrasDest(extraFieldsPtr, merge)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := cachedTypeFields(reflect.Indirect(ptrStruct).Type(), tagKey)
+	if err != nil {
+		return nil, err
+	}
+	extraFieldsName, err = fields.extrasFieldName(extraFieldsName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynDest{ptrStruct: ptrStruct, fields: fields, extraFieldsName: extraFieldsName, extras: extras}, nil
+}
+
+// field return the field of the struct with the name key, ok is false if key is the name of an extra field
+func (d *dynDest) field(key string) (fi fieldInfo, ok bool) {
+	return d.fields.fieldByName(key, d.extraFieldsName)
+}
+
+// fieldValue return the value of the field fi of the struct, allocating the nil embedded pointers
+func (d *dynDest) fieldValue(fi fieldInfo) (reflect.Value, error) {
+	return fieldByIndexAlloc(d.ptrStruct.Elem(), fi.index)
+}
+
+// fieldType return the type of the field fi of the struct
+func (d *dynDest) fieldType(fi fieldInfo) reflect.Type {
+	return d.fields.typ.FieldByIndex(fi.index).Type
+}
+
+// dynMember is a key/value pair of the encoding of a dynamic struct
+type dynMember struct {
+	key   string
+	value interface{}
+	// field is the field of the struct encoded by the member, the zero fieldInfo for the extra fields that aren't part of the struct
+	field fieldInfo
+	// extra is true if value is the value of an extra field
+	extra bool
+}
+
+// dynMembers return the members of the encoding of the dynamic struct _struct for the tag key tagKey:
+// the fields of the struct in declaration order, except extraFieldsName and the empty fields with the omitempty option,
+// followed by the extra fields sorted by key, or in their order if they are OrderedExtras
+// The extra fields with the same name of a field of the struct are applied by the collision policy,
+// and their values are made ready to be encoded in the format of tagKey by portableExtraValue
+func (o Options) dynMembers(_struct reflect.Value, extraFields interface{}, extraFieldsName string, tagKey string) ([]dynMember, error) {
+	extras, err := extrasList(extraFields)
+	if err != nil {
+		return nil, err
+	}
+
+	_struct, err = indirectStruct(_struct)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := cachedTypeFields(_struct.Type(), tagKey)
+	if err != nil {
+		return nil, err
+	}
+	extraFieldsName, err = fields.extrasFieldName(extraFieldsName)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides, extras, err := o.Collisions.resolveCollisions(extras, fields, extraFieldsName)
+	if err != nil {
+		return nil, err
+	}
+
+	if fields.unexported {
+		// the fields promoted from unexported embedded structs can be read only from an addressable struct
+		_struct = addressableStruct(_struct)
+	}
+
+	out := make([]dynMember, 0, len(fields.list)+len(extras))
+	for _, fi := range fields.list {
+		if fi.is(extraFieldsName) {
+			continue
+		}
+
+		if v, ok := overrides[fi.actualFieldName]; ok {
+			// the extra field overwrites the field of the struct
+			v, err = portableExtraValue(v, tagKey)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, dynMember{key: fi.actualFieldName, value: v, field: fi, extra: true})
+			continue
+		}
+
+		fieldValue, ok := fieldByIndex(_struct, fi.index)
+		if !ok || (fi.omitEmpty && fieldValue.IsZero()) {
+			continue
+		}
+
+		out = append(out, dynMember{key: fi.actualFieldName, value: fieldValue.Interface(), field: fi})
+	}
+
+	// add the missing extra fields
+	for _, f := range extras {
+		if _, ok := f.Value.(XMLOrder); ok && tagKey != "xml" {
+			// the order of the attributes and of the elements is meaningful only in XML
+			continue
+		}
+		v, err := portableExtraValue(f.Value, tagKey)
+		if err != nil {
+			return nil, err
+		}
+		key := f.Key
+		if tagKey != "cbor" {
+			// the integer keys of CBOR are strings in the other formats
+			key = portableCBORKey(key)
+		}
+		out = append(out, dynMember{key: key, value: v, extra: true})
+	}
+
+	return out, nil
+}
+
+// indirectStruct return _struct, or the value pointed by _struct if it's a pointer, checking that it's a struct
+func indirectStruct(_struct reflect.Value) (reflect.Value, error) {
+	if _struct.Kind() == reflect.Ptr {
+		if _struct.IsNil() {
+			return reflect.Value{}, errors.New("The pointer of type " + _struct.Type().String() + " is nil")
+		}
+		_struct = _struct.Elem()
+	}
+
+	if _struct.Kind() != reflect.Struct {
+		return reflect.Value{}, errors.New("The value " + describeValue(_struct) + " isn't a struct or a pointer to a struct")
+	}
+
+	return _struct, nil
+}
+
+// describeValue return the description of the type of v for the error messages
+func describeValue(v reflect.Value) string {
+	if !v.IsValid() {
+		return "nil"
+	}
+
+	return "of type " + v.Type().String()
+}
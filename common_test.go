@@ -22,6 +22,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type Person struct {
@@ -63,51 +64,197 @@ func ptrBool(val bool) *bool {
 }
 
 func TestBuildFieldInfo(t *testing.T) {
-	var ftt FooTagsTest
-	fttValue := reflect.ValueOf(ftt)
-
-	outInfo, err := buildFieldInfo("Normal", fttValue, "")
+	outInfo, err := buildFieldInfo("Normal", []int{0}, "json", "")
 	assert.NoError(t, err)
 	assert.Equal(t, fieldInfo{
+		name:            "Normal",
 		actualFieldName: "Normal",
-		fieldValue:      fttValue,
+		index:           []int{0},
 		omitted:         false,
 		omitEmpty:       false,
 	}, outInfo)
 
-	outInfo, err = buildFieldInfo("Renamed", fttValue, "Bar")
+	outInfo, err = buildFieldInfo("Renamed", []int{1}, "json", "Bar")
 	assert.NoError(t, err)
 	assert.Equal(t, fieldInfo{
+		name:            "Renamed",
 		actualFieldName: "Bar",
-		fieldValue:      fttValue,
+		index:           []int{1},
+		tagged:          true,
 		omitted:         false,
 		omitEmpty:       false,
 	}, outInfo)
 
-	outInfo, err = buildFieldInfo("Hidden", fttValue, "-")
+	outInfo, err = buildFieldInfo("Hidden", []int{2}, "json", "-")
 	assert.NoError(t, err)
 	assert.Equal(t, fieldInfo{
+		name:            "Hidden",
 		actualFieldName: "",
-		fieldValue:      fttValue,
+		index:           []int{2},
 		omitted:         true,
 		omitEmpty:       false,
 	}, outInfo)
 
-	outInfo, err = buildFieldInfo("RenamedOmitEmpty", fttValue, "ROE,omitempty")
+	outInfo, err = buildFieldInfo("RenamedOmitEmpty", []int{3}, "json", "ROE,omitempty")
 	assert.NoError(t, err)
 	assert.Equal(t, fieldInfo{
+		name:            "RenamedOmitEmpty",
 		actualFieldName: "ROE",
-		fieldValue:      fttValue,
+		index:           []int{3},
+		tagged:          true,
 		omitted:         false,
 		omitEmpty:       true,
 	}, outInfo)
 
-	outInfo, err = buildFieldInfo("OnlyOmitEmtpy", fttValue, ",omitempty")
+	outInfo, err = buildFieldInfo("OnlyOmitEmtpy", []int{4}, "json", ",omitempty")
 	assert.NoError(t, err)
 	assert.Equal(t, fieldInfo{
+		name:            "OnlyOmitEmtpy",
 		actualFieldName: "OnlyOmitEmtpy",
-		fieldValue:      fttValue,
+		index:           []int{4},
 		omitted:         false,
 		omitEmpty:       true,
 	}, outInfo)
+
+	outInfo, err = buildFieldInfo("Others", []int{5}, "json", ",extras")
+	assert.NoError(t, err)
+	assert.Equal(t, fieldInfo{
+		name:            "Others",
+		actualFieldName: "Others",
+		index:           []int{5},
+		omitted:         false,
+		omitEmpty:       false,
+		extras:          true,
+	}, outInfo)
+
+	_, err = buildFieldInfo("Wrong", []int{6}, "json", "Wrong,foobar")
+	assert.Error(t, err)
+}
+
+func TestBuildTypeFields(t *testing.T) {
+	fields, err := buildTypeFields(reflect.TypeOf(FooTagsTest{}), "json")
+	require.NoError(t, err)
+
+	names := make([]string, 0)
+	for _, fi := range fields.list {
+		names = append(names, fi.actualFieldName)
+	}
+	assert.Equal(t, []string{"Normal", "Bar", "ROE", "OnlyOmitEmtpy", "ROE2", "OnlyOmitEmtpy2"}, names)
+
+	fi, ok := fields.fieldByName("Bar", "_otherInfo")
+	assert.True(t, ok)
+	assert.Equal(t, []int{1}, fi.index)
+
+	_, ok = fields.fieldByName("Hidden", "_otherInfo")
+	assert.False(t, ok)
+
+	_, ok = fields.fieldByName("_otherInfo", "_otherInfo")
+	assert.False(t, ok)
+}
+
+func TestExtrasFieldName(t *testing.T) {
+	type byDynTag struct {
+		Name   string
+		Others map[string]interface{} `dyn:",extras"`
+	}
+	type byJSONTag struct {
+		Name   string
+		Others map[string]interface{} `json:",extras"`
+	}
+	type byType struct {
+		Name   string
+		others Extras
+	}
+	type withoutExtras struct {
+		Name string
+	}
+	type twoExtras struct {
+		Name   string
+		Others map[string]interface{} `dyn:",extras"`
+		others Extras
+	}
+	type wrongExtras struct {
+		Others []string `dyn:",extras"`
+	}
+
+	fields, err := buildTypeFields(reflect.TypeOf(byDynTag{}), "json")
+	require.NoError(t, err)
+	name, err := fields.extrasFieldName("")
+	assert.NoError(t, err)
+	assert.Equal(t, "Others", name)
+
+	fields, err = buildTypeFields(reflect.TypeOf(byJSONTag{}), "json")
+	require.NoError(t, err)
+	name, err = fields.extrasFieldName("")
+	assert.NoError(t, err)
+	assert.Equal(t, "Others", name)
+
+	fields, err = buildTypeFields(reflect.TypeOf(byJSONTag{}), "bson")
+	require.NoError(t, err)
+	_, err = fields.extrasFieldName("")
+	assert.Error(t, err)
+	name, err = fields.extrasFieldName("Others")
+	assert.NoError(t, err)
+	assert.Equal(t, "Others", name)
+	_, err = fields.extrasFieldName("others")
+	assert.EqualError(t, err, "The struct godynstruct.byJSONTag doesn't have a field named others")
+	_, err = fields.extrasFieldName("Name")
+	assert.EqualError(t, err, "The field Name of godynstruct.byJSONTag isn't of type Extras, OrderedExtras or map[string]interface{}")
+
+	fields, err = buildTypeFields(reflect.TypeOf(byType{}), "json")
+	require.NoError(t, err)
+	name, err = fields.extrasFieldName("")
+	assert.NoError(t, err)
+	assert.Equal(t, "others", name)
+
+	fields, err = buildTypeFields(reflect.TypeOf(withoutExtras{}), "json")
+	require.NoError(t, err)
+	_, err = fields.extrasFieldName("")
+	assert.EqualError(t, err, `The struct godynstruct.withoutExtras doesn't have a field of type Extras, OrderedExtras or tagged with dyn:",extras"`)
+
+	fields, err = buildTypeFields(reflect.TypeOf(twoExtras{}), "json")
+	require.NoError(t, err)
+	_, err = fields.extrasFieldName("")
+	assert.EqualError(t, err, `The struct godynstruct.twoExtras has more than one field of type Extras, OrderedExtras or tagged with dyn:",extras"`)
+
+	_, err = buildTypeFields(reflect.TypeOf(wrongExtras{}), "json")
+	assert.Error(t, err)
+}
+
+func TestCachedTypeFields(t *testing.T) {
+	typ := reflect.TypeOf(FooTagsTest{})
+
+	jsonFields, err := cachedTypeFields(typ, "json")
+	require.NoError(t, err)
+	bsonFields, err := cachedTypeFields(typ, "bson")
+	require.NoError(t, err)
+
+	again, err := cachedTypeFields(typ, "json")
+	require.NoError(t, err)
+	assert.Same(t, jsonFields, again)
+	assert.NotSame(t, jsonFields, bsonFields)
+
+	type wrongTags struct {
+		Foo string `json:"Foo,foobar"`
+	}
+	_, err = cachedTypeFields(reflect.TypeOf(wrongTags{}), "json")
+	assert.Error(t, err)
+}
+
+func BenchmarkBuildTypeFields(b *testing.B) {
+	typ := reflect.TypeOf(Person{})
+	for i := 0; i < b.N; i++ {
+		if _, err := buildTypeFields(typ, "json"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCachedTypeFields(b *testing.B) {
+	typ := reflect.TypeOf(Person{})
+	for i := 0; i < b.N; i++ {
+		if _, err := cachedTypeFields(typ, "json"); err != nil {
+			b.Fatal(err)
+		}
+	}
 }
@@ -0,0 +1,353 @@
+// go-dyn-struct
+// Copyright (C) 2020  Andrea Laisa
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+// © 2020 GitHub, Inc.
+
+package godynstruct
+
+import (
+	"encoding/xml"
+	"errors"
+	"reflect"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Dyn wraps the struct Value giving it the dynamic fields behaviour for JSON, BSON, YAML, TOML, MessagePack, CBOR and XML
+// T must be a struct with exactly one field of type Extras, OrderedExtras or tagged with dyn:",extras", that can also be unexported or embedded
+// The fields of T that are dynamic structs must be wrapped in Dyn too
+type Dyn[T any] struct {
+	Value T
+}
+
+// dynWrapper is implemented by Dyn
+type dynWrapper interface {
+	// wrappedType return the type of the wrapped struct
+	wrappedType() reflect.Type
+}
+
+var dynWrapperType = reflect.TypeOf((*dynWrapper)(nil)).Elem()
+
+// dynUnmarshaler is implemented by the pointers to Dyn
+type dynUnmarshaler interface {
+	// unmarshalJSON is like UnmarshalJSON, but it uses the options o
+	unmarshalJSON(data []byte, o Options) error
+	// unmarshalBSON is like UnmarshalBSON, but it uses the options o
+	unmarshalBSON(data []byte, o Options) error
+	// unmarshalYAML is like UnmarshalYAML, but it uses the options o
+	unmarshalYAML(node *yaml.Node, o Options) error
+	// unmarshalTOML stores the TOML table at path, whose values are still undecoded, using the options o
+	unmarshalTOML(md *toml.MetaData, path toml.Key, table map[string]toml.Primitive, o Options) error
+	// unmarshalMsgpack is like UnmarshalMsgpack, but it uses the options o
+	unmarshalMsgpack(data []byte, o Options) error
+	// unmarshalCBOR is like UnmarshalCBOR, but it uses the options o
+	unmarshalCBOR(data []byte, o Options) error
+	// unmarshalXML stores the element started by start, inside the name space declarations scope, using the options o
+	// src contains the data read by dec, if it's known
+	unmarshalXML(dec *xml.Decoder, start xml.StartElement, scope []xmlDecl, src []byte, o Options) error
+}
+
+func (d Dyn[T]) wrappedType() reflect.Type {
+	return reflect.TypeOf(&d.Value).Elem()
+}
+
+// MarshalJSON return the JSON encoding of d.Value
+func (d Dyn[T]) MarshalJSON() ([]byte, error) {
+	extraFields, name, err := extrasField(reflect.ValueOf(&d.Value).Elem(), "json")
+	if err != nil {
+		return nil, err
+	}
+
+	return DynMarshalJSON(reflect.ValueOf(d.Value), extraFields.Interface(), name)
+}
+
+// UnmarshalJSON parses the JSON encoded data and store the result into d.Value
+func (d *Dyn[T]) UnmarshalJSON(data []byte) error {
+	return d.unmarshalJSON(data, Options{})
+}
+
+func (d *Dyn[T]) unmarshalJSON(data []byte, o Options) error {
+	extraFields, name, err := extrasField(reflect.ValueOf(&d.Value).Elem(), "json")
+	if err != nil {
+		return err
+	}
+
+	return o.DynUnmarshalJSON(data, reflect.ValueOf(&d.Value), extraFields.Addr().Interface(), name)
+}
+
+// MarshalBSON return the BSON encoding of d.Value
+func (d Dyn[T]) MarshalBSON() ([]byte, error) {
+	extraFields, name, err := extrasField(reflect.ValueOf(&d.Value).Elem(), "bson")
+	if err != nil {
+		return nil, err
+	}
+
+	return DynMarshalBSON(reflect.ValueOf(d.Value), extraFields.Interface(), name)
+}
+
+// UnmarshalBSON parses the BSON encoded data and store the result into d.Value
+func (d *Dyn[T]) UnmarshalBSON(data []byte) error {
+	return d.unmarshalBSON(data, Options{})
+}
+
+func (d *Dyn[T]) unmarshalBSON(data []byte, o Options) error {
+	extraFields, name, err := extrasField(reflect.ValueOf(&d.Value).Elem(), "bson")
+	if err != nil {
+		return err
+	}
+
+	return o.DynUnmarshalBSON(data, reflect.ValueOf(&d.Value), extraFields.Addr().Interface(), name)
+}
+
+// MarshalYAML return the YAML mapping node of d.Value
+func (d Dyn[T]) MarshalYAML() (interface{}, error) {
+	extraFields, name, err := extrasField(reflect.ValueOf(&d.Value).Elem(), "yaml")
+	if err != nil {
+		return nil, err
+	}
+
+	return Options{}.encodeYAMLStruct(reflect.ValueOf(d.Value), extraFields.Interface(), name)
+}
+
+// UnmarshalYAML store the YAML node into d.Value
+func (d *Dyn[T]) UnmarshalYAML(node *yaml.Node) error {
+	return d.unmarshalYAML(node, Options{})
+}
+
+func (d *Dyn[T]) unmarshalYAML(node *yaml.Node, o Options) error {
+	extraFields, name, err := extrasField(reflect.ValueOf(&d.Value).Elem(), "yaml")
+	if err != nil {
+		return err
+	}
+
+	dest, err := newDynDest(reflect.ValueOf(&d.Value), extraFields.Addr().Interface(), name, "yaml", o.Merge)
+	if err != nil {
+		return err
+	}
+
+	return o.decodeYAMLStruct(node, dest)
+}
+
+// MarshalTOML return the TOML encoding of d.Value
+// The nested Dyn are encoded as tables only inside a dynamic struct, because the toml package writes the result of MarshalTOML as a single value
+func (d Dyn[T]) MarshalTOML() ([]byte, error) {
+	extraFields, name, err := extrasField(reflect.ValueOf(&d.Value).Elem(), "toml")
+	if err != nil {
+		return nil, err
+	}
+
+	return DynMarshalTOML(reflect.ValueOf(d.Value), extraFields.Interface(), name)
+}
+
+// UnmarshalTOML stores the TOML table data, already decoded by the toml package, into d.Value
+func (d *Dyn[T]) UnmarshalTOML(data interface{}) error {
+	// the table is encoded again, because the toml package doesn't allow to decode an already decoded value
+	raw, err := toml.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	extraFields, name, err := extrasField(reflect.ValueOf(&d.Value).Elem(), "toml")
+	if err != nil {
+		return err
+	}
+
+	return DynUnmarshalTOML(raw, reflect.ValueOf(&d.Value), extraFields.Addr().Interface(), name)
+}
+
+func (d *Dyn[T]) unmarshalTOML(md *toml.MetaData, path toml.Key, table map[string]toml.Primitive, o Options) error {
+	extraFields, name, err := extrasField(reflect.ValueOf(&d.Value).Elem(), "toml")
+	if err != nil {
+		return err
+	}
+
+	dest, err := newDynDest(reflect.ValueOf(&d.Value), extraFields.Addr().Interface(), name, "toml", o.Merge)
+	if err != nil {
+		return err
+	}
+
+	return o.decodeTOMLStruct(md, path, table, dest)
+}
+
+// MarshalMsgpack return the MessagePack encoding of d.Value
+func (d Dyn[T]) MarshalMsgpack() ([]byte, error) {
+	extraFields, name, err := extrasField(reflect.ValueOf(&d.Value).Elem(), "msgpack")
+	if err != nil {
+		return nil, err
+	}
+
+	return DynMarshalMsgpack(reflect.ValueOf(d.Value), extraFields.Interface(), name)
+}
+
+// UnmarshalMsgpack parses the MessagePack encoded data and store the result into d.Value
+func (d *Dyn[T]) UnmarshalMsgpack(data []byte) error {
+	return d.unmarshalMsgpack(data, Options{})
+}
+
+func (d *Dyn[T]) unmarshalMsgpack(data []byte, o Options) error {
+	extraFields, name, err := extrasField(reflect.ValueOf(&d.Value).Elem(), "msgpack")
+	if err != nil {
+		return err
+	}
+
+	return o.DynUnmarshalMsgpack(data, reflect.ValueOf(&d.Value), extraFields.Addr().Interface(), name)
+}
+
+// nestedDyn return the dynamic struct in the field fieldValue, that can be a Dyn or a pointer to a Dyn allocated if nil
+// ok is false if the field isn't a dynamic struct or if the encoded value isn't an object,
+// in that case the value is left to the unmarshaller of the format, that sets the nil pointers and reports the errors
+func nestedDyn(fieldValue reflect.Value, object bool) (d dynUnmarshaler, ok bool) {
+	if !object {
+		return nil, false
+	}
+
+	if fieldValue.Kind() == reflect.Ptr {
+		if fieldValue.IsNil() {
+			if !fieldValue.Type().Implements(dynUnmarshalerType) {
+				return nil, false
+			}
+			fieldValue.Set(reflect.New(fieldValue.Type().Elem()))
+		}
+		d, ok = fieldValue.Interface().(dynUnmarshaler)
+		return d, ok
+	}
+
+	d, ok = fieldValue.Addr().Interface().(dynUnmarshaler)
+	return d, ok
+}
+
+var dynUnmarshalerType = reflect.TypeOf((*dynUnmarshaler)(nil)).Elem()
+
+// isDynType return true if typ is a Dyn or a pointer to a Dyn
+func isDynType(typ reflect.Type) bool {
+	return typ.Implements(dynUnmarshalerType) || reflect.PtrTo(typ).Implements(dynUnmarshalerType)
+}
+
+// extrasField return the field of _struct that contains the extra fields and the name of the field
+// _struct must be an addressable struct
+func extrasField(_struct reflect.Value, tagKey string) (reflect.Value, string, error) {
+	if _struct.Kind() != reflect.Struct {
+		return reflect.Value{}, "", errors.New("The type " + _struct.Type().String() + " isn't a struct")
+	}
+
+	fields, err := cachedTypeFields(_struct.Type(), tagKey)
+	if err != nil {
+		return reflect.Value{}, "", err
+	}
+
+	fi, err := fields.extrasField()
+	if err != nil {
+		return reflect.Value{}, "", err
+	}
+
+	// the field can be unexported
+	return exportedValue(_struct.FieldByIndex(fi.index)), fi.name, nil
+}
+
+// dynStruct return a pointer to the struct contained in v, that can be a struct, a Dyn or a pointer to one of them
+// If v isn't a pointer the pointed struct is a copy
+func dynStruct(v interface{}) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || rv.Kind() == reflect.Ptr {
+		return dynStructPtr(v)
+	}
+
+	_struct := rv
+	if _struct.Type().Implements(dynWrapperType) {
+		_struct = _struct.Field(0)
+	}
+	if _struct.Kind() != reflect.Struct {
+		return reflect.Value{}, errors.New("The value " + describeValue(rv) + " isn't a struct or a Dyn of a struct")
+	}
+
+	ptr := reflect.New(_struct.Type())
+	ptr.Elem().Set(_struct)
+	return ptr, nil
+}
+
+// dynStructPtr return the pointer to the struct pointed by v, that can be a pointer to a struct or to a Dyn
+func dynStructPtr(v interface{}) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return reflect.Value{}, errors.New("The value " + describeValue(rv) + " isn't a struct, a Dyn or a non-nil pointer to one of them")
+	}
+
+	ptr := rv
+	if ptr.Type().Implements(dynWrapperType) {
+		ptr = ptr.Elem().Field(0).Addr()
+	}
+	if ptr.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, errors.New("The value " + describeValue(rv) + " isn't a pointer to a struct or to a Dyn of a struct")
+	}
+
+	return ptr, nil
+}
+
+// MarshalCBOR return the CBOR encoding of d.Value
+func (d Dyn[T]) MarshalCBOR() ([]byte, error) {
+	extraFields, name, err := extrasField(reflect.ValueOf(&d.Value).Elem(), "cbor")
+	if err != nil {
+		return nil, err
+	}
+
+	return DynMarshalCBOR(reflect.ValueOf(d.Value), extraFields.Interface(), name)
+}
+
+// UnmarshalCBOR parses the CBOR encoded data and store the result into d.Value
+func (d *Dyn[T]) UnmarshalCBOR(data []byte) error {
+	return d.unmarshalCBOR(data, Options{})
+}
+
+func (d *Dyn[T]) unmarshalCBOR(data []byte, o Options) error {
+	extraFields, name, err := extrasField(reflect.ValueOf(&d.Value).Elem(), "cbor")
+	if err != nil {
+		return err
+	}
+
+	return o.DynUnmarshalCBOR(data, reflect.ValueOf(&d.Value), extraFields.Addr().Interface(), name)
+}
+
+// MarshalXML writes d.Value to e as the element started by start
+// If start is named after the type of d, like for a Dyn that isn't a field of a struct, the element is named after d.Value
+func (d Dyn[T]) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	extraFields, name, err := extrasField(reflect.ValueOf(&d.Value).Elem(), "xml")
+	if err != nil {
+		return err
+	}
+
+	if start.Name.Local == reflect.TypeOf(d).Name() {
+		start = xml.StartElement{}
+	}
+	return Options{}.encodeXMLStruct(e, start, reflect.ValueOf(d.Value), extraFields.Interface(), name)
+}
+
+// UnmarshalXML reads the element started by start and store the result into d.Value
+func (d *Dyn[T]) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	return d.unmarshalXML(dec, start, nil, nil, Options{})
+}
+
+func (d *Dyn[T]) unmarshalXML(dec *xml.Decoder, start xml.StartElement, scope []xmlDecl, src []byte, o Options) error {
+	extraFields, name, err := extrasField(reflect.ValueOf(&d.Value).Elem(), "xml")
+	if err != nil {
+		return err
+	}
+
+	dest, err := newDynDest(reflect.ValueOf(&d.Value), extraFields.Addr().Interface(), name, "xml", o.Merge)
+	if err != nil {
+		return err
+	}
+	return o.decodeXMLStruct(dec, start, scope, src, dest)
+}
@@ -0,0 +1,253 @@
+// go-dyn-struct
+// Copyright (C) 2020  Andrea Laisa
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+// © 2020 GitHub, Inc.
+
+package godynstruct
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"gopkg.in/yaml.v3"
+)
+
+type Car struct {
+	Model  string
+	Year   int `json:"year" bson:"year"`
+	Driver *Dyn[Driver]
+	extras Extras
+}
+
+type Driver struct {
+	Name string
+	Extras
+}
+
+type NoExtras struct {
+	Model string
+}
+
+type TwoExtras struct {
+	Model  string
+	First  Extras
+	Second Extras
+}
+
+func TestDynFormats(t *testing.T) {
+	car := Dyn[Car]{
+		Value: Car{
+			Model:  "Panda",
+			Year:   2003,
+			Driver: &Dyn[Driver]{Value: Driver{Name: "amreo", Extras: Extras{"license": "B"}}},
+			extras: Extras{"color": "red"},
+		},
+	}
+
+	bsonDoc, err := bson.Marshal(bson.D{
+		{Key: "Model", Value: "Panda"},
+		{Key: "year", Value: 2003},
+		{Key: "Driver", Value: bson.D{{Key: "Name", Value: "amreo"}, {Key: "license", Value: "B"}}},
+		{Key: "color", Value: "red"},
+	})
+	require.NoError(t, err)
+
+	msgpackMap, err := msgpack.Marshal(OrderedExtras{
+		{"Model", "Panda"},
+		{"Year", 2003},
+		{"Driver", OrderedExtras{{"Name", "amreo"}, {"license", "B"}}},
+		{"color", "red"},
+	})
+	require.NoError(t, err)
+
+	cborMap, err := cbor.Marshal(OrderedExtras{
+		{"Model", "Panda"},
+		{"Year", 2003},
+		{"Driver", OrderedExtras{{"Name", "amreo"}, {"license", "B"}}},
+		{"color", "red"},
+	})
+	require.NoError(t, err)
+
+	formats := []struct {
+		name      string
+		marshal   func(v interface{}) ([]byte, error)
+		unmarshal func(data []byte, v interface{}) error
+		to        func(v interface{}) ([]byte, error)
+		from      func(data []byte, v interface{}) error
+		expected  string
+		// decoded is the value decoded from expected, if it isn't car
+		decoded *Dyn[Car]
+	}{
+		{
+			name:      "JSON",
+			marshal:   json.Marshal,
+			unmarshal: json.Unmarshal,
+			to:        ToJSON,
+			from:      FromJSON,
+			expected:  `{"Model":"Panda","year":2003,"Driver":{"Name":"amreo","license":"B"},"color":"red"}`,
+		},
+		{
+			name:      "BSON",
+			marshal:   bson.Marshal,
+			unmarshal: bson.Unmarshal,
+			to:        ToBSON,
+			from:      FromBSON,
+			expected:  string(bsonDoc),
+		},
+		{
+			name:      "YAML",
+			marshal:   yaml.Marshal,
+			unmarshal: yaml.Unmarshal,
+			to:        ToYAML,
+			from:      FromYAML,
+			expected:  "model: Panda\nyear: 2003\ndriver:\n    name: amreo\n    license: B\ncolor: red\n",
+		},
+		{
+			name:      "TOML",
+			marshal:   toml.Marshal,
+			unmarshal: toml.Unmarshal,
+			to:        ToTOML,
+			from:      FromTOML,
+			expected:  "Model = \"Panda\"\nYear = 2003\ncolor = \"red\"\n\n[Driver]\n  Name = \"amreo\"\n  license = \"B\"\n",
+		},
+		{
+			name:      "MessagePack",
+			marshal:   msgpack.Marshal,
+			unmarshal: msgpack.Unmarshal,
+			to:        ToMsgpack,
+			from:      FromMsgpack,
+			expected:  string(msgpackMap),
+		},
+		{
+			name:      "CBOR",
+			marshal:   cbor.Marshal,
+			unmarshal: cbor.Unmarshal,
+			to:        ToCBOR,
+			from:      FromCBOR,
+			expected:  string(cborMap),
+		},
+		{
+			name:      "XML",
+			marshal:   xml.Marshal,
+			unmarshal: xml.Unmarshal,
+			to:        ToXML,
+			from:      FromXML,
+			expected:  `<Car><Model>Panda</Model><Year>2003</Year><Driver><Name>amreo</Name><license>B</license></Driver><color>red</color></Car>`,
+			// the unknown elements are kept encoded
+			decoded: &Dyn[Car]{
+				Value: Car{
+					Model:  "Panda",
+					Year:   2003,
+					Driver: &Dyn[Driver]{Value: Driver{Name: "amreo", Extras: Extras{"license": XMLElement(`<license>B</license>`)}}},
+					extras: Extras{"color": XMLElement(`<color>red</color>`)},
+				},
+			},
+		},
+	}
+
+	for _, f := range formats {
+		t.Run(f.name, func(t *testing.T) {
+			decoded := car
+			if f.decoded != nil {
+				decoded = *f.decoded
+			}
+
+			raw, err := f.marshal(car)
+			require.NoError(t, err)
+			assert.Equal(t, f.expected, string(raw))
+
+			again, err := f.to(car)
+			require.NoError(t, err)
+			assert.Equal(t, raw, again)
+
+			var out Dyn[Car]
+			require.NoError(t, f.unmarshal(raw, &out))
+			assert.Equal(t, decoded, out)
+
+			// the decoded value is encoded again in the same way
+			again, err = f.marshal(out)
+			require.NoError(t, err)
+			assert.Equal(t, raw, again)
+
+			out = Dyn[Car]{}
+			require.NoError(t, f.from(raw, &out))
+			assert.Equal(t, decoded, out)
+		})
+	}
+}
+
+func TestDynWithoutExtras(t *testing.T) {
+	_, err := json.Marshal(Dyn[NoExtras]{})
+	assert.Error(t, err)
+
+	_, err = bson.Marshal(Dyn[TwoExtras]{})
+	assert.Error(t, err)
+
+	var out Dyn[NoExtras]
+	assert.Error(t, json.Unmarshal([]byte(`{"Model": "Panda"}`), &out))
+}
+
+func TestValueEntryPoints(t *testing.T) {
+	in := Car{Model: "Panda", Year: 2000, extras: Extras{"color": "red"}}
+
+	for _, v := range []interface{}{in, &in, Dyn[Car]{Value: in}, &Dyn[Car]{Value: in}} {
+		data, err := ToJSON(v)
+		require.NoError(t, err)
+		assert.Equal(t, `{"Model":"Panda","year":2000,"Driver":null,"color":"red"}`, string(data))
+
+		data, err = ToBSON(v)
+		require.NoError(t, err)
+		assert.Equal(t, "red", bson.Raw(data).Lookup("color").StringValue())
+	}
+
+	var out Car
+	require.NoError(t, FromJSON([]byte(`{"Model":"Panda","year":2000,"color":"red"}`), &out))
+	assert.Equal(t, in, out)
+
+	var dyn Dyn[Car]
+	data, err := ToBSON(in)
+	require.NoError(t, err)
+	require.NoError(t, FromBSON(data, &dyn))
+	assert.Equal(t, in, dyn.Value)
+
+	require.NoError(t, Options{DisallowUnknownFields: true}.FromJSON([]byte(`{"Model":"Tipo"}`), &out))
+	assert.Error(t, Options{DisallowUnknownFields: true}.FromBSON(data, &out))
+
+	// the values are checked before decoding
+	n := 42
+	var nilCar *Car
+	assert.EqualError(t, FromJSON([]byte(`{}`), out), "The value of type godynstruct.Car isn't a struct, a Dyn or a non-nil pointer to one of them")
+	assert.EqualError(t, FromJSON([]byte(`{}`), nil), "The value nil isn't a struct, a Dyn or a non-nil pointer to one of them")
+	assert.EqualError(t, FromBSON(data, nilCar), "The value of type *godynstruct.Car isn't a struct, a Dyn or a non-nil pointer to one of them")
+	assert.EqualError(t, FromBSON(data, &n), "The value of type *int isn't a pointer to a struct or to a Dyn of a struct")
+	assert.EqualError(t, FromJSON([]byte(`{}`), &Dyn[int]{}), "The value of type *godynstruct.Dyn[int] isn't a pointer to a struct or to a Dyn of a struct")
+	_, err = ToJSON(n)
+	assert.EqualError(t, err, "The value of type int isn't a struct or a Dyn of a struct")
+	_, err = ToBSON(Dyn[int]{})
+	assert.EqualError(t, err, "The value of type godynstruct.Dyn[int] isn't a struct or a Dyn of a struct")
+	_, err = ToJSON(&n)
+	assert.EqualError(t, err, "The value of type *int isn't a pointer to a struct or to a Dyn of a struct")
+	_, err = ToBSON(nilCar)
+	assert.Error(t, err)
+	_, err = ToJSON(NoExtras{})
+	assert.Error(t, err)
+}
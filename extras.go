@@ -0,0 +1,689 @@
+// go-dyn-struct
+// Copyright (C) 2020  Andrea Laisa
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+// © 2020 GitHub, Inc.
+
+package godynstruct
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"gopkg.in/yaml.v3"
+)
+
+// Extras is the type of the field of a dynamic struct that contains the extra fields
+// The extra fields are encoded sorted by key
+type Extras map[string]interface{}
+
+// Decode stores the value of the extra field key into the value pointed by v
+// The raw values, stored by the unmarshallers with the option RawExtras, are decoded by the format they come from
+func (e Extras) Decode(key string, v interface{}) error {
+	value, ok := e[key]
+	if !ok {
+		return errors.New("The extra field " + key + " doesn't exist")
+	}
+
+	return decodeExtraValue(key, value, v)
+}
+
+// ExtraField is a key/value pair of OrderedExtras
+type ExtraField struct {
+	Key   string
+	Value interface{}
+}
+
+// OrderedExtras is the type of the field of a dynamic struct that contains the extra fields in the same order they appear in the encoded data
+// The objects nested in the values are decoded as OrderedExtras too, so the order is preserved at every level
+type OrderedExtras []ExtraField
+
+var (
+	extrasType        = reflect.TypeOf(Extras(nil))
+	orderedExtrasType = reflect.TypeOf(OrderedExtras(nil))
+)
+
+// Get return the value of the extra field key
+func (e OrderedExtras) Get(key string) (interface{}, bool) {
+	for _, f := range e {
+		if f.Key == key {
+			return f.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// Set sets the value of the extra field key, keeping its position if it's already present
+func (e *OrderedExtras) Set(key string, value interface{}) {
+	for i := range *e {
+		if (*e)[i].Key == key {
+			(*e)[i].Value = value
+			return
+		}
+	}
+
+	*e = append(*e, ExtraField{Key: key, Value: value})
+}
+
+// Delete removes the extra field key
+func (e *OrderedExtras) Delete(key string) {
+	for i := range *e {
+		if (*e)[i].Key == key {
+			*e = append((*e)[:i], (*e)[i+1:]...)
+			return
+		}
+	}
+}
+
+// Decode stores the value of the extra field key into the value pointed by v
+// The raw values, stored by the unmarshallers with the option RawExtras, are decoded by the format they come from
+func (e OrderedExtras) Decode(key string, v interface{}) error {
+	value, ok := e.Get(key)
+	if !ok {
+		return errors.New("The extra field " + key + " doesn't exist")
+	}
+
+	return decodeExtraValue(key, value, v)
+}
+
+// MarshalJSON return the JSON encoding of e as an object with the keys in order
+func (e OrderedExtras) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	out := newJSONObject(&buf)
+	for _, f := range e {
+		err := out.add(f.Key, f.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := out.close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON parses the JSON encoded object data keeping the order of the keys
+func (e *OrderedExtras) UnmarshalJSON(data []byte) error {
+	v, err := decodeOrderedJSON(data, false)
+	if err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case nil:
+		*e = nil
+	case OrderedExtras:
+		*e = v
+	default:
+		return errors.New("json: cannot unmarshal a value that isn't an object into OrderedExtras")
+	}
+
+	return nil
+}
+
+// MarshalBSON return the BSON encoding of e as a document with the keys in order
+func (e OrderedExtras) MarshalBSON() ([]byte, error) {
+	doc := make(bson.D, 0, len(e))
+	for _, f := range e {
+		doc = append(doc, bson.E{Key: f.Key, Value: f.Value})
+	}
+
+	return bson.Marshal(doc)
+}
+
+// UnmarshalBSON parses the BSON encoded document data keeping the order of the keys
+func (e *OrderedExtras) UnmarshalBSON(data []byte) error {
+	var doc bson.D
+	err := bson.Unmarshal(data, &doc)
+	if err != nil {
+		return err
+	}
+
+	*e = orderedFromBSON(doc).(OrderedExtras)
+	return nil
+}
+
+// MarshalYAML return e as a YAML mapping node with the keys in order
+func (e OrderedExtras) MarshalYAML() (interface{}, error) {
+	out := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, f := range e {
+		err := addYAMLPair(out, f.Key, f.Value, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// UnmarshalYAML decodes the YAML mapping node keeping the order of the keys
+func (e *OrderedExtras) UnmarshalYAML(node *yaml.Node) error {
+	v, err := decodeOrderedYAML(node)
+	if err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case nil:
+		*e = nil
+	case OrderedExtras:
+		*e = v
+	default:
+		return errors.New("yaml: line " + strconv.Itoa(node.Line) + ": cannot unmarshal a value that isn't a mapping into OrderedExtras")
+	}
+
+	return nil
+}
+
+// MarshalMsgpack return the MessagePack encoding of e as a map with the keys in order
+func (e OrderedExtras) MarshalMsgpack() ([]byte, error) {
+	return encodeMsgpackMap(e)
+}
+
+// UnmarshalMsgpack parses the MessagePack encoded map data keeping the order of the keys
+func (e *OrderedExtras) UnmarshalMsgpack(data []byte) error {
+	v, err := decodeOrderedMsgpack(data)
+	if err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case nil:
+		*e = nil
+	case OrderedExtras:
+		*e = v
+	default:
+		return errors.New("msgpack: cannot unmarshal a value that isn't a map into OrderedExtras")
+	}
+
+	return nil
+}
+
+// MarshalCBOR return the CBOR encoding of e as a map with the keys in order, with the keys made by CBORIntKey encoded as integers
+func (e OrderedExtras) MarshalCBOR() ([]byte, error) {
+	pairs := make([]cborEntry, len(e))
+	for i, f := range e {
+		pairs[i] = cborEntry{key: cborKey(f.Key), value: f.Value}
+	}
+
+	return encodeCBORMap(pairs)
+}
+
+// UnmarshalCBOR parses the CBOR encoded map data keeping the order of the keys and the tags of the values
+func (e *OrderedExtras) UnmarshalCBOR(data []byte) error {
+	v, err := decodeOrderedCBOR(data)
+	if err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case nil:
+		*e = nil
+	case OrderedExtras:
+		*e = v
+	default:
+		return errors.New("cbor: cannot unmarshal a value that isn't a map with string keys into OrderedExtras")
+	}
+
+	return nil
+}
+
+// MarshalXML writes e to enc as the element started by start, with the keys that start with @ as attributes,
+// the key #text as the text and the other keys as child elements, in order
+func (e OrderedExtras) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	for _, f := range e {
+		if strings.HasPrefix(f.Key, "@") {
+			start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: f.Key[1:]}, Value: fmt.Sprint(f.Value)})
+		}
+	}
+
+	err := enc.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range e {
+		switch {
+		case strings.HasPrefix(f.Key, "@"):
+			continue
+		case f.Key == "#text":
+			err = enc.EncodeToken(xml.CharData(fmt.Sprint(f.Value)))
+		default:
+			err = enc.EncodeElement(xmlValue(f.Value), xml.StartElement{Name: xml.Name{Local: f.Key}})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return enc.EncodeToken(start.End())
+}
+
+// UnmarshalXML reads the element started by start keeping the order of the attributes and the child elements,
+// with the attributes as @name, the repeated elements as []interface{}, the elements that contain only text as string and the other text as #text
+func (e *OrderedExtras) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	v, err := decodeXMLValue(dec, start)
+	if err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case OrderedExtras:
+		*e = v
+	case string:
+		*e = OrderedExtras{}
+		if v != "" {
+			*e = OrderedExtras{{"#text", v}}
+		}
+	}
+
+	return nil
+}
+
+// decodeExtraValue stores value, the value of the extra field key, into the value pointed by v
+// The json.RawMessage, bson.RawValue, *yaml.Node, msgpack.RawMessage, cbor.RawMessage and XMLElement values are unmarshalled,
+// the cbor.Tag values are decoded like the cbor package does if they aren't assignable, the other values must be assignable to the value pointed by v
+func decodeExtraValue(key string, value interface{}, v interface{}) error {
+	switch value := value.(type) {
+	case json.RawMessage:
+		return json.Unmarshal(value, v)
+	case bson.RawValue:
+		return value.Unmarshal(v)
+	case *yaml.Node:
+		return value.Decode(v)
+	case msgpack.RawMessage:
+		return msgpack.Unmarshal(value, v)
+	case cbor.RawMessage:
+		return cbor.Unmarshal(value, v)
+	case XMLElement:
+		return xml.Unmarshal(value, v)
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("The extra field " + key + " can't be decoded into a value that isn't a non-nil pointer")
+	}
+
+	if value == nil {
+		rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+		return nil
+	}
+
+	if tag, ok := value.(cbor.Tag); ok && !reflect.TypeOf(tag).AssignableTo(rv.Elem().Type()) {
+		// the tagged value is decoded again, for example into a time.Time or a big.Int
+		data, err := cbor.Marshal(tag)
+		if err != nil {
+			return err
+		}
+		return cbor.Unmarshal(data, v)
+	}
+
+	if !reflect.TypeOf(value).AssignableTo(rv.Elem().Type()) {
+		return errors.New("The extra field " + key + " of type " + reflect.TypeOf(value).String() + " can't be decoded into " + rv.Elem().Type().String())
+	}
+	rv.Elem().Set(reflect.ValueOf(value))
+
+	return nil
+}
+
+// portableExtraValue return value, the value of an extra field, ready to be encoded in the format of tagKey
+// The raw values stored by the unmarshallers of the other formats with the option RawExtras are decoded, with the objects as OrderedExtras
+func portableExtraValue(value interface{}, tagKey string) (interface{}, error) {
+	switch v := value.(type) {
+	case json.RawMessage:
+		if tagKey == "yaml" {
+			// JSON is valid YAML, so the node keeps the numbers exactly as they are
+			var node yaml.Node
+			err := yaml.Unmarshal(v, &node)
+			if err != nil {
+				return nil, err
+			}
+			return clearYAMLStyle(resolveYAMLNode(&node)), nil
+		}
+		if tagKey == "toml" {
+			// the toml package encodes json.Number as a number
+			return decodeOrderedJSON(v, true)
+		}
+		if tagKey != "json" {
+			out, err := decodeOrderedJSON(v, true)
+			if err != nil {
+				return nil, err
+			}
+			return nativeJSONNumbers(out), nil
+		}
+	case bson.RawValue:
+		if tagKey != "bson" {
+			out, ok := bsonScalarValue(v)
+			if ok {
+				return out, nil
+			}
+			err := v.UnmarshalWithContext(&bsoncodec.DecodeContext{Registry: bson.DefaultRegistry, Ancestor: bsonDocumentType}, &out)
+			if err != nil {
+				return nil, err
+			}
+			return orderedFromBSON(out), nil
+		}
+	case *yaml.Node:
+		if tagKey != "yaml" {
+			return decodeOrderedYAML(v)
+		}
+	case msgpack.RawMessage:
+		if tagKey != "msgpack" {
+			return decodeOrderedMsgpack(v)
+		}
+	case cbor.RawMessage:
+		if tagKey != "cbor" {
+			return decodeOrderedCBOR(v)
+		}
+	case XMLElement:
+		if tagKey != "xml" {
+			return decodeOrderedXML(v)
+		}
+	case []XMLElement:
+		if tagKey != "xml" {
+			out := make([]interface{}, len(v))
+			for i, x := range v {
+				el, err := decodeOrderedXML(x)
+				if err != nil {
+					return nil, err
+				}
+				out[i] = el
+			}
+			return out, nil
+		}
+	}
+
+	if tagKey != "cbor" {
+		value, _ = portableCBORValue(value)
+	}
+
+	return value, nil
+}
+
+// portableCBORKey return the decimal representation of the integer of key if it's made by CBORIntKey, otherwise it return key
+func portableCBORKey(key string) string {
+	if n, ok := cborKey(key).(int64); ok {
+		return strconv.FormatInt(n, 10)
+	}
+
+	return key
+}
+
+// portableCBORValue return v with the CBOR specific values nested inside converted for the other formats:
+// the cbor.Tag values are replaced by their content, the keys made by CBORIntKey by their decimal representation,
+// and the maps with integer keys become map[string]interface{}
+// The bool is true if v has been converted, the values that don't change aren't copied
+func portableCBORValue(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case cbor.Tag:
+		out, _ := portableCBORValue(v.Content)
+		return out, true
+	case []interface{}:
+		var out []interface{}
+		for i, item := range v {
+			item, changed := portableCBORValue(item)
+			if changed && out == nil {
+				out = append([]interface{}(nil), v...)
+			}
+			if out != nil {
+				out[i] = item
+			}
+		}
+		if out == nil {
+			return v, false
+		}
+		return out, true
+	case OrderedExtras:
+		var out OrderedExtras
+		for i, f := range v {
+			value, changed := portableCBORValue(f.Value)
+			key := portableCBORKey(f.Key)
+			if (changed || key != f.Key) && out == nil {
+				out = append(OrderedExtras(nil), v...)
+			}
+			if out != nil {
+				out[i] = ExtraField{Key: key, Value: value}
+			}
+		}
+		if out == nil {
+			return v, false
+		}
+		return out, true
+	case map[string]interface{}:
+		var out map[string]interface{}
+		for k, item := range v {
+			item, changed := portableCBORValue(item)
+			key := portableCBORKey(k)
+			if (changed || key != k) && out == nil {
+				out = make(map[string]interface{}, len(v))
+				for k, item := range v {
+					out[k] = item
+				}
+			}
+			if out != nil {
+				delete(out, k)
+				out[key] = item
+			}
+		}
+		if out == nil {
+			return v, false
+		}
+		return out, true
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			var key string
+			switch k := k.(type) {
+			case string:
+				key = k
+			case uint64:
+				key = strconv.FormatUint(k, 10)
+			case int64:
+				key = strconv.FormatInt(k, 10)
+			default:
+				// the other keys can't be represented as strings
+				return v, false
+			}
+			out[key], _ = portableCBORValue(item)
+		}
+		return out, true
+	default:
+		return v, false
+	}
+}
+
+// nativeJSONNumbers return v with the json.Number values nested inside converted to int64, or to float64 if they aren't integers
+func nativeJSONNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		n, _ := v.Float64()
+		return n
+	case OrderedExtras:
+		for i := range v {
+			v[i].Value = nativeJSONNumbers(v[i].Value)
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = nativeJSONNumbers(v[i])
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// isExtrasType return true if typ can be the type of the field that contains the extra fields
+func isExtrasType(typ reflect.Type) bool {
+	return typ == orderedExtrasType || typ.ConvertibleTo(extrasType)
+}
+
+// extrasList return the extra fields contained in extraFields, sorted by key if extraFields is a map
+// extraFields can be a map[string]interface{}, Extras or OrderedExtras
+func extrasList(extraFields interface{}) (OrderedExtras, error) {
+	var m map[string]interface{}
+
+	switch v := extraFields.(type) {
+	case nil:
+		return nil, nil
+	case OrderedExtras:
+		return v, nil
+	case map[string]interface{}:
+		m = v
+	case Extras:
+		m = v
+	default:
+		rv := reflect.ValueOf(extraFields)
+		if !rv.Type().ConvertibleTo(extrasType) {
+			return nil, errors.New("The extra fields can't be of type " + rv.Type().String())
+		}
+		m = rv.Convert(extrasType).Interface().(Extras)
+	}
+
+	out := make(OrderedExtras, 0, len(m))
+	for k, v := range m {
+		out = append(out, ExtraField{Key: k, Value: v})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Key < out[j].Key
+	})
+
+	return out, nil
+}
+
+// extrasDest is the container where the extra fields found while unmarshalling are stored
+type extrasDest struct {
+	m       map[string]interface{}
+	ordered *OrderedExtras
+	// index contains the position in ordered of each key
+	index map[string]int
+	// merge is true if the values are merged with the ones already present
+	merge bool
+}
+
+// newExtrasDest return the container pointed by extraFieldsPtr as an extrasDest
+// The container is emptied, unless merge is true
+// extraFieldsPtr can be a *map[string]interface{}, *Extras or *OrderedExtras
+func newExtrasDest(extraFieldsPtr interface{}, merge bool) (*extrasDest, error) {
+	rv := reflect.ValueOf(extraFieldsPtr)
+	if !rv.IsValid() || rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return nil, errors.New("The extra fields value " + describeValue(rv) + " isn't a non-nil pointer to Extras, OrderedExtras or map[string]interface{}")
+	}
+
+	switch ptr := extraFieldsPtr.(type) {
+	case *OrderedExtras:
+		if !merge || *ptr == nil {
+			*ptr = OrderedExtras{}
+		}
+		index := make(map[string]int, len(*ptr))
+		for i, f := range *ptr {
+			index[f.Key] = i
+		}
+		return &extrasDest{ordered: ptr, index: index, merge: merge}, nil
+	case *map[string]interface{}:
+		if !merge || *ptr == nil {
+			*ptr = make(map[string]interface{})
+		}
+		return &extrasDest{m: *ptr, merge: merge}, nil
+	case *Extras:
+		if !merge || *ptr == nil {
+			*ptr = make(Extras)
+		}
+		return &extrasDest{m: *ptr, merge: merge}, nil
+	}
+
+	if !rv.Elem().Type().ConvertibleTo(extrasType) {
+		return nil, errors.New("The pointer to the extra fields can't be of type " + rv.Type().String())
+	}
+
+	if merge && !rv.Elem().IsNil() {
+		return &extrasDest{m: rv.Elem().Convert(extrasType).Interface().(Extras), merge: merge}, nil
+	}
+
+	m := make(map[string]interface{})
+	rv.Elem().Set(reflect.ValueOf(m).Convert(rv.Elem().Type()))
+	return &extrasDest{m: m, merge: merge}, nil
+}
+
+// isOrdered return true if the container keeps the order of the extra fields
+func (d *extrasDest) isOrdered() bool {
+	return d.ordered != nil
+}
+
+// set sets the value of the extra field key, merging it with the current value if d.merge is true
+func (d *extrasDest) set(key string, value interface{}) {
+	if d.ordered == nil {
+		if d.merge {
+			value = mergeExtraValue(d.m[key], value)
+		}
+		d.m[key] = value
+		return
+	}
+
+	if i, ok := d.index[key]; ok {
+		if d.merge {
+			value = mergeExtraValue((*d.ordered)[i].Value, value)
+		}
+		(*d.ordered)[i].Value = value
+		return
+	}
+
+	d.index[key] = len(*d.ordered)
+	*d.ordered = append(*d.ordered, ExtraField{Key: key, Value: value})
+}
+
+// mergeExtraValue return old updated with value
+// If both are objects the members of value are merged recursively into old, otherwise value replaces old
+func mergeExtraValue(old interface{}, value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		if old, ok := old.(Extras); ok {
+			return mergeExtraValue(map[string]interface{}(old), value)
+		}
+		if old, ok := old.(map[string]interface{}); ok {
+			for k, v := range value {
+				old[k] = mergeExtraValue(old[k], v)
+			}
+			return old
+		}
+	case OrderedExtras:
+		if old, ok := old.(OrderedExtras); ok {
+			for _, f := range value {
+				current, _ := old.Get(f.Key)
+				old.Set(f.Key, mergeExtraValue(current, f.Value))
+			}
+			return old
+		}
+	}
+
+	return value
+}
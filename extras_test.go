@@ -0,0 +1,178 @@
+// go-dyn-struct
+// Copyright (C) 2020  Andrea Laisa
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+// © 2020 GitHub, Inc.
+
+package godynstruct
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type Event struct {
+	Name   string `json:"name" bson:"name"`
+	Source string `json:"source" bson:"source"`
+	others OrderedExtras
+}
+
+func TestOrderedExtras(t *testing.T) {
+	e := OrderedExtras{}
+	e.Set("b", 1)
+	e.Set("a", 2)
+	e.Set("b", 3)
+	assert.Equal(t, OrderedExtras{{"b", 3}, {"a", 2}}, e)
+
+	v, ok := e.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 2, v)
+	_, ok = e.Get("c")
+	assert.False(t, ok)
+
+	e.Delete("b")
+	assert.Equal(t, OrderedExtras{{"a", 2}}, e)
+}
+
+func TestOrderedExtrasJSON(t *testing.T) {
+	data := `{"z":1,"a":{"y":true,"b":null},"m":[{"k":"v","c":"d"}]}`
+
+	var e OrderedExtras
+	require.NoError(t, json.Unmarshal([]byte(data), &e))
+	assert.Equal(t, OrderedExtras{
+		{"z", 1.0},
+		{"a", OrderedExtras{{"y", true}, {"b", nil}}},
+		{"m", []interface{}{OrderedExtras{{"k", "v"}, {"c", "d"}}}},
+	}, e)
+
+	raw, err := json.Marshal(e)
+	require.NoError(t, err)
+	assert.Equal(t, data, string(raw))
+
+	assert.Error(t, json.Unmarshal([]byte(`[1]`), &e))
+}
+
+func TestOrderedExtrasBSON(t *testing.T) {
+	doc := bson.D{
+		bson.E{Key: "z", Value: int32(1)},
+		bson.E{Key: "a", Value: bson.D{
+			bson.E{Key: "y", Value: true},
+			bson.E{Key: "b", Value: nil},
+		}},
+	}
+	data, err := bson.Marshal(doc)
+	require.NoError(t, err)
+
+	var e OrderedExtras
+	require.NoError(t, bson.Unmarshal(data, &e))
+	assert.Equal(t, OrderedExtras{
+		{"z", int32(1)},
+		{"a", OrderedExtras{{"y", true}, {"b", nil}}},
+	}, e)
+
+	raw, err := bson.Marshal(e)
+	require.NoError(t, err)
+	assert.Equal(t, bson.Raw(data), bson.Raw(raw))
+}
+
+func TestOrderedExtrasJSONRoundTrip(t *testing.T) {
+	data := `{"name":"login","zeta":{"y":1,"b":[2,{"d":3,"c":4}]},"source":"web","alpha":"last"}`
+
+	var e Event
+	require.NoError(t, DynUnmarshalJSON([]byte(data), reflect.ValueOf(&e), &e.others, ""))
+	assert.Equal(t, "login", e.Name)
+	assert.Equal(t, "web", e.Source)
+	assert.Equal(t, "zeta", e.others[0].Key)
+	assert.Equal(t, "alpha", e.others[1].Key)
+
+	raw, err := DynMarshalJSON(reflect.ValueOf(e), e.others, "")
+	require.NoError(t, err)
+	assert.Equal(t, `{"name":"login","source":"web","zeta":{"y":1,"b":[2,{"d":3,"c":4}]},"alpha":"last"}`, string(raw))
+}
+
+func TestOrderedExtrasBSONRoundTrip(t *testing.T) {
+	data, err := bson.Marshal(bson.D{
+		bson.E{Key: "name", Value: "login"},
+		bson.E{Key: "source", Value: "web"},
+		bson.E{Key: "zeta", Value: bson.D{
+			bson.E{Key: "y", Value: 1},
+			bson.E{Key: "b", Value: bson.A{2, bson.D{bson.E{Key: "d", Value: 3}, bson.E{Key: "c", Value: 4}}}},
+		}},
+		bson.E{Key: "alpha", Value: "last"},
+	})
+	require.NoError(t, err)
+
+	var e Event
+	require.NoError(t, DynUnmarshalBSON(data, reflect.ValueOf(&e), &e.others, ""))
+	assert.Equal(t, "zeta", e.others[0].Key)
+	assert.Equal(t, "alpha", e.others[1].Key)
+
+	raw, err := DynMarshalBSON(reflect.ValueOf(e), e.others, "")
+	require.NoError(t, err)
+	assert.Equal(t, bson.Raw(data), bson.Raw(raw))
+}
+
+func TestExtrasContainers(t *testing.T) {
+	_, err := extrasList([]string{"foo"})
+	assert.Error(t, err)
+
+	var wrong []string
+	_, err = newExtrasDest(&wrong, false)
+	assert.Error(t, err)
+	_, err = newExtrasDest(nil, false)
+	assert.EqualError(t, err, "The extra fields value nil isn't a non-nil pointer to Extras, OrderedExtras or map[string]interface{}")
+	_, err = newExtrasDest((*OrderedExtras)(nil), false)
+	assert.EqualError(t, err, "The extra fields value of type *godynstruct.OrderedExtras isn't a non-nil pointer to Extras, OrderedExtras or map[string]interface{}")
+
+	type otherMap map[string]interface{}
+	var m otherMap
+	dest, err := newExtrasDest(&m, false)
+	require.NoError(t, err)
+	dest.set("foo", "bar")
+	assert.Equal(t, otherMap{"foo": "bar"}, m)
+
+	list, err := extrasList(m)
+	require.NoError(t, err)
+	assert.Equal(t, OrderedExtras{{"foo", "bar"}}, list)
+}
+
+func TestExtrasDecode(t *testing.T) {
+	extras := Extras{"name": "amreo", "age": json.RawMessage(`20`), "none": nil}
+
+	var name string
+	require.NoError(t, extras.Decode("name", &name))
+	assert.Equal(t, "amreo", name)
+
+	var age int
+	require.NoError(t, extras.Decode("age", &age))
+	assert.Equal(t, 20, age)
+
+	name = "foo"
+	require.NoError(t, extras.Decode("none", &name))
+	assert.Equal(t, "", name)
+
+	assert.EqualError(t, extras.Decode("name", &age), "The extra field name of type string can't be decoded into int")
+	assert.EqualError(t, extras.Decode("name", name), "The extra field name can't be decoded into a value that isn't a non-nil pointer")
+	assert.EqualError(t, extras.Decode("missing", &name), "The extra field missing doesn't exist")
+
+	ordered := OrderedExtras{{Key: "age", Value: json.RawMessage(`21`)}}
+	require.NoError(t, ordered.Decode("age", &age))
+	assert.Equal(t, 21, age)
+	assert.EqualError(t, ordered.Decode("missing", &age), "The extra field missing doesn't exist")
+}
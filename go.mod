@@ -1,8 +1,20 @@
 module github.com/amreo/go-dyn-struct
 
-go 1.14
+go 1.18
 
 require (
-	github.com/stretchr/testify v1.5.1
+	github.com/BurntSushi/toml v1.5.0
+	github.com/fxamacker/cbor/v2 v2.7.0
+	github.com/stretchr/testify v1.8.2
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	github.com/x448/float16 v0.8.4
 	go.mongodb.org/mongo-driver v1.3.3
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/go-stack/stack v1.8.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
 )
@@ -18,103 +18,728 @@
 package godynstruct
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"io"
 	"reflect"
+	"strings"
+	"sync"
 )
 
 // DynMarshalJSON return the JSON encoding of the dynamic struct _struct
+// The fields of the struct are encoded in declaration order, followed by the extra fields sorted by key, or in their order if they are OrderedExtras
+// If an extra field has the same name of a field of the struct, the value of the extra field is used in place of the field
 // _struct contains the reflect.Value of the struct
-// extraFields is the map that contains the extra fields
-// extraFieldsName is the name of the field in the struct that contains the extra fields
-func DynMarshalJSON(_struct reflect.Value, extraFields map[string]interface{}, extraFieldsName string) ([]byte, error) {
-	// out is the map that will be marshalled
-	out := make(map[string]interface{})
+// extraFields contains the extra fields, it can be a map[string]interface{}, Extras or OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func DynMarshalJSON(_struct reflect.Value, extraFields interface{}, extraFieldsName string) ([]byte, error) {
+	return Options{}.DynMarshalJSON(_struct, extraFields, extraFieldsName)
+}
+
+// DynMarshalJSON is like the function DynMarshalJSON, but it uses the options o
+func (o Options) DynMarshalJSON(_struct reflect.Value, extraFields interface{}, extraFieldsName string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := o.encodeJSONStruct(newJSONObject(&buf), _struct, extraFields, extraFieldsName)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DynEncodeJSON writes the JSON encoding of the dynamic struct _struct to w, followed by a newline
+// It's like DynMarshalJSON, but the members are written to w one at a time, so if an error is returned part of the object can be already written
+// w is the writer where the JSON encoding is written
+// _struct contains the reflect.Value of the struct
+// extraFields contains the extra fields, it can be a map[string]interface{}, Extras or OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func DynEncodeJSON(w io.Writer, _struct reflect.Value, extraFields interface{}, extraFieldsName string) error {
+	return NewJSONEncoder(w).Encode(_struct, extraFields, extraFieldsName)
+}
+
+// DynEncodeJSON is like the function DynEncodeJSON, but it uses the options o
+func (o Options) DynEncodeJSON(w io.Writer, _struct reflect.Value, extraFields interface{}, extraFieldsName string) error {
+	return o.NewJSONEncoder(w).Encode(_struct, extraFields, extraFieldsName)
+}
+
+// JSONEncoder writes the JSON encoding of dynamic structs to a writer, like json.Encoder
+type JSONEncoder struct {
+	w          io.Writer
+	options    Options
+	prefix     string
+	indent     string
+	escapeHTML bool
+}
+
+// NewJSONEncoder return a JSONEncoder that writes to w
+func NewJSONEncoder(w io.Writer) *JSONEncoder {
+	return Options{}.NewJSONEncoder(w)
+}
+
+// NewJSONEncoder is like the function NewJSONEncoder, but the encoder uses the options o
+func (o Options) NewJSONEncoder(w io.Writer) *JSONEncoder {
+	return &JSONEncoder{w: w, options: o, escapeHTML: true}
+}
 
-	if _struct.Kind() == reflect.Ptr {
-		_struct = _struct.Elem()
+// SetIndent makes the encoder indent the objects like json.Encoder.SetIndent
+func (e *JSONEncoder) SetIndent(prefix string, indent string) {
+	e.prefix, e.indent = prefix, indent
+}
+
+// SetEscapeHTML sets if the characters &, < and > are escaped inside the strings, like json.Encoder.SetEscapeHTML
+// The default is true
+func (e *JSONEncoder) SetEscapeHTML(on bool) {
+	e.escapeHTML = on
+}
+
+// Encode writes the JSON encoding of the dynamic struct _struct to the writer, followed by a newline
+// The members are written one at a time, so if an error is returned part of the object can be already written
+// _struct contains the reflect.Value of the struct
+// extraFields contains the extra fields, it can be a map[string]interface{}, Extras or OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func (e *JSONEncoder) Encode(_struct reflect.Value, extraFields interface{}, extraFieldsName string) error {
+	out := newJSONObject(e.w)
+	out.setIndent(e.prefix, e.indent)
+	out.setEscapeHTML(e.escapeHTML)
+
+	err := e.options.encodeJSONStruct(out, _struct, extraFields, extraFieldsName)
+	if err != nil {
+		return err
 	}
 
-	// add each field except extraFieldsName into out
-	typ := _struct.Type()
-	for i := 0; i < _struct.NumField(); i++ {
-		fi := typ.Field(i)
+	_, err = io.WriteString(e.w, "\n")
+	return err
+}
 
-		if fi.Name != extraFieldsName {
-			val, _ := fi.Tag.Lookup("json")
-			fi, err := buildFieldInfo(fi.Name, _struct.Field(i), val)
+// encodeJSONStruct writes the dynamic struct _struct as the JSON object out
+func (o Options) encodeJSONStruct(out *jsonObject, _struct reflect.Value, extraFields interface{}, extraFieldsName string) error {
+	members, err := o.dynMembers(_struct, extraFields, extraFieldsName, "json")
+	if err != nil {
+		return err
+	}
+
+	for _, m := range members {
+		v := m.value
+		if m.field.quoted && !m.extra {
+			v, err = quotedJSONValue(reflect.ValueOf(m.value), out.escapeHTML)
 			if err != nil {
-				return nil, err
+				return err
 			}
+		}
 
-			if !fi.omitted && (!fi.omitEmpty || !fi.fieldValue.IsZero()) {
-				out[fi.actualFieldName] = fi.fieldValue.Interface()
-			}
+		err = out.add(m.key, v)
+		if err != nil {
+			return err
 		}
 	}
 
-	// add the missing extra fields
-	for v, k := range extraFields {
-		out[v] = k
+	return out.close()
+}
+
+// jsonObject writes a JSON object to w member by member
+type jsonObject struct {
+	w io.Writer
+	// prefix and indent are set like json.Encoder.SetIndent, prefix contains also the indentation of the object
+	prefix string
+	indent string
+	// escapeHTML is set like json.Encoder.SetEscapeHTML
+	escapeHTML bool
+	// members is the number of members written
+	members int
+	// buf contains the member being written, enc encodes the values into buf
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+// newJSONObject return a jsonObject that writes to w, without indentation and with the HTML characters escaped
+func newJSONObject(w io.Writer) *jsonObject {
+	o := &jsonObject{w: w, escapeHTML: true}
+	o.enc = json.NewEncoder(&o.buf)
+	return o
+}
+
+// setEscapeHTML sets if the HTML characters are escaped inside the strings like json.Encoder.SetEscapeHTML
+func (o *jsonObject) setEscapeHTML(on bool) {
+	o.escapeHTML = on
+	o.enc.SetEscapeHTML(on)
+}
+
+// setIndent sets the indentation of the members like json.Encoder.SetIndent
+func (o *jsonObject) setIndent(prefix string, indent string) {
+	o.prefix, o.indent = prefix, indent
+	o.enc.SetIndent(prefix+indent, indent)
+}
+
+// indented return true if the members are indented
+func (o *jsonObject) indented() bool {
+	return o.prefix != "" || o.indent != ""
+}
+
+// add writes the member key with the JSON encoding of value
+func (o *jsonObject) add(key string, value interface{}) error {
+	o.buf.Reset()
+	if o.members == 0 {
+		o.buf.WriteByte('{')
+	} else {
+		o.buf.WriteByte(',')
+	}
+	if o.indented() {
+		o.buf.WriteByte('\n')
+		o.buf.WriteString(o.prefix)
+		o.buf.WriteString(o.indent)
+	}
+
+	err := o.encode(key)
+	if err != nil {
+		return err
+	}
+	o.buf.WriteByte(':')
+	if o.indented() {
+		o.buf.WriteByte(' ')
+	}
+	err = o.encode(value)
+	if err != nil {
+		return err
 	}
 
-	return json.Marshal(out)
+	_, err = o.w.Write(o.buf.Bytes())
+	o.members++
+	return err
+}
+
+// encode appends the JSON encoding of v to o.buf
+// The valid json.RawMessage values are written as they are, only indented if needed
+func (o *jsonObject) encode(v interface{}) error {
+	if raw, ok := v.(json.RawMessage); ok && json.Valid(raw) {
+		if o.indented() {
+			return json.Indent(&o.buf, raw, o.prefix+o.indent, o.indent)
+		}
+		o.buf.Write(raw)
+		return nil
+	}
+
+	err := o.enc.Encode(v)
+	if err != nil {
+		return err
+	}
+
+	// remove the newline written by the encoder
+	o.buf.Truncate(o.buf.Len() - 1)
+	return nil
+}
+
+// close writes the end of the object
+func (o *jsonObject) close() error {
+	var err error
+	switch {
+	case o.members == 0:
+		_, err = io.WriteString(o.w, "{}")
+	case o.indented():
+		_, err = io.WriteString(o.w, "\n"+o.prefix+"}")
+	default:
+		_, err = io.WriteString(o.w, "}")
+	}
+
+	return err
+}
+
+// ToJSON return the JSON encoding of the dynamic struct v, that can be a struct, a Dyn or a pointer to one of them
+// The extra fields are the ones in the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func ToJSON(v interface{}) ([]byte, error) {
+	return Options{}.ToJSON(v)
+}
+
+// ToJSON is like the function ToJSON, but it uses the options o
+func (o Options) ToJSON(v interface{}) ([]byte, error) {
+	ptrStruct, err := dynStruct(v)
+	if err != nil {
+		return nil, err
+	}
+
+	extraFields, name, err := extrasField(ptrStruct.Elem(), "json")
+	if err != nil {
+		return nil, err
+	}
+
+	return o.DynMarshalJSON(ptrStruct, extraFields.Interface(), name)
 }
 
 // DynUnmarshalJSON parses the JSON encoded data and store the result into ptrStruct. The fields that aren't part of the struct are set inside extraFieldsPtr
 // data contains the JSON encoded rappresentation of the data
 // ptrStruct contains a reflect.Value pointer to the struct
-// extraFieldsPtr is the pointer to the extraFields map
-func DynUnmarshalJSON(data []byte, ptrStruct reflect.Value, extraFieldsPtr *map[string]interface{}, extraFieldsName string) error {
-	// initialize the map that contains the extra fields
-	*extraFieldsPtr = make(map[string]interface{})
+// extraFieldsPtr is the pointer to the extra fields, it can be a *map[string]interface{}, *Extras or *OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func DynUnmarshalJSON(data []byte, ptrStruct reflect.Value, extraFieldsPtr interface{}, extraFieldsName string) error {
+	return Options{}.DynUnmarshalJSON(data, ptrStruct, extraFieldsPtr, extraFieldsName)
+}
 
-	// get the list of key/value pairs of the map
-	var objmap map[string]json.RawMessage
-	err := json.Unmarshal(data, &objmap)
+// DynUnmarshalJSON is like the function DynUnmarshalJSON, but it uses the options o
+func (o Options) DynUnmarshalJSON(data []byte, ptrStruct reflect.Value, extraFieldsPtr interface{}, extraFieldsName string) error {
+	dest, err := newDynDest(ptrStruct, extraFieldsPtr, extraFieldsName, "json", o.Merge)
 	if err != nil {
 		return err
 	}
 
-	// create a map of every struct fields
-	structFields := make(map[string]fieldInfo)
+	if o.DisallowUnknownFields {
+		// the unknown fields are checked before decoding, so the struct isn't modified if there are some
+		members, err := decodeJSONObject(data)
+		if err != nil {
+			return err
+		}
 
-	typ := reflect.Indirect(ptrStruct).Type()
-	for i := 0; i < typ.NumField(); i++ {
-		fi := typ.Field(i)
+		paths, err := unknownJSONStructFields(members, dest.fields, dest.extraFieldsName, "", nil)
+		if err != nil {
+			return err
+		}
+		if len(paths) > 0 {
+			return &UnknownFieldsError{Paths: paths}
+		}
+	}
 
-		if fi.Name != extraFieldsName {
-			val, _ := fi.Tag.Lookup("json")
-			info, err := buildFieldInfo(fi.Name, ptrStruct.Elem().Field(i), val)
-			if err != nil {
-				return err
-			}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	err = o.decodeJSONStruct(dec, dest, false)
+	if err != nil {
+		return err
+	}
 
-			structFields[info.actualFieldName] = info
-		}
+	if _, err = dec.Token(); err != io.EOF {
+		return errors.New("json: invalid character after top-level value")
 	}
 
-	// for each key/value pair set it to a field of struct or add it to extraFields
-	for k, v := range objmap {
-		field := structFields[k]
+	return nil
+}
+
+// DynDecodeJSON reads the next JSON encoded value from r and store the result into ptrStruct. The fields that aren't part of the struct are set inside extraFieldsPtr
+// The object is decoded while it's read, without reading it whole first, except the values of the fields with the string option or that are dynamic structs
+// The data after the value can be read from r too, so use a JSONDecoder to decode several values from the same reader
+// r is the reader of the JSON encoded rappresentation of the data
+// ptrStruct contains a reflect.Value pointer to the struct
+// extraFieldsPtr is the pointer to the extra fields, it can be a *map[string]interface{}, *Extras or *OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func DynDecodeJSON(r io.Reader, ptrStruct reflect.Value, extraFieldsPtr interface{}, extraFieldsName string) error {
+	return Options{}.DynDecodeJSON(r, ptrStruct, extraFieldsPtr, extraFieldsName)
+}
+
+// DynDecodeJSON is like the function DynDecodeJSON, but it uses the options o
+// With DisallowUnknownFields the struct can be modified even if an *UnknownFieldsError is returned, because the unknown fields are found while decoding
+func (o Options) DynDecodeJSON(r io.Reader, ptrStruct reflect.Value, extraFieldsPtr interface{}, extraFieldsName string) error {
+	return o.NewJSONDecoder(r).Decode(ptrStruct, extraFieldsPtr, extraFieldsName)
+}
+
+// JSONDecoder reads the dynamic structs from a stream of JSON values, like json.Decoder
+type JSONDecoder struct {
+	dec     *json.Decoder
+	options Options
+}
+
+// NewJSONDecoder return a JSONDecoder that reads from r
+func NewJSONDecoder(r io.Reader) *JSONDecoder {
+	return Options{}.NewJSONDecoder(r)
+}
 
-		if field.fieldValue.IsValid() {
-			if !field.omitted {
-				// the field k is part of the struct, so the value will be set inside
-				err = json.Unmarshal(objmap[k], field.fieldValue.Addr().Interface())
+// NewJSONDecoder is like the function NewJSONDecoder, but the decoder uses the options o
+func (o Options) NewJSONDecoder(r io.Reader) *JSONDecoder {
+	return &JSONDecoder{dec: json.NewDecoder(r), options: o}
+}
+
+// Decode reads the next JSON encoded value and store it into ptrStruct like DynDecodeJSON. It returns io.EOF if there are no more values
+// ptrStruct contains a reflect.Value pointer to the struct
+// extraFieldsPtr is the pointer to the extra fields, it can be a *map[string]interface{}, *Extras or *OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func (d *JSONDecoder) Decode(ptrStruct reflect.Value, extraFieldsPtr interface{}, extraFieldsName string) error {
+	dest, err := newDynDest(ptrStruct, extraFieldsPtr, extraFieldsName, "json", d.options.Merge)
+	if err != nil {
+		return err
+	}
+
+	return d.options.decodeJSONStruct(d.dec, dest, d.options.DisallowUnknownFields)
+}
+
+// decodeJSONStruct reads the next JSON object from dec and store it into dest, decoding each value directly from dec
+// If strict is true the unknown fields are collected while decoding and returned at the end as an *UnknownFieldsError, instead of being stored in the extra fields
+func (o Options) decodeJSONStruct(dec *json.Decoder, dest *dynDest, strict bool) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	switch tok {
+	case nil:
+		return nil
+	case json.Delim('{'):
+	default:
+		return errors.New("json: cannot unmarshal a value that isn't an object into a dynamic struct")
+	}
+
+	var unknown []string
+	for dec.More() {
+		tok, err = dec.Token()
+		if err != nil {
+			return err
+		}
+		key := tok.(string)
+
+		if field, ok := dest.field(key); ok {
+			// the field is part of the struct, so the value will be set inside
+			var raw json.RawMessage
+			fieldType := dest.fieldType(field)
+			if strict || field.quoted || isDynType(fieldType) {
+				// the whole value is needed before decoding it
+				err = dec.Decode(&raw)
 				if err != nil {
 					return err
 				}
 			}
+			if strict {
+				unknown, err = unknownJSONFields(raw, fieldType, key, unknown)
+				if err != nil {
+					return err
+				}
+			}
+
+			fieldValue, err := dest.fieldValue(field)
+			if err != nil {
+				return err
+			}
+
+			if field.quoted {
+				err = unmarshalQuotedJSON(raw, dest.fields.typ, field, fieldValue)
+			} else if raw == nil {
+				err = dec.Decode(fieldValue.Addr().Interface())
+			} else if d, ok := nestedDyn(fieldValue, raw[0] == '{'); ok {
+				// the nested dynamic struct is unmarshalled with the same options, except that its unknown fields have been already checked
+				nested := o
+				nested.DisallowUnknownFields = false
+				err = d.unmarshalJSON(raw, nested)
+			} else {
+				err = json.Unmarshal(raw, fieldValue.Addr().Interface())
+			}
+			if err != nil {
+				return err
+			}
+		} else if strict {
+			// the value is skipped
+			unknown = append(unknown, key)
+			err = dec.Decode(&json.RawMessage{})
+			if err != nil {
+				return err
+			}
 		} else {
-			// the field k is not part of the struct, so the kv will be added to extraFields
-			var out interface{}
-			err = json.Unmarshal(v, &out)
+			// the field is not part of the struct, so the kv will be added to extras
+			value, err := o.decodeJSONExtra(dec, dest.extras.isOrdered())
 			if err != nil {
 				return err
 			}
-			(*extraFieldsPtr)[k] = out
+			dest.extras.set(key, value)
 		}
 	}
 
+	// read the closing brace
+	if _, err = dec.Token(); err != nil {
+		return err
+	}
+
+	if len(unknown) > 0 {
+		return &UnknownFieldsError{Paths: unknown}
+	}
+
+	return nil
+}
+
+// decodeJSONExtra reads the next JSON value from dec and return it decoded as the value of an extra field, as set by the options o
+// ordered is true if the objects must be decoded as OrderedExtras
+func (o Options) decodeJSONExtra(dec *json.Decoder, ordered bool) (interface{}, error) {
+	if o.RawExtras || o.UseNumber {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err != nil {
+			return nil, err
+		}
+
+		if o.RawExtras {
+			return raw, nil
+		}
+		if ordered {
+			return decodeOrderedJSON(raw, true)
+		}
+
+		var out interface{}
+		numbers := json.NewDecoder(bytes.NewReader(raw))
+		numbers.UseNumber()
+		err = numbers.Decode(&out)
+		return out, err
+	}
+
+	if ordered {
+		return decodeOrderedJSONValue(dec)
+	}
+
+	var out interface{}
+	err := dec.Decode(&out)
+	return out, err
+}
+
+// FromJSON parses the JSON encoded data and store the result into the dynamic struct pointed by v, that can be a pointer to a struct or to a Dyn
+// The fields that aren't part of the struct are set inside the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func FromJSON(data []byte, v interface{}) error {
+	return Options{}.FromJSON(data, v)
+}
+
+// FromJSON is like the function FromJSON, but it uses the options o
+func (o Options) FromJSON(data []byte, v interface{}) error {
+	ptrStruct, err := dynStructPtr(v)
+	if err != nil {
+		return err
+	}
+
+	extraFields, name, err := extrasField(ptrStruct.Elem(), "json")
+	if err != nil {
+		return err
+	}
+
+	return o.DynUnmarshalJSON(data, ptrStruct, extraFields.Addr().Interface(), name)
+}
+
+// jsonMember is a key/value pair of a JSON object
+type jsonMember struct {
+	key   string
+	value json.RawMessage
+}
+
+// decodeJSONObject return the members of the JSON encoded object data, in order
+// If data is null there are no members
+func decodeJSONObject(data []byte) ([]jsonMember, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []jsonMember
+	switch tok {
+	case nil:
+	case json.Delim('{'):
+		for dec.More() {
+			tok, err = dec.Token()
+			if err != nil {
+				return nil, err
+			}
+
+			var value json.RawMessage
+			err = dec.Decode(&value)
+			if err != nil {
+				return nil, err
+			}
+
+			out = append(out, jsonMember{key: tok.(string), value: value})
+		}
+
+		// read the closing brace
+		if _, err = dec.Token(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("json: cannot unmarshal a value that isn't an object into a dynamic struct")
+	}
+
+	if _, err = dec.Token(); err != io.EOF {
+		return nil, errors.New("json: invalid character after top-level value")
+	}
+
+	return out, nil
+}
+
+// unknownJSONStructFields appends to paths the path of each member that isn't a field of the struct, also inside the values of the fields
+func unknownJSONStructFields(members []jsonMember, fields *typeFields, extraFieldsName string, path string, paths []string) ([]string, error) {
+	for _, m := range members {
+		field, ok := fields.fieldByName(m.key, extraFieldsName)
+		if !ok {
+			paths = append(paths, joinPath(path, m.key))
+			continue
+		}
+
+		fieldType := fields.typ.FieldByIndex(field.index).Type
+		var err error
+		paths, err = unknownJSONFields(m.value, fieldType, joinPath(path, m.key), paths)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return paths, nil
+}
+
+// unknownJSONFields appends to paths the path of each field of the JSON encoded data that isn't part of the type typ
+// The values that don't match typ are ignored, because they are reported by the unmarshalling
+func unknownJSONFields(data []byte, typ reflect.Type, path string, paths []string) ([]string, error) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	if typ.Kind() != reflect.Struct && (typ.Implements(jsonUnmarshalerType) || reflect.PtrTo(typ).Implements(jsonUnmarshalerType)) {
+		return paths, nil
+	}
+
+	switch typ.Kind() {
+	case reflect.Slice, reflect.Array:
+		var values []json.RawMessage
+		if json.Unmarshal(data, &values) != nil {
+			return paths, nil
+		}
+
+		var err error
+		for i, v := range values {
+			paths, err = unknownJSONFields(v, typ.Elem(), indexPath(path, i), paths)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case reflect.Map:
+		members, err := decodeJSONObject(data)
+		if err != nil {
+			return paths, nil
+		}
+
+		for _, m := range members {
+			paths, err = unknownJSONFields(m.value, typ.Elem(), joinPath(path, m.key), paths)
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		fields, extraFieldsName, ok, err := nestedStructFields(typ, "json", jsonUnmarshalerType)
+		if err != nil || !ok {
+			return paths, err
+		}
+
+		members, err := decodeJSONObject(data)
+		if err != nil {
+			return paths, nil
+		}
+
+		return unknownJSONStructFields(members, fields, extraFieldsName, path, paths)
+	}
+
+	return paths, nil
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// decodeOrderedJSON parses the JSON encoded data like json.Unmarshal into an interface{}, but the objects are decoded as OrderedExtras
+// If useNumber is true the numbers are decoded as json.Number
+func decodeOrderedJSON(data []byte, useNumber bool) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if useNumber {
+		dec.UseNumber()
+	}
+
+	out, err := decodeOrderedJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = dec.Token(); err != io.EOF {
+		return nil, errors.New("json: invalid character after top-level value")
+	}
+
+	return out, nil
+}
+
+// decodeOrderedJSONValue decodes the next value read from dec, the objects are decoded as OrderedExtras
+func decodeOrderedJSONValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		out := OrderedExtras{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+
+			value, err := decodeOrderedJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+
+			out.Set(key.(string), value)
+		}
+
+		_, err = dec.Token()
+		return out, err
+	case json.Delim('['):
+		out := []interface{}{}
+		for dec.More() {
+			value, err := decodeOrderedJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+
+			out = append(out, value)
+		}
+
+		_, err = dec.Token()
+		return out, err
+	default:
+		return tok, nil
+	}
+}
+
+// quotedJSONValue return the value that is marshalled as the JSON encoding of fieldValue inside a JSON string, like the string option of encoding/json
+// escapeHTML sets if the HTML characters are escaped in the encoding, like json.Encoder.SetEscapeHTML
+func quotedJSONValue(fieldValue reflect.Value, escapeHTML bool) (interface{}, error) {
+	if fieldValue.Kind() == reflect.Ptr && fieldValue.IsNil() {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(escapeHTML)
+	err := enc.Encode(fieldValue.Interface())
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// quotedFieldTypes contains, for each type of the fields with the string option, a struct type with only a field of that type tagged with the string option
+var quotedFieldTypes sync.Map
+
+// unmarshalQuotedJSON parses the JSON string data that contains the JSON encoding of the value of the field fi of the struct typ, like the string option of encoding/json
+// The value is decoded by encoding/json into a struct with only that field, so the result and the errors are the same of encoding/json
+func unmarshalQuotedJSON(data []byte, typ reflect.Type, fi fieldInfo, fieldValue reflect.Value) error {
+	wrapperType, ok := quotedFieldTypes.Load(fieldValue.Type())
+	if !ok {
+		wrapperType, _ = quotedFieldTypes.LoadOrStore(fieldValue.Type(), reflect.StructOf([]reflect.StructField{
+			{Name: "Value", Type: fieldValue.Type(), Tag: `json:"v,string"`},
+		}))
+	}
+
+	wrapper := reflect.New(wrapperType.(reflect.Type))
+	wrapper.Elem().Field(0).Set(fieldValue)
+
+	wrapperData := make([]byte, 0, len(data)+6)
+	wrapperData = append(wrapperData, `{"v":`...)
+	wrapperData = append(wrapperData, data...)
+	wrapperData = append(wrapperData, '}')
+
+	err := json.Unmarshal(wrapperData, wrapper.Interface())
+	if err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			typeErr.Struct = typ.Name()
+			typeErr.Field = fi.actualFieldName
+		}
+		return err
+	}
+
+	fieldValue.Set(wrapper.Elem().Field(0))
 	return nil
 }
@@ -18,9 +18,14 @@
 package godynstruct
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"io"
 	"reflect"
+	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -97,6 +102,46 @@ func TestDynMarshalJSON(t *testing.T) {
 	assert.JSONEq(t, expected, string(raw))
 }
 
+func TestDynMarshalJSONOrder(t *testing.T) {
+	p := Person{
+		ID:       "foobar",
+		Name:     "amreo",
+		Age:      99,
+		AltNames: []string{"bar", "foo"},
+		FavoriteOperatingSystems: []FavoriteOperatingSystem{
+			{
+				OS:    "Archlinux",
+				Since: 2015,
+				_otherInfo: map[string]interface{}{
+					"Kernel": "linux",
+					"Arch":   "x86_64",
+				},
+			},
+		},
+		_otherInfo: map[string]interface{}{
+			"Really":     true,
+			"Profession": "Gamer",
+			"Name":       "overwritten",
+		},
+	}
+
+	expected := `{"BarID":"foobar","Name":"overwritten","Age":99,"AltNames":["bar","foo"],"Certification":null,` +
+		`"FavoriteOperatingSystems":[{"OS":"Archlinux","Since":2015,"Arch":"x86_64","Kernel":"linux"}],` +
+		`"OptionalMainOperatingSystem":null,"OptionalTitle":null,"Profession":"Gamer","Really":true}`
+
+	raw, err := json.Marshal(p)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(raw))
+
+	raw, err = DynMarshalJSON(reflect.ValueOf(FooTagsTest{}), nil, "_otherInfo")
+	require.NoError(t, err)
+	assert.Equal(t, `{"Normal":0,"Bar":""}`, string(raw))
+
+	raw, err = DynMarshalJSON(reflect.ValueOf(struct{ others Extras }{}), nil, "")
+	require.NoError(t, err)
+	assert.Equal(t, `{}`, string(raw))
+}
+
 func TestDynMarshalJSONWithTags(t *testing.T) {
 	p := FooTagsTest{
 		Normal:            4,
@@ -204,3 +249,400 @@ func TestDynUnmarshalJSONWithTags(t *testing.T) {
 
 	assert.Equal(t, expected, out)
 }
+
+type TaggedExtras struct {
+	Name   string
+	Others map[string]interface{} `dyn:",extras"`
+}
+
+func TestDynJSONExtrasByTag(t *testing.T) {
+	p := TaggedExtras{
+		Name: "amreo",
+		Others: map[string]interface{}{
+			"Really": true,
+		},
+	}
+
+	raw, err := DynMarshalJSON(reflect.ValueOf(p), p.Others, "")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"Name": "amreo", "Really": true}`, string(raw))
+
+	var out TaggedExtras
+	require.NoError(t, DynUnmarshalJSON([]byte(`{"Name": "amreo", "Really": true, "Others": 3}`), reflect.ValueOf(&out), &out.Others, ""))
+	assert.Equal(t, TaggedExtras{
+		Name: "amreo",
+		Others: map[string]interface{}{
+			"Really": true,
+			"Others": 3.0,
+		},
+	}, out)
+
+	_, err = DynMarshalJSON(reflect.ValueOf(Person{}), nil, "")
+	assert.Error(t, err)
+
+	// a misspelled name of the extras field isn't encoded as a normal field
+	_, err = DynMarshalJSON(reflect.ValueOf(p), p.Others, "others")
+	assert.EqualError(t, err, "The struct godynstruct.TaggedExtras doesn't have a field named others")
+	err = DynUnmarshalJSON([]byte(`{"Name": "amreo"}`), reflect.ValueOf(&out), &out.Others, "Name")
+	assert.EqualError(t, err, "The field Name of godynstruct.TaggedExtras isn't of type Extras, OrderedExtras or map[string]interface{}")
+}
+
+type Metadata struct {
+	CreatedBy string
+	Revision  int `json:"rev"`
+	Title     string
+	Tag       string
+}
+
+type Audit struct {
+	Tag      string `json:"Tag"`
+	Reviewer string
+	Title    string
+}
+
+type audit2 struct {
+	Reviewer string
+	Approved bool
+}
+
+type Document struct {
+	Metadata
+	*Audit
+	audit2
+	Title  string
+	others map[string]interface{} `dyn:",extras"`
+}
+
+func TestDynJSONEmbeddedStructs(t *testing.T) {
+	doc := Document{
+		Metadata: Metadata{
+			CreatedBy: "amreo",
+			Revision:  3,
+			Title:     "hidden",
+			Tag:       "hidden",
+		},
+		Audit: &Audit{
+			Tag:      "reviewed",
+			Reviewer: "conflicting",
+			Title:    "hidden",
+		},
+		audit2: audit2{
+			Reviewer: "conflicting",
+			Approved: true,
+		},
+		Title: "Manual",
+		others: map[string]interface{}{
+			"Pages": 10.0,
+		},
+	}
+
+	raw, err := DynMarshalJSON(reflect.ValueOf(doc), doc.others, "")
+	require.NoError(t, err)
+
+	expected := `
+		{
+			"CreatedBy": "amreo",
+			"rev": 3,
+			"Tag": "reviewed",
+			"Approved": true,
+			"Title": "Manual",
+			"Pages": 10
+		}
+	`
+	assert.JSONEq(t, expected, string(raw))
+
+	// the same output of encoding/json, except the extras
+	type plainDocument Document
+	plainRaw, err := json.Marshal(plainDocument(doc))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"CreatedBy":"amreo","rev":3,"Tag":"reviewed","Approved":true,"Title":"Manual"}`, string(plainRaw))
+
+	var out Document
+	require.NoError(t, DynUnmarshalJSON([]byte(`{"CreatedBy":"amreo","rev":3,"Tag":"reviewed","Reviewer":"foo","Approved":true,"Title":"Manual","Pages":10}`), reflect.ValueOf(&out), &out.others, ""))
+	assert.Equal(t, Document{
+		Metadata: Metadata{
+			CreatedBy: "amreo",
+			Revision:  3,
+		},
+		Audit: &Audit{
+			Tag: "reviewed",
+		},
+		audit2: audit2{
+			Approved: true,
+		},
+		Title: "Manual",
+		others: map[string]interface{}{
+			"Reviewer": "foo",
+			"Pages":    10.0,
+		},
+	}, out)
+
+	raw, err = DynMarshalJSON(reflect.ValueOf(Document{Title: "Manual"}), nil, "")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"CreatedBy":"","rev":0,"Approved":false,"Title":"Manual"}`, string(raw))
+}
+
+type Account struct {
+	ID      int64   `json:"id,string"`
+	Balance float64 `json:"balance,string"`
+	Active  bool    `json:"active,string"`
+	Label   string  `json:"label,string"`
+	Parent  *int64  `json:"parent,string"`
+	Tags    []int   `json:"tags,string"`
+	Others  Extras  `json:"-"`
+}
+
+func TestDynJSONStringOption(t *testing.T) {
+	a := Account{
+		ID:      9007199254740993,
+		Balance: 10.5,
+		Active:  true,
+		Label:   "main",
+		Tags:    []int{1, 2},
+	}
+
+	// the output must be the same of encoding/json
+	type plainAccount Account
+	expected, err := json.Marshal(plainAccount(a))
+	require.NoError(t, err)
+
+	raw, err := DynMarshalJSON(reflect.ValueOf(a), nil, "")
+	require.NoError(t, err)
+	assert.JSONEq(t, string(expected), string(raw))
+	assert.JSONEq(t, `{"id":"9007199254740993","balance":"10.5","active":"true","label":"\"main\"","parent":null,"tags":[1,2]}`, string(raw))
+
+	var out Account
+	require.NoError(t, DynUnmarshalJSON(raw, reflect.ValueOf(&out), &out.Others, ""))
+	a.Others = Extras{}
+	assert.Equal(t, a, out)
+
+	parent := int64(3)
+	a.Parent = &parent
+	raw, err = DynMarshalJSON(reflect.ValueOf(a), nil, "")
+	require.NoError(t, err)
+	out = Account{}
+	require.NoError(t, DynUnmarshalJSON(raw, reflect.ValueOf(&out), &out.Others, ""))
+	assert.Equal(t, a, out)
+
+	// the HTML characters in the quoted values are escaped like json.Encoder
+	a.Label = "<a&b>"
+	for _, escapeHTML := range []bool{true, false} {
+		var expected, buf bytes.Buffer
+		stdEnc := json.NewEncoder(&expected)
+		stdEnc.SetEscapeHTML(escapeHTML)
+		require.NoError(t, stdEnc.Encode(plainAccount(a)))
+
+		enc := NewJSONEncoder(&buf)
+		enc.SetEscapeHTML(escapeHTML)
+		require.NoError(t, enc.Encode(reflect.ValueOf(a), a.Others, "Others"))
+		assert.Equal(t, expected.String(), buf.String())
+	}
+}
+
+func TestDynUnmarshalJSONStringOptionErrors(t *testing.T) {
+	type plainAccount Account
+
+	for _, data := range []string{
+		`{"id": 10}`,
+		`{"id": "abc"}`,
+		`{"id": ""}`,
+		`{"active": "1"}`,
+		`{"label": "main"}`,
+		`{"balance": "true"}`,
+		`{"parent": [1]}`,
+	} {
+		var expected plainAccount
+		expectedErr := json.Unmarshal([]byte(data), &expected)
+		require.Error(t, expectedErr, data)
+
+		var out Account
+		err := DynUnmarshalJSON([]byte(data), reflect.ValueOf(&out), &out.Others, "")
+		assert.EqualError(t, err, strings.Replace(expectedErr.Error(), "plainAccount", "Account", 1), data)
+	}
+
+	var out Account
+	assert.NoError(t, DynUnmarshalJSON([]byte(`{"id": null, "parent": "null"}`), reflect.ValueOf(&out), &out.Others, ""))
+	assert.Error(t, DynUnmarshalJSON([]byte(`{"id": "1.5"}`), reflect.ValueOf(&out), &out.Others, ""))
+}
+
+func TestDynDecodeJSON(t *testing.T) {
+	data := `
+		{
+			"Model": "Panda",
+			"year": 2000,
+			"Driver": { "Name": "amreo", "age": 20 },
+			"color": "red",
+			"engine": { "hp": 60, "fuel": [ "gas", "lpg" ] }
+		}
+	`
+
+	expected := Car{
+		Model:  "Panda",
+		Year:   2000,
+		Driver: &Dyn[Driver]{Value: Driver{Name: "amreo", Extras: Extras{"age": 20.0}}},
+		extras: Extras{"color": "red", "engine": map[string]interface{}{"hp": 60.0, "fuel": []interface{}{"gas", "lpg"}}},
+	}
+
+	// the data is read one byte at a time
+	var out Car
+	require.NoError(t, DynDecodeJSON(iotest.OneByteReader(strings.NewReader(data)), reflect.ValueOf(&out), &out.extras, ""))
+	assert.Equal(t, expected, out)
+
+	var event Event
+	require.NoError(t, Options{UseNumber: true}.DynDecodeJSON(strings.NewReader(`{"name":"start","b":{"x":1},"a":[2]}`), reflect.ValueOf(&event), &event.others, ""))
+	assert.Equal(t, Event{Name: "start", others: OrderedExtras{
+		{Key: "b", Value: OrderedExtras{{Key: "x", Value: json.Number("1")}}},
+		{Key: "a", Value: []interface{}{json.Number("2")}},
+	}}, event)
+
+	// the unknown fields are found while decoding
+	out = Car{}
+	err := Options{DisallowUnknownFields: true}.DynDecodeJSON(strings.NewReader(data), reflect.ValueOf(&out), &out.extras, "")
+	var unknownErr *UnknownFieldsError
+	require.True(t, errors.As(err, &unknownErr))
+	assert.Equal(t, []string{"Driver.age", "color", "engine"}, unknownErr.Paths)
+	assert.Equal(t, Extras{}, out.extras)
+
+	out = Car{}
+	assert.Error(t, DynDecodeJSON(strings.NewReader(`[1, 2]`), reflect.ValueOf(&out), &out.extras, ""))
+	assert.Error(t, DynDecodeJSON(strings.NewReader(`{"Model": "Panda", "year": `), reflect.ValueOf(&out), &out.extras, ""))
+	assert.Error(t, DynDecodeJSON(strings.NewReader(`{"year": "2000"}`), reflect.ValueOf(&out), &out.extras, ""))
+	out = Car{}
+	require.NoError(t, DynDecodeJSON(strings.NewReader(`null`), reflect.ValueOf(&out), &out.extras, ""))
+	assert.Equal(t, Car{extras: Extras{}}, out)
+}
+
+func TestJSONDecoder(t *testing.T) {
+	// the values are concatenated, so the decoder reads past the end of each one
+	dec := NewJSONDecoder(strings.NewReader(`{"name":"a","x":1} {"name":"b","y":2}` + "\n" + `null`))
+
+	var e Event
+	require.NoError(t, dec.Decode(reflect.ValueOf(&e), &e.others, ""))
+	assert.Equal(t, Event{Name: "a", others: OrderedExtras{{"x", 1.0}}}, e)
+	require.NoError(t, dec.Decode(reflect.ValueOf(&e), &e.others, ""))
+	assert.Equal(t, Event{Name: "b", others: OrderedExtras{{"y", 2.0}}}, e)
+	require.NoError(t, dec.Decode(reflect.ValueOf(&e), &e.others, ""))
+	assert.Equal(t, "b", e.Name)
+	assert.Equal(t, io.EOF, dec.Decode(reflect.ValueOf(&e), &e.others, ""))
+
+	dec = Options{DisallowUnknownFields: true}.NewJSONDecoder(strings.NewReader(`{"name":"a"}{"name":"b","x":1}`))
+	require.NoError(t, dec.Decode(reflect.ValueOf(&e), &e.others, ""))
+	assert.Equal(t, &UnknownFieldsError{Paths: []string{"x"}}, dec.Decode(reflect.ValueOf(&e), &e.others, ""))
+}
+
+func TestDynEncodeJSON(t *testing.T) {
+	in := Car{
+		Model:  "<Panda>",
+		Year:   2000,
+		Driver: &Dyn[Driver]{Value: Driver{Name: "amreo", Extras: Extras{"age": 20}}},
+		extras: Extras{
+			"color":  "red & white",
+			"engine": map[string]interface{}{"hp": 60, "fuel": []string{"gas", "lpg"}},
+			"raw":    json.RawMessage(`{"a":[1,2],"b":{}}`),
+			"empty":  Extras{},
+		},
+	}
+
+	compact, err := DynMarshalJSON(reflect.ValueOf(in), in.extras, "")
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, DynEncodeJSON(&buf, reflect.ValueOf(in), in.extras, ""))
+	assert.Equal(t, string(compact)+"\n", buf.String())
+
+	// the indentation is the same of json.Encoder
+	var expected bytes.Buffer
+	require.NoError(t, json.Indent(&expected, compact, ">", "\t"))
+	buf.Reset()
+	enc := NewJSONEncoder(&buf)
+	enc.SetIndent(">", "\t")
+	require.NoError(t, enc.Encode(reflect.ValueOf(in), in.extras, ""))
+	require.NoError(t, enc.Encode(reflect.ValueOf(in), in.extras, ""))
+	assert.Equal(t, expected.String()+"\n"+expected.String()+"\n", buf.String())
+
+	buf.Reset()
+	enc = NewJSONEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	require.NoError(t, enc.Encode(reflect.ValueOf(in), in.extras, ""))
+	assert.Contains(t, buf.String(), `"Model":"<Panda>"`)
+	assert.Contains(t, buf.String(), `"color":"red & white"`)
+	assert.Contains(t, string(compact), `"Model":"\u003cPanda\u003e"`)
+
+	buf.Reset()
+	enc = Options{Collisions: StructWins}.NewJSONEncoder(&buf)
+	enc.SetIndent("", "  ")
+	require.NoError(t, enc.Encode(reflect.ValueOf(Event{Name: "start"}), OrderedExtras{{Key: "name", Value: "stop"}, {Key: "empty", Value: OrderedExtras{}}}, ""))
+	assert.Equal(t, "{\n  \"name\": \"start\",\n  \"source\": \"\",\n  \"empty\": {}\n}\n", buf.String())
+
+	assert.Error(t, DynEncodeJSON(failingWriter{}, reflect.ValueOf(in), in.extras, ""))
+}
+
+// failingWriter is a writer that always fails
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func BenchmarkDynMarshalJSON(b *testing.B) {
+	p := Person{
+		ID:       "foobar",
+		Name:     "amreo",
+		Age:      99,
+		AltNames: []string{"bar", "foo"},
+		_otherInfo: map[string]interface{}{
+			"Profession": "Gamer",
+			"Really":     true,
+		},
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := DynMarshalJSON(reflect.ValueOf(p), p._otherInfo, "_otherInfo"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDynUnmarshalJSON(b *testing.B) {
+	data := []byte(`{"BarID":"foobar","Name":"amreo","Age":99,"AltNames":["bar","foo"],"Profession":"Gamer","Really":true}`)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var out Person
+		if err := DynUnmarshalJSON(data, reflect.ValueOf(&out), &out._otherInfo, "_otherInfo"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDynDecodeJSON(b *testing.B) {
+	data := []byte(`{"BarID":"foobar","Name":"amreo","Age":99,"AltNames":["bar","foo"],"Profession":"Gamer","Really":true}`)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var out Person
+		if err := DynDecodeJSON(bytes.NewReader(data), reflect.ValueOf(&out), &out._otherInfo, "_otherInfo"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDynJSONInvalidValues(t *testing.T) {
+	var nilPerson *Person
+	_, err := DynMarshalJSON(reflect.ValueOf(nilPerson), nil, "_otherInfo")
+	assert.EqualError(t, err, "The pointer of type *godynstruct.Person is nil")
+	_, err = DynMarshalJSON(reflect.ValueOf(42), nil, "_otherInfo")
+	assert.EqualError(t, err, "The value of type int isn't a struct or a pointer to a struct")
+	_, err = DynMarshalJSON(reflect.Value{}, nil, "_otherInfo")
+	assert.EqualError(t, err, "The value nil isn't a struct or a pointer to a struct")
+
+	var p Person
+	assert.EqualError(t, DynUnmarshalJSON([]byte(`{}`), reflect.ValueOf(p), &p._otherInfo, "_otherInfo"), "The value of type godynstruct.Person isn't a non-nil pointer to a struct")
+	assert.EqualError(t, DynUnmarshalJSON([]byte(`{}`), reflect.ValueOf(nilPerson), &p._otherInfo, "_otherInfo"), "The value of type *godynstruct.Person isn't a non-nil pointer to a struct")
+	n := 42
+	assert.EqualError(t, DynUnmarshalJSON([]byte(`{}`), reflect.ValueOf(&n), &p._otherInfo, "_otherInfo"), "The type int isn't a struct")
+	_, err = DynMarshalBSON(reflect.ValueOf(&n), nil, "_otherInfo")
+	assert.EqualError(t, err, "The value of type int isn't a struct or a pointer to a struct")
+	assert.EqualError(t, DynUnmarshalJSON([]byte(`{}`), reflect.ValueOf(&p), nil, "_otherInfo"), "The extra fields value nil isn't a non-nil pointer to Extras, OrderedExtras or map[string]interface{}")
+}
@@ -0,0 +1,365 @@
+// go-dyn-struct
+// Copyright (C) 2020  Andrea Laisa
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+// © 2020 GitHub, Inc.
+
+package godynstruct
+
+import (
+	"bytes"
+	"reflect"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// DynMarshalMsgpack return the MessagePack encoding of the dynamic struct _struct
+// The fields of the struct are encoded in declaration order, followed by the extra fields sorted by key, or in their order if they are OrderedExtras
+// The numbers in the extra fields keep their type, so the ones decoded by DynUnmarshalMsgpack are encoded again with the same size
+// If an extra field has the same name of a field of the struct, the value of the extra field is used in place of the field
+// _struct contains the reflect.Value of the struct
+// extraFields contains the extra fields, it can be a map[string]interface{}, Extras or OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func DynMarshalMsgpack(_struct reflect.Value, extraFields interface{}, extraFieldsName string) ([]byte, error) {
+	return Options{}.DynMarshalMsgpack(_struct, extraFields, extraFieldsName)
+}
+
+// DynMarshalMsgpack is like the function DynMarshalMsgpack, but it uses the options o
+func (o Options) DynMarshalMsgpack(_struct reflect.Value, extraFields interface{}, extraFieldsName string) ([]byte, error) {
+	members, err := o.dynMembers(_struct, extraFields, extraFieldsName, "msgpack")
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(OrderedExtras, len(members))
+	for i, m := range members {
+		out[i] = ExtraField{Key: m.key, Value: m.value}
+	}
+
+	return encodeMsgpackMap(out)
+}
+
+// encodeMsgpackMap return the MessagePack encoding of the pairs as a map with the keys in order
+func encodeMsgpackMap(pairs OrderedExtras) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	// the keys of the maps nested in the values are sorted, so the same values have always the same encoding
+	enc.SetSortMapKeys(true)
+
+	err := enc.EncodeMapLen(len(pairs))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range pairs {
+		err = enc.EncodeString(f.Key)
+		if err != nil {
+			return nil, err
+		}
+		err = enc.Encode(f.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ToMsgpack return the MessagePack encoding of the dynamic struct v, that can be a struct, a Dyn or a pointer to one of them
+// The extra fields are the ones in the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func ToMsgpack(v interface{}) ([]byte, error) {
+	return Options{}.ToMsgpack(v)
+}
+
+// ToMsgpack is like the function ToMsgpack, but it uses the options o
+func (o Options) ToMsgpack(v interface{}) ([]byte, error) {
+	ptrStruct, err := dynStruct(v)
+	if err != nil {
+		return nil, err
+	}
+
+	extraFields, name, err := extrasField(ptrStruct.Elem(), "msgpack")
+	if err != nil {
+		return nil, err
+	}
+
+	return o.DynMarshalMsgpack(ptrStruct, extraFields.Interface(), name)
+}
+
+// DynUnmarshalMsgpack parses the MessagePack encoded data and store the result into the dynamic struct pointed by ptrStruct
+// The keys of the map that aren't part of the struct are set inside the extras, in order if they are OrderedExtras
+// The numbers in the extra fields are decoded with the type of their encoding, like int8 or float32, so they are encoded again in the same way
+// With the option RawExtras the values of the extra fields are stored as msgpack.RawMessage
+// data is the MessagePack encoded data, that must contain a map with string keys or nil
+// ptrStruct contains the reflect.Value of the pointer to the struct
+// extraFieldsPtr is the pointer to the extra fields, it can be a *map[string]interface{}, *Extras or *OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func DynUnmarshalMsgpack(data []byte, ptrStruct reflect.Value, extraFieldsPtr interface{}, extraFieldsName string) error {
+	return Options{}.DynUnmarshalMsgpack(data, ptrStruct, extraFieldsPtr, extraFieldsName)
+}
+
+// DynUnmarshalMsgpack is like the function DynUnmarshalMsgpack, but it uses the options o
+func (o Options) DynUnmarshalMsgpack(data []byte, ptrStruct reflect.Value, extraFieldsPtr interface{}, extraFieldsName string) error {
+	dest, err := newDynDest(ptrStruct, extraFieldsPtr, extraFieldsName, "msgpack", o.Merge)
+	if err != nil {
+		return err
+	}
+
+	members, err := decodeMsgpackMap(data)
+	if err != nil {
+		return err
+	}
+
+	if o.DisallowUnknownFields {
+		paths, err := unknownMsgpackStructFields(members, dest.fields, dest.extraFieldsName, "", nil)
+		if err != nil {
+			return err
+		}
+		if len(paths) > 0 {
+			return &UnknownFieldsError{Paths: paths}
+		}
+	}
+
+	// for each key/value pair, set it to a field of struct or to extras
+	for _, m := range members {
+		if field, ok := dest.field(m.key); ok {
+			// the field m.key is part of the struct, so the value will be set inside
+			fieldValue, err := dest.fieldValue(field)
+			if err != nil {
+				return err
+			}
+
+			if d, ok := nestedDyn(fieldValue, isMsgpackMap(m.value)); ok {
+				// the nested dynamic struct is unmarshalled with the same options
+				err = d.unmarshalMsgpack(m.value, o)
+			} else {
+				err = msgpack.Unmarshal(m.value, fieldValue.Addr().Interface())
+			}
+			if err != nil {
+				return err
+			}
+		} else if o.RawExtras {
+			dest.extras.set(m.key, m.value)
+		} else {
+			// the field m.key is not part of the struct, so the value is decoded into extras
+			var out interface{}
+			if dest.extras.isOrdered() {
+				out, err = decodeOrderedMsgpack(m.value)
+			} else {
+				err = msgpack.Unmarshal(m.value, &out)
+			}
+			if err != nil {
+				return err
+			}
+			dest.extras.set(m.key, out)
+		}
+	}
+
+	return nil
+}
+
+// FromMsgpack parses the MessagePack encoded data and store the result into the dynamic struct pointed by v, that can be a pointer to a struct or to a Dyn
+// The keys that aren't part of the struct are set inside the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func FromMsgpack(data []byte, v interface{}) error {
+	return Options{}.FromMsgpack(data, v)
+}
+
+// FromMsgpack is like the function FromMsgpack, but it uses the options o
+func (o Options) FromMsgpack(data []byte, v interface{}) error {
+	ptrStruct, err := dynStructPtr(v)
+	if err != nil {
+		return err
+	}
+
+	extraFields, name, err := extrasField(ptrStruct.Elem(), "msgpack")
+	if err != nil {
+		return err
+	}
+
+	return o.DynUnmarshalMsgpack(data, ptrStruct, extraFields.Addr().Interface(), name)
+}
+
+// msgpackMember is a key/value pair of a MessagePack map, with the value still encoded
+type msgpackMember struct {
+	key   string
+	value msgpack.RawMessage
+}
+
+// decodeMsgpackMap return the key/value pairs of the MessagePack encoded map data, in order
+// It return no pairs if data contains nil
+func decodeMsgpackMap(data []byte) ([]msgpackMember, error) {
+	r := bytes.NewReader(data)
+	dec := msgpack.NewDecoder(r)
+	n, err := dec.DecodeMapLen()
+	if err != nil {
+		return nil, err
+	}
+
+	// n is -1 if the map is nil, and it isn't trusted for the capacity, because each pair takes at least two of the bytes left
+	size := n
+	if size > r.Len()/2 {
+		size = r.Len() / 2
+	}
+	if size < 0 {
+		size = 0
+	}
+	members := make([]msgpackMember, 0, size)
+	for i := 0; i < n; i++ {
+		k, err := dec.DecodeString()
+		if err != nil {
+			return nil, err
+		}
+		v, err := dec.DecodeRaw()
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, msgpackMember{key: k, value: v})
+	}
+
+	return members, nil
+}
+
+// isMsgpackMap return true if the MessagePack encoded value data is a map
+func isMsgpackMap(data []byte) bool {
+	return len(data) > 0 && (msgpcode.IsFixedMap(data[0]) || data[0] == msgpcode.Map16 || data[0] == msgpcode.Map32)
+}
+
+// decodeOrderedMsgpack parses the MessagePack encoded data like msgpack.Unmarshal into an interface{}, but the maps are decoded as OrderedExtras
+func decodeOrderedMsgpack(data []byte) (interface{}, error) {
+	return decodeOrderedMsgpackValue(msgpack.NewDecoder(bytes.NewReader(data)))
+}
+
+// decodeOrderedMsgpackValue reads the next value from dec, decoding the maps as OrderedExtras
+func decodeOrderedMsgpackValue(dec *msgpack.Decoder) (interface{}, error) {
+	c, err := dec.PeekCode()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case msgpcode.IsFixedMap(c) || c == msgpcode.Map16 || c == msgpcode.Map32:
+		n, err := dec.DecodeMapLen()
+		if err != nil {
+			return nil, err
+		}
+
+		// n isn't trusted for the capacity, because the data can be shorter
+		out := make(OrderedExtras, 0)
+		for i := 0; i < n; i++ {
+			k, err := dec.DecodeString()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeOrderedMsgpackValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			out.Set(k, v)
+		}
+		return out, nil
+	case msgpcode.IsFixedArray(c) || c == msgpcode.Array16 || c == msgpcode.Array32:
+		n, err := dec.DecodeArrayLen()
+		if err != nil {
+			return nil, err
+		}
+
+		out := make([]interface{}, 0)
+		for i := 0; i < n; i++ {
+			v, err := decodeOrderedMsgpackValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	default:
+		return dec.DecodeInterface()
+	}
+}
+
+// unknownMsgpackStructFields appends to paths the path of each member that isn't a field of the struct, also inside the values of the fields
+func unknownMsgpackStructFields(members []msgpackMember, fields *typeFields, extraFieldsName string, path string, paths []string) ([]string, error) {
+	for _, m := range members {
+		field, ok := fields.fieldByName(m.key, extraFieldsName)
+		if !ok {
+			paths = append(paths, joinPath(path, m.key))
+			continue
+		}
+
+		fieldType := fields.typ.FieldByIndex(field.index).Type
+		var err error
+		paths, err = unknownMsgpackFields(m.value, fieldType, joinPath(path, m.key), paths)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return paths, nil
+}
+
+// unknownMsgpackFields appends to paths the path of each key of the MessagePack encoded data that isn't part of the type typ
+// The values that don't match typ are ignored, because they are reported by the unmarshalling
+func unknownMsgpackFields(data []byte, typ reflect.Type, path string, paths []string) ([]string, error) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	if typ.Kind() != reflect.Struct && (typ.Implements(msgpackUnmarshalerType) || reflect.PtrTo(typ).Implements(msgpackUnmarshalerType)) {
+		return paths, nil
+	}
+
+	switch typ.Kind() {
+	case reflect.Slice, reflect.Array:
+		var values []msgpack.RawMessage
+		if msgpack.Unmarshal(data, &values) != nil {
+			return paths, nil
+		}
+
+		var err error
+		for i, v := range values {
+			paths, err = unknownMsgpackFields(v, typ.Elem(), indexPath(path, i), paths)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case reflect.Map:
+		members, err := decodeMsgpackMap(data)
+		if err != nil {
+			return paths, nil
+		}
+
+		for _, m := range members {
+			paths, err = unknownMsgpackFields(m.value, typ.Elem(), joinPath(path, m.key), paths)
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		fields, extraFieldsName, ok, err := nestedStructFields(typ, "msgpack", msgpackUnmarshalerType)
+		if err != nil || !ok {
+			return paths, err
+		}
+
+		members, err := decodeMsgpackMap(data)
+		if err != nil {
+			return paths, nil
+		}
+
+		return unknownMsgpackStructFields(members, fields, extraFieldsName, path, paths)
+	}
+
+	return paths, nil
+}
+
+var msgpackUnmarshalerType = reflect.TypeOf((*msgpack.Unmarshaler)(nil)).Elem()
@@ -0,0 +1,161 @@
+// go-dyn-struct
+// Copyright (C) 2020  Andrea Laisa
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+// © 2020 GitHub, Inc.
+
+package godynstruct
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type Message struct {
+	ID      int64  `msgpack:"id"`
+	Method  string `msgpack:"method"`
+	Trace   string `msgpack:"trace,omitempty"`
+	Local   string `msgpack:"-"`
+	Payload *Dyn[Driver]
+	others  OrderedExtras
+}
+
+func TestDynMsgpack(t *testing.T) {
+	m := Message{
+		ID:      1,
+		Method:  "ping",
+		Local:   "ignored",
+		Payload: &Dyn[Driver]{Value: Driver{Name: "amreo", Extras: Extras{"License": "B"}}},
+		others: OrderedExtras{
+			{"zeta", OrderedExtras{{"y", int8(1)}, {"b", []interface{}{uint16(2), float32(1.5)}}}},
+			{"alpha", 3.25},
+		},
+	}
+
+	raw, err := DynMarshalMsgpack(reflect.ValueOf(m), m.others, "others")
+	require.NoError(t, err)
+
+	expected, err := msgpack.Marshal(OrderedExtras{
+		{"id", int64(1)},
+		{"method", "ping"},
+		{"Payload", OrderedExtras{{"Name", "amreo"}, {"License", "B"}}},
+		{"zeta", OrderedExtras{{"y", int8(1)}, {"b", []interface{}{uint16(2), float32(1.5)}}}},
+		{"alpha", 3.25},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, expected, raw)
+
+	var out Message
+	require.NoError(t, DynUnmarshalMsgpack(raw, reflect.ValueOf(&out), &out.others, "others"))
+	m.Local = ""
+	assert.Equal(t, m, out)
+
+	// the numbers of the extra fields keep their type, so they are encoded again in the same way
+	again, err := DynMarshalMsgpack(reflect.ValueOf(out), out.others, "others")
+	require.NoError(t, err)
+	assert.Equal(t, raw, again)
+
+	var d Driver
+	require.NoError(t, DynUnmarshalMsgpack(raw, reflect.ValueOf(&d), &d.Extras, ""))
+	assert.Equal(t, Extras{
+		"id":      int64(1),
+		"method":  "ping",
+		"Payload": map[string]interface{}{"Name": "amreo", "License": "B"},
+		"zeta":    map[string]interface{}{"y": int8(1), "b": []interface{}{uint16(2), float32(1.5)}},
+		"alpha":   3.25,
+	}, d.Extras)
+
+	// nil leaves the struct as it is
+	require.NoError(t, DynUnmarshalMsgpack([]byte{0xc0}, reflect.ValueOf(&out), &out.others, "others"))
+	assert.Equal(t, "ping", out.Method)
+
+	assert.Error(t, DynUnmarshalMsgpack([]byte{0x91, 0x01}, reflect.ValueOf(&out), &out.others, "others"))
+	assert.Error(t, DynUnmarshalMsgpack([]byte{0x81, 0xa2, 'i', 'd'}, reflect.ValueOf(&out), &out.others, "others"))
+}
+
+func TestDynMsgpackOptions(t *testing.T) {
+	raw, err := msgpack.Marshal(OrderedExtras{
+		{"method", "ping"},
+		{"extra", int16(-300)},
+		{"Payload", OrderedExtras{{"Name", "amreo"}, {"License", "B"}}},
+	})
+	require.NoError(t, err)
+
+	var m Message
+	err = Options{DisallowUnknownFields: true}.DynUnmarshalMsgpack(raw, reflect.ValueOf(&m), &m.others, "others")
+	assert.Equal(t, &UnknownFieldsError{Paths: []string{"extra", "Payload.License"}}, err)
+
+	m = Message{}
+	require.NoError(t, Options{RawExtras: true}.DynUnmarshalMsgpack(raw, reflect.ValueOf(&m), &m.others, "others"))
+	assert.Equal(t, OrderedExtras{{"extra", msgpack.RawMessage{0xd1, 0xfe, 0xd4}}}, m.others)
+	var extra int
+	require.NoError(t, m.others.Decode("extra", &extra))
+	assert.Equal(t, -300, extra)
+
+	again, err := DynMarshalMsgpack(reflect.ValueOf(m), m.others, "others")
+	require.NoError(t, err)
+	var out OrderedExtras
+	require.NoError(t, msgpack.Unmarshal(again, &out))
+	extraValue, _ := out.Get("extra")
+	assert.Equal(t, int16(-300), extraValue)
+
+	// the raw extra fields are decoded when they are encoded in another format
+	json, err := DynMarshalJSON(reflect.ValueOf(Event{Name: "login"}), m.others, "")
+	require.NoError(t, err)
+	assert.Equal(t, `{"name":"login","source":"","extra":-300}`, string(json))
+}
+
+func TestDynMsgpackLengths(t *testing.T) {
+	// the lengths in the headers of the maps and of the arrays are bigger than the data, so they must not be used to allocate
+	truncated := [][]byte{
+		{0xdf, 0x7f, 0xff, 0xff, 0xff},
+		{0x81, 0xa1, 'x', 0xdf, 0x7f, 0xff, 0xff, 0xff},
+		{0x81, 0xa1, 'x', 0xdd, 0x7f, 0xff, 0xff, 0xff},
+		{0x81, 0xa1, 'x', 0x91, 0xdf, 0x7f, 0xff, 0xff, 0xff},
+		{0x81, 0xa2, 'i', 'd', 0xdd, 0x7f, 0xff, 0xff, 0xff},
+		{0x81, 0xa7, 'P', 'a', 'y', 'l', 'o', 'a', 'd', 0xdf, 0x7f, 0xff, 0xff, 0xff},
+	}
+
+	for _, data := range truncated {
+		var m Message
+		assert.Error(t, DynUnmarshalMsgpack(data, reflect.ValueOf(&m), &m.others, "others"))
+		m = Message{}
+		assert.Error(t, Options{DisallowUnknownFields: true}.DynUnmarshalMsgpack(data, reflect.ValueOf(&m), &m.others, "others"))
+		m = Message{}
+		assert.Error(t, Options{RawExtras: true}.DynUnmarshalMsgpack(data, reflect.ValueOf(&m), &m.others, "others"))
+
+		var d Driver
+		assert.Error(t, DynUnmarshalMsgpack(data, reflect.ValueOf(&d), &d.Extras, ""))
+	}
+
+	// the empty maps and arrays are decoded as empty values
+	var m Message
+	require.NoError(t, DynUnmarshalMsgpack([]byte{0x82, 0xa1, 'x', 0x80, 0xa1, 'y', 0x90}, reflect.ValueOf(&m), &m.others, "others"))
+	assert.Equal(t, OrderedExtras{{"x", OrderedExtras{}}, {"y", []interface{}{}}}, m.others)
+}
+
+func TestDynMsgpackSortedMaps(t *testing.T) {
+	// the keys of the nested maps are sorted, so the encoding is always the same
+	d := Driver{Name: "amreo", Extras: Extras{"m": map[string]interface{}{"bb": 1, "a": 2, "c": 3, "d": 4, "e": 5}}}
+	for i := 0; i < 20; i++ {
+		raw, err := ToMsgpack(d)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0x82, 0xa4, 'N', 'a', 'm', 'e', 0xa5, 'a', 'm', 'r', 'e', 'o',
+			0xa1, 'm', 0x85, 0xa1, 'a', 0x02, 0xa2, 'b', 'b', 0x01, 0xa1, 'c', 0x03, 0xa1, 'd', 0x04, 0xa1, 'e', 0x05}, raw)
+	}
+}
@@ -0,0 +1,150 @@
+// go-dyn-struct
+// Copyright (C) 2020  Andrea Laisa
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+// © 2020 GitHub, Inc.
+
+package godynstruct
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Options contains the options of the dynamic marshallers and unmarshallers
+// The zero value contains the default options, that are the ones used by the package functions
+type Options struct {
+	// DisallowUnknownFields makes the unmarshallers return an *UnknownFieldsError listing every field that isn't part of the struct,
+	// instead of storing them in the extra fields
+	// The fields of the nested structs are checked too, except the ones of the dynamic structs without a field of type Extras,
+	// OrderedExtras or tagged with dyn:",extras"
+	DisallowUnknownFields bool
+	// Merge makes the unmarshallers add the unknown fields to the extra fields already present, instead of emptying them first
+	// The objects already present are merged recursively with the new ones, the other values are replaced
+	// The nested dynamic structs are merged too, when they are a field, or a pointer to a field, of type Dyn
+	Merge bool
+	// UseNumber makes the JSON unmarshallers decode the numbers in the extra fields as json.Number instead of float64,
+	// so they are marshalled again exactly as they were, without losing precision
+	UseNumber bool
+	// RawExtras makes the unmarshallers store the values of the extra fields without decoding them, as json.RawMessage, bson.RawValue, *yaml.Node, msgpack.RawMessage or cbor.RawMessage,
+	// so they are encoded again as they are by the marshaller of the same format, and decoded when they are encoded in another format
+	// The values can be decoded on demand with the method Decode of Extras and OrderedExtras
+	// With Merge the raw values already present are replaced
+	// The XML unmarshallers always store the child elements as XMLElement
+	RawExtras bool
+	// Collisions is the policy applied by the marshallers when an extra field has the same name of a field of the struct
+	// The default is ExtrasWin
+	Collisions CollisionPolicy
+}
+
+// CollisionPolicy tells the marshallers what to do when an extra field has the same name of a field of the struct
+type CollisionPolicy int
+
+const (
+	// ExtrasWin encodes the value of the extra field in place of the field of the struct
+	ExtrasWin CollisionPolicy = iota
+	// StructWins encodes the field of the struct and ignores the extra field
+	StructWins
+	// CollisionError makes the marshallers return an error naming the conflicting key
+	CollisionError
+)
+
+// resolveCollisions splits extras by the policy p in the extra fields that replace a field of the struct, by name,
+// and the ones that must be added after the fields of the struct
+func (p CollisionPolicy) resolveCollisions(extras OrderedExtras, fields *typeFields, extraFieldsName string) (map[string]interface{}, OrderedExtras, error) {
+	if p != ExtrasWin && p != StructWins && p != CollisionError {
+		return nil, nil, errors.New("Unknown collision policy " + strconv.Itoa(int(p)))
+	}
+
+	overrides := make(map[string]interface{})
+	rest := make(OrderedExtras, 0, len(extras))
+	for _, f := range extras {
+		if _, ok := fields.fieldByName(f.Key, extraFieldsName); !ok {
+			rest = append(rest, f)
+			continue
+		}
+
+		switch p {
+		case ExtrasWin:
+			overrides[f.Key] = f.Value
+		case CollisionError:
+			return nil, nil, errors.New("The extra field " + f.Key + " has the same name of a field of the struct " + fields.typ.String())
+		}
+	}
+
+	return overrides, rest, nil
+}
+
+// UnknownFieldsError is the error returned when the encoded data contains fields that aren't part of the struct and DisallowUnknownFields is set
+type UnknownFieldsError struct {
+	// Paths contains the path of every unknown field, like Foo.Bar[2].Baz
+	Paths []string
+}
+
+func (e *UnknownFieldsError) Error() string {
+	quoted := make([]string, len(e.Paths))
+	for i, p := range e.Paths {
+		quoted[i] = strconv.Quote(p)
+	}
+
+	return "unknown fields " + strings.Join(quoted, ", ")
+}
+
+// joinPath return the path of the field key of the object at path
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+// indexPath return the path of the i-th element of the array at path
+func indexPath(path string, i int) string {
+	return path + "[" + strconv.Itoa(i) + "]"
+}
+
+// nestedStructFields return the fields of the struct typ, found nested in the value being unmarshalled, and the name of its extras field
+// ok is false if the fields of typ can't be known, because it isn't a struct or because it's decoded by a custom unmarshaller
+// that isn't a dynamic struct with a field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func nestedStructFields(typ reflect.Type, tagKey string, unmarshalerType reflect.Type) (fields *typeFields, extraFieldsName string, ok bool, err error) {
+	dynamic := false
+	if typ.Implements(dynWrapperType) {
+		typ = reflect.Zero(typ).Interface().(dynWrapper).wrappedType()
+		dynamic = true
+	} else if typ.Implements(unmarshalerType) || reflect.PtrTo(typ).Implements(unmarshalerType) {
+		dynamic = true
+	}
+
+	if typ.Kind() != reflect.Struct {
+		return nil, "", false, nil
+	}
+
+	fields, err = cachedTypeFields(typ, tagKey)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	if dynamic {
+		extrasField, err := fields.extrasField()
+		if err != nil {
+			return nil, "", false, nil
+		}
+		extraFieldsName = extrasField.name
+	}
+
+	return fields, extraFieldsName, true, nil
+}
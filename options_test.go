@@ -0,0 +1,304 @@
+// go-dyn-struct
+// Copyright (C) 2020  Andrea Laisa
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+// © 2020 GitHub, Inc.
+
+package godynstruct
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type Order struct {
+	ID     string       `json:"id" bson:"id"`
+	Items  []Item       `json:"items" bson:"items"`
+	Buyer  *Dyn[Driver] `json:"buyer" bson:"buyer"`
+	Notes  map[string]Item
+	extras Extras
+}
+
+type Item struct {
+	SKU string `json:"sku" bson:"sku"`
+}
+
+func TestUnknownFieldsError(t *testing.T) {
+	err := &UnknownFieldsError{Paths: []string{"foo", "bar[1].baz"}}
+	assert.Equal(t, `unknown fields "foo", "bar[1].baz"`, err.Error())
+}
+
+func TestDynUnmarshalJSONDisallowUnknownFields(t *testing.T) {
+	strict := Options{DisallowUnknownFields: true}
+	data := `
+		{
+			"id": "1",
+			"items": [ { "sku": "a" }, { "sku": "b", "color": "red" } ],
+			"buyer": { "Name": "amreo", "vip": true },
+			"Notes": { "first": { "sku": "c", "size": 3 } },
+			"coupon": "X"
+		}
+	`
+
+	var out Order
+	err := strict.DynUnmarshalJSON([]byte(data), reflect.ValueOf(&out), &out.extras, "")
+	var unknownErr *UnknownFieldsError
+	require.True(t, errors.As(err, &unknownErr))
+	assert.Equal(t, []string{"items[1].color", "buyer.vip", "Notes.first.size", "coupon"}, unknownErr.Paths)
+	assert.Equal(t, Order{extras: Extras{}}, out)
+
+	require.NoError(t, strict.DynUnmarshalJSON([]byte(`{"id": "1", "items": [ { "sku": "a" } ], "buyer": { "Name": "amreo" }}`), reflect.ValueOf(&out), &out.extras, ""))
+	assert.Equal(t, "1", out.ID)
+	assert.Equal(t, Extras{}, out.extras)
+
+	// without the option the unknown fields are stored in the extra fields
+	require.NoError(t, Options{}.DynUnmarshalJSON([]byte(`{"id": "1", "coupon": "X"}`), reflect.ValueOf(&out), &out.extras, ""))
+	assert.Equal(t, Extras{"coupon": "X"}, out.extras)
+}
+
+func TestDynUnmarshalBSONDisallowUnknownFields(t *testing.T) {
+	strict := Options{DisallowUnknownFields: true}
+	data, err := bson.Marshal(bson.D{
+		bson.E{Key: "id", Value: "1"},
+		bson.E{Key: "items", Value: bson.A{
+			bson.D{bson.E{Key: "sku", Value: "a"}},
+			bson.D{bson.E{Key: "sku", Value: "b"}, bson.E{Key: "color", Value: "red"}},
+		}},
+		bson.E{Key: "buyer", Value: bson.D{bson.E{Key: "Name", Value: "amreo"}, bson.E{Key: "vip", Value: true}}},
+		bson.E{Key: "coupon", Value: "X"},
+	})
+	require.NoError(t, err)
+
+	var out Order
+	err = strict.DynUnmarshalBSON(data, reflect.ValueOf(&out), &out.extras, "")
+	var unknownErr *UnknownFieldsError
+	require.True(t, errors.As(err, &unknownErr))
+	assert.Equal(t, []string{"items[1].color", "buyer.vip", "coupon"}, unknownErr.Paths)
+
+	data, err = bson.Marshal(bson.D{bson.E{Key: "id", Value: "1"}})
+	require.NoError(t, err)
+	require.NoError(t, strict.DynUnmarshalBSON(data, reflect.ValueOf(&out), &out.extras, ""))
+	assert.Equal(t, "1", out.ID)
+}
+
+func TestCollisionPolicy(t *testing.T) {
+	in := Order{ID: "1", extras: Extras{"id": "2", "coupon": "X"}}
+
+	// the extra fields win by default
+	for _, opts := range []Options{{}, {Collisions: ExtrasWin}} {
+		data, err := opts.DynMarshalJSON(reflect.ValueOf(in), in.extras, "")
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"id": "2", "items": null, "buyer": null, "Notes": null, "coupon": "X"}`, string(data))
+		assert.Regexp(t, `^\{"id":"2",.*"coupon":"X"\}$`, string(data))
+
+		data, err = opts.DynMarshalBSON(reflect.ValueOf(in), in.extras, "")
+		require.NoError(t, err)
+		assert.Equal(t, "2", bson.Raw(data).Lookup("id").StringValue())
+		elements, err := bson.Raw(data).Elements()
+		require.NoError(t, err)
+		assert.Len(t, elements, 5)
+	}
+
+	data, err := Options{Collisions: StructWins}.DynMarshalJSON(reflect.ValueOf(in), in.extras, "")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id": "1", "items": null, "buyer": null, "Notes": null, "coupon": "X"}`, string(data))
+
+	data, err = Options{Collisions: StructWins}.DynMarshalBSON(reflect.ValueOf(in), in.extras, "")
+	require.NoError(t, err)
+	assert.Equal(t, "1", bson.Raw(data).Lookup("id").StringValue())
+	elements, err := bson.Raw(data).Elements()
+	require.NoError(t, err)
+	assert.Len(t, elements, 5)
+
+	_, err = Options{Collisions: CollisionError}.DynMarshalJSON(reflect.ValueOf(in), in.extras, "")
+	assert.EqualError(t, err, "The extra field id has the same name of a field of the struct godynstruct.Order")
+	_, err = Options{Collisions: CollisionError}.DynMarshalBSON(reflect.ValueOf(in), in.extras, "")
+	assert.EqualError(t, err, "The extra field id has the same name of a field of the struct godynstruct.Order")
+
+	// without collisions every policy gives the same result
+	in.extras = Extras{"coupon": "X"}
+	data, err = Options{Collisions: CollisionError}.DynMarshalJSON(reflect.ValueOf(in), in.extras, "")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id": "1", "items": null, "buyer": null, "Notes": null, "coupon": "X"}`, string(data))
+
+	_, err = Options{Collisions: CollisionPolicy(42)}.DynMarshalJSON(reflect.ValueOf(in), in.extras, "")
+	assert.EqualError(t, err, "Unknown collision policy 42")
+}
+
+func TestDynUnmarshalJSONMerge(t *testing.T) {
+	merge := Options{Merge: true}
+
+	var out Car
+	require.NoError(t, merge.DynUnmarshalJSON([]byte(`
+		{
+			"Model": "Panda",
+			"year": 2000,
+			"Driver": { "Name": "amreo", "age": 20, "address": { "city": "Rome" } },
+			"color": "red",
+			"engine": { "hp": 60, "fuel": "gas" }
+		}
+	`), reflect.ValueOf(&out), &out.extras, ""))
+	require.NoError(t, merge.DynUnmarshalJSON([]byte(`
+		{
+			"year": 2001,
+			"Driver": { "address": { "zip": "00100" } },
+			"engine": { "hp": 70 },
+			"wheels": 4
+		}
+	`), reflect.ValueOf(&out), &out.extras, ""))
+
+	assert.Equal(t, "Panda", out.Model)
+	assert.Equal(t, 2001, out.Year)
+	assert.Equal(t, "amreo", out.Driver.Value.Name)
+	assert.Equal(t, Extras{"age": 20.0, "address": map[string]interface{}{"city": "Rome", "zip": "00100"}}, out.Driver.Value.Extras)
+	assert.Equal(t, Extras{"color": "red", "engine": map[string]interface{}{"hp": 70.0, "fuel": "gas"}, "wheels": 4.0}, out.extras)
+
+	// without the option the extra fields are replaced
+	require.NoError(t, Options{}.DynUnmarshalJSON([]byte(`{"wheels": 3}`), reflect.ValueOf(&out), &out.extras, ""))
+	assert.Equal(t, Extras{"wheels": 3.0}, out.extras)
+	assert.Equal(t, "Panda", out.Model)
+
+	var event Event
+	require.NoError(t, merge.DynUnmarshalJSON([]byte(`{"name": "start", "b": 1, "a": { "x": 1, "y": 2 }}`), reflect.ValueOf(&event), &event.others, ""))
+	require.NoError(t, merge.DynUnmarshalJSON([]byte(`{"a": { "z": 3, "x": 4 }, "c": [1], "b": 2}`), reflect.ValueOf(&event), &event.others, ""))
+	assert.Equal(t, "start", event.Name)
+	assert.Equal(t, OrderedExtras{
+		{Key: "b", Value: 2.0},
+		{Key: "a", Value: OrderedExtras{{Key: "x", Value: 4.0}, {Key: "y", Value: 2.0}, {Key: "z", Value: 3.0}}},
+		{Key: "c", Value: []interface{}{1.0}},
+	}, event.others)
+}
+
+func TestDynUnmarshalBSONMerge(t *testing.T) {
+	merge := Options{Merge: true}
+
+	var out Car
+	data, err := bson.Marshal(bson.D{
+		bson.E{Key: "Model", Value: "Panda"},
+		bson.E{Key: "Driver", Value: bson.D{bson.E{Key: "Name", Value: "amreo"}, bson.E{Key: "address", Value: bson.D{bson.E{Key: "city", Value: "Rome"}}}}},
+		bson.E{Key: "engine", Value: bson.D{bson.E{Key: "hp", Value: 60}, bson.E{Key: "fuel", Value: "gas"}}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, merge.DynUnmarshalBSON(data, reflect.ValueOf(&out), &out.extras, ""))
+
+	data, err = bson.Marshal(bson.D{
+		bson.E{Key: "year", Value: 2001},
+		bson.E{Key: "Driver", Value: bson.D{bson.E{Key: "address", Value: bson.D{bson.E{Key: "zip", Value: "00100"}}}}},
+		bson.E{Key: "engine", Value: bson.D{bson.E{Key: "hp", Value: 70}}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, merge.DynUnmarshalBSON(data, reflect.ValueOf(&out), &out.extras, ""))
+
+	assert.Equal(t, "Panda", out.Model)
+	assert.Equal(t, 2001, out.Year)
+	assert.Equal(t, "amreo", out.Driver.Value.Name)
+	assert.Equal(t, Extras{"address": map[string]interface{}{"city": "Rome", "zip": "00100"}}, out.Driver.Value.Extras)
+	assert.Equal(t, Extras{"engine": map[string]interface{}{"hp": int32(70), "fuel": "gas"}}, out.extras)
+}
+
+func TestDynUnmarshalJSONUseNumber(t *testing.T) {
+	data := `{"Model":"Panda","year":2000,"Driver":{"Name":"amreo","id":9007199254740993},"id":12345678901234567890,"price":{"amount":10.10,"list":[1e3,-0.5]}}`
+
+	var out Car
+	require.NoError(t, Options{UseNumber: true}.DynUnmarshalJSON([]byte(data), reflect.ValueOf(&out), &out.extras, ""))
+	assert.Equal(t, 2000, out.Year)
+	assert.Equal(t, json.Number("12345678901234567890"), out.extras["id"])
+	assert.Equal(t, map[string]interface{}{"amount": json.Number("10.10"), "list": []interface{}{json.Number("1e3"), json.Number("-0.5")}}, out.extras["price"])
+	assert.Equal(t, Extras{"id": json.Number("9007199254740993")}, out.Driver.Value.Extras)
+
+	raw, err := DynMarshalJSON(reflect.ValueOf(out), out.extras, "")
+	require.NoError(t, err)
+	assert.Equal(t, data, string(raw))
+
+	var event Event
+	require.NoError(t, Options{UseNumber: true}.DynUnmarshalJSON([]byte(`{"name":"start","id":9007199254740993,"amount":{"value":0.10}}`), reflect.ValueOf(&event), &event.others, ""))
+	assert.Equal(t, OrderedExtras{
+		{Key: "id", Value: json.Number("9007199254740993")},
+		{Key: "amount", Value: OrderedExtras{{Key: "value", Value: json.Number("0.10")}}},
+	}, event.others)
+
+	raw, err = DynMarshalJSON(reflect.ValueOf(event), event.others, "")
+	require.NoError(t, err)
+	assert.Equal(t, `{"name":"start","source":"","id":9007199254740993,"amount":{"value":0.10}}`, string(raw))
+
+	// without the option the numbers are float64
+	require.NoError(t, Options{}.DynUnmarshalJSON([]byte(data), reflect.ValueOf(&out), &out.extras, ""))
+	assert.Equal(t, 12345678901234567890.0, out.extras["id"])
+}
+
+func TestDynUnmarshalJSONRawExtras(t *testing.T) {
+	raw := Options{RawExtras: true}
+	data := `{"Model":"Panda","year":2000,"Driver":{"Name":"amreo","age":20},"id":12345678901234567890,"tags":[ "a", "<b>" ],"price":{ "amount": 10.10 }}`
+
+	var out Car
+	require.NoError(t, raw.DynUnmarshalJSON([]byte(data), reflect.ValueOf(&out), &out.extras, ""))
+	assert.Equal(t, 2000, out.Year)
+	assert.Equal(t, Extras{
+		"id":    json.RawMessage(`12345678901234567890`),
+		"tags":  json.RawMessage(`[ "a", "<b>" ]`),
+		"price": json.RawMessage(`{ "amount": 10.10 }`),
+	}, out.extras)
+	assert.Equal(t, Extras{"age": json.RawMessage(`20`)}, out.Driver.Value.Extras)
+
+	var tags []string
+	require.NoError(t, out.extras.Decode("tags", &tags))
+	assert.Equal(t, []string{"a", "<b>"}, tags)
+
+	encoded, err := DynMarshalJSON(reflect.ValueOf(out), out.extras, "")
+	require.NoError(t, err)
+	assert.Equal(t, `{"Model":"Panda","year":2000,"Driver":{"Name":"amreo","age":20},"id":12345678901234567890,"price":{ "amount": 10.10 },"tags":[ "a", "<b>" ]}`, string(encoded))
+
+	var event Event
+	require.NoError(t, raw.DynUnmarshalJSON([]byte(`{"name":"start","b":{"x":1},"a":null}`), reflect.ValueOf(&event), &event.others, ""))
+	assert.Equal(t, OrderedExtras{{Key: "b", Value: json.RawMessage(`{"x":1}`)}, {Key: "a", Value: json.RawMessage(`null`)}}, event.others)
+}
+
+func TestDynUnmarshalBSONRawExtras(t *testing.T) {
+	raw := Options{RawExtras: true}
+	data, err := bson.Marshal(bson.D{
+		bson.E{Key: "Model", Value: "Panda"},
+		bson.E{Key: "id", Value: int64(1) << 60},
+		bson.E{Key: "price", Value: bson.D{bson.E{Key: "amount", Value: 10.1}}},
+	})
+	require.NoError(t, err)
+
+	var out Car
+	require.NoError(t, raw.DynUnmarshalBSON(data, reflect.ValueOf(&out), &out.extras, ""))
+	assert.Equal(t, "Panda", out.Model)
+	require.IsType(t, bson.RawValue{}, out.extras["id"])
+	assert.Equal(t, bson.TypeInt64, out.extras["id"].(bson.RawValue).Type)
+
+	// the values don't depend on data
+	for i := range data {
+		data[i] = 0
+	}
+
+	var id int64
+	require.NoError(t, out.extras.Decode("id", &id))
+	assert.Equal(t, int64(1)<<60, id)
+	var price map[string]float64
+	require.NoError(t, out.extras.Decode("price", &price))
+	assert.Equal(t, map[string]float64{"amount": 10.1}, price)
+
+	encoded, err := DynMarshalBSON(reflect.ValueOf(out), out.extras, "")
+	require.NoError(t, err)
+	assert.Equal(t, bson.TypeInt64, bson.Raw(encoded).Lookup("id").Type)
+	assert.Equal(t, 10.1, bson.Raw(encoded).Lookup("price", "amount").Double())
+}
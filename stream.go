@@ -0,0 +1,235 @@
+// go-dyn-struct
+// Copyright (C) 2020  Andrea Laisa
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+// © 2020 GitHub, Inc.
+
+package godynstruct
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// RecordError is the error returned by the stream readers and writers when a record can't be read or written
+type RecordError struct {
+	// Index is the index of the record in the stream, starting from 0
+	Index int
+	Err   error
+}
+
+func (e *RecordError) Error() string {
+	return "record " + strconv.Itoa(e.Index) + ": " + e.Err.Error()
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// JSONReader reads the dynamic structs from a stream of newline-delimited JSON objects (JSON Lines)
+// The empty lines are skipped
+type JSONReader struct {
+	r       *bufio.Reader
+	options Options
+	// index is the index of the next record
+	index int
+}
+
+// NewJSONReader return a JSONReader that reads from r
+func NewJSONReader(r io.Reader) *JSONReader {
+	return Options{}.NewJSONReader(r)
+}
+
+// NewJSONReader is like the function NewJSONReader, but the reader uses the options o
+func (o Options) NewJSONReader(r io.Reader) *JSONReader {
+	return &JSONReader{r: bufio.NewReader(r), options: o}
+}
+
+// Read reads the next record and store it into ptrStruct like DynUnmarshalJSON. It returns io.EOF if there are no more records
+// If the record can't be read or decoded, the error is a *RecordError, and the following records can still be read
+// ptrStruct contains a reflect.Value pointer to the struct
+// extraFieldsPtr is the pointer to the extra fields, it can be a *map[string]interface{}, *Extras or *OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func (r *JSONReader) Read(ptrStruct reflect.Value, extraFieldsPtr interface{}, extraFieldsName string) error {
+	for {
+		line, err := r.r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return &RecordError{Index: r.index, Err: err}
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			if err == io.EOF {
+				return io.EOF
+			}
+			continue
+		}
+
+		index := r.index
+		r.index++
+		err = r.options.DynUnmarshalJSON(line, ptrStruct, extraFieldsPtr, extraFieldsName)
+		if err != nil {
+			return &RecordError{Index: index, Err: err}
+		}
+
+		return nil
+	}
+}
+
+// JSONWriter writes the dynamic structs as a stream of newline-delimited JSON objects (JSON Lines)
+type JSONWriter struct {
+	w       io.Writer
+	options Options
+	// index is the index of the next record
+	index int
+}
+
+// NewJSONWriter return a JSONWriter that writes to w
+func NewJSONWriter(w io.Writer) *JSONWriter {
+	return Options{}.NewJSONWriter(w)
+}
+
+// NewJSONWriter is like the function NewJSONWriter, but the writer uses the options o
+func (o Options) NewJSONWriter(w io.Writer) *JSONWriter {
+	return &JSONWriter{w: w, options: o}
+}
+
+// Write writes the dynamic struct _struct encoded like DynMarshalJSON as the next record, followed by a newline
+// The record is written with a single write, if it can't be encoded nothing is written and the error is a *RecordError
+// _struct contains the reflect.Value of the struct
+// extraFields contains the extra fields, it can be a map[string]interface{}, Extras or OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func (w *JSONWriter) Write(_struct reflect.Value, extraFields interface{}, extraFieldsName string) error {
+	index := w.index
+	w.index++
+
+	data, err := w.options.DynMarshalJSON(_struct, extraFields, extraFieldsName)
+	if err != nil {
+		return &RecordError{Index: index, Err: err}
+	}
+
+	_, err = w.w.Write(append(data, '\n'))
+	if err != nil {
+		return &RecordError{Index: index, Err: err}
+	}
+
+	return nil
+}
+
+// maxBSONDocumentSize is the maximum size of a BSON document accepted by MongoDB
+const maxBSONDocumentSize = 16 * 1024 * 1024
+
+// BSONReader reads the dynamic structs from a stream of BSON documents, like the files written by mongodump
+// The documents larger than 16 MiB, the maximum size accepted by MongoDB, are rejected
+type BSONReader struct {
+	r       io.Reader
+	options Options
+	// index is the index of the next record
+	index int
+}
+
+// NewBSONReader return a BSONReader that reads from r
+func NewBSONReader(r io.Reader) *BSONReader {
+	return Options{}.NewBSONReader(r)
+}
+
+// NewBSONReader is like the function NewBSONReader, but the reader uses the options o
+func (o Options) NewBSONReader(r io.Reader) *BSONReader {
+	return &BSONReader{r: r, options: o}
+}
+
+// Read reads the next document and store it into ptrStruct like DynUnmarshalBSON. It returns io.EOF if there are no more documents
+// If the document can't be read or decoded the error is a *RecordError. The following documents can still be read
+// if the document has been read but it can't be decoded
+// ptrStruct contains a reflect.Value pointer to the struct
+// extraFieldsPtr is the pointer to the extra fields, it can be a *map[string]interface{}, *Extras or *OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func (r *BSONReader) Read(ptrStruct reflect.Value, extraFieldsPtr interface{}, extraFieldsName string) error {
+	index := r.index
+
+	// read the length of the document, that includes the length itself
+	var header [4]byte
+	_, err := io.ReadFull(r.r, header[:])
+	if err == io.EOF {
+		return io.EOF
+	}
+	if err != nil {
+		return &RecordError{Index: index, Err: err}
+	}
+
+	length := int32(binary.LittleEndian.Uint32(header[:]))
+	if length < 5 || length > maxBSONDocumentSize {
+		return &RecordError{Index: index, Err: errors.New("Invalid length " + strconv.Itoa(int(length)) + " of the BSON document")}
+	}
+
+	// the document is read in chunks, so a truncated stream doesn't allocate the whole length
+	var buf bytes.Buffer
+	buf.Write(header[:])
+	_, err = io.CopyN(&buf, r.r, int64(length)-4)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return &RecordError{Index: index, Err: err}
+	}
+	data := buf.Bytes()
+
+	r.index++
+	err = r.options.DynUnmarshalBSON(data, ptrStruct, extraFieldsPtr, extraFieldsName)
+	if err != nil {
+		return &RecordError{Index: index, Err: err}
+	}
+
+	return nil
+}
+
+// BSONWriter writes the dynamic structs as a stream of BSON documents, like the files written by mongodump
+type BSONWriter struct {
+	w       io.Writer
+	options Options
+	// index is the index of the next record
+	index int
+}
+
+// NewBSONWriter return a BSONWriter that writes to w
+func NewBSONWriter(w io.Writer) *BSONWriter {
+	return Options{}.NewBSONWriter(w)
+}
+
+// NewBSONWriter is like the function NewBSONWriter, but the writer uses the options o
+func (o Options) NewBSONWriter(w io.Writer) *BSONWriter {
+	return &BSONWriter{w: w, options: o}
+}
+
+// Write writes the dynamic struct _struct encoded like DynMarshalBSON as the next document
+// The document is written with a single write, if it can't be encoded nothing is written and the error is a *RecordError
+// _struct contains the reflect.Value of the struct
+// extraFields contains the extra fields, it can be a map[string]interface{}, Extras or OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func (w *BSONWriter) Write(_struct reflect.Value, extraFields interface{}, extraFieldsName string) error {
+	index := w.index
+	w.index++
+
+	err := w.options.DynEncodeBSON(w.w, _struct, extraFields, extraFieldsName)
+	if err != nil {
+		return &RecordError{Index: index, Err: err}
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+// go-dyn-struct
+// Copyright (C) 2020  Andrea Laisa
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+// © 2020 GitHub, Inc.
+
+package godynstruct
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var streamCars = []Car{
+	{
+		Model:  "Panda",
+		Year:   2000,
+		Driver: &Dyn[Driver]{Value: Driver{Name: "amreo", Extras: Extras{"age": 20.0}}},
+		extras: Extras{"color": "red"},
+	},
+	{
+		Model:  "Punto",
+		Year:   2010,
+		extras: Extras{"engine": map[string]interface{}{"hp": 60.0}},
+	},
+}
+
+func TestJSONStream(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewJSONWriter(&buf)
+	for _, c := range streamCars {
+		require.NoError(t, w.Write(reflect.ValueOf(c), c.extras, ""))
+	}
+	assert.Equal(t, 2, strings.Count(buf.String(), "\n"))
+
+	r := NewJSONReader(&buf)
+	for _, expected := range streamCars {
+		var out Car
+		require.NoError(t, r.Read(reflect.ValueOf(&out), &out.extras, ""))
+		assert.Equal(t, expected, out)
+	}
+	var out Car
+	assert.Equal(t, io.EOF, r.Read(reflect.ValueOf(&out), &out.extras, ""))
+}
+
+func TestJSONReaderErrors(t *testing.T) {
+	data := `{"Model": "Panda"}
+
+{"Model": 42}
+  {"Model": "Punto", "color": "red"}
+{"Model": "Tipo"`
+
+	r := Options{DisallowUnknownFields: true}.NewJSONReader(strings.NewReader(data))
+
+	var out Car
+	require.NoError(t, r.Read(reflect.ValueOf(&out), &out.extras, ""))
+	assert.Equal(t, "Panda", out.Model)
+
+	// the empty lines aren't records
+	err := r.Read(reflect.ValueOf(&out), &out.extras, "")
+	var recordErr *RecordError
+	require.True(t, errors.As(err, &recordErr))
+	assert.Equal(t, 1, recordErr.Index)
+	assert.Contains(t, err.Error(), "record 1: json: cannot unmarshal number")
+
+	// the reader goes on after an error
+	err = r.Read(reflect.ValueOf(&out), &out.extras, "")
+	require.True(t, errors.As(err, &recordErr))
+	assert.Equal(t, 2, recordErr.Index)
+	var unknownErr *UnknownFieldsError
+	require.True(t, errors.As(err, &unknownErr))
+	assert.Equal(t, []string{"color"}, unknownErr.Paths)
+
+	err = r.Read(reflect.ValueOf(&out), &out.extras, "")
+	require.True(t, errors.As(err, &recordErr))
+	assert.Equal(t, 3, recordErr.Index)
+
+	assert.Equal(t, io.EOF, r.Read(reflect.ValueOf(&out), &out.extras, ""))
+}
+
+func TestJSONWriterErrors(t *testing.T) {
+	var buf bytes.Buffer
+	w := Options{Collisions: CollisionError}.NewJSONWriter(&buf)
+	require.NoError(t, w.Write(reflect.ValueOf(streamCars[0]), streamCars[0].extras, ""))
+
+	err := w.Write(reflect.ValueOf(Car{}), Extras{"Model": "Tipo"}, "")
+	var recordErr *RecordError
+	require.True(t, errors.As(err, &recordErr))
+	assert.Equal(t, 1, recordErr.Index)
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+
+	err = NewJSONWriter(failingWriter{}).Write(reflect.ValueOf(Car{}), nil, "")
+	require.True(t, errors.As(err, &recordErr))
+	assert.Equal(t, 0, recordErr.Index)
+}
+
+func TestBSONStream(t *testing.T) {
+	cars := []Car{
+		{Model: "Panda", Year: 2000, extras: Extras{"color": "red"}},
+		{Model: "Punto", Year: 2010, Driver: &Dyn[Driver]{Value: Driver{Name: "amreo", Extras: Extras{}}}, extras: Extras{}},
+	}
+
+	var buf bytes.Buffer
+	w := NewBSONWriter(&buf)
+	for _, c := range cars {
+		require.NoError(t, w.Write(reflect.ValueOf(c), c.extras, ""))
+	}
+	data := buf.Bytes()
+
+	r := NewBSONReader(bytes.NewReader(data))
+	for _, expected := range cars {
+		var out Car
+		require.NoError(t, r.Read(reflect.ValueOf(&out), &out.extras, ""))
+		assert.Equal(t, expected, out)
+	}
+	var out Car
+	assert.Equal(t, io.EOF, r.Read(reflect.ValueOf(&out), &out.extras, ""))
+
+	// truncated stream
+	r = NewBSONReader(bytes.NewReader(data[:len(data)-2]))
+	require.NoError(t, r.Read(reflect.ValueOf(&out), &out.extras, ""))
+	err := r.Read(reflect.ValueOf(&out), &out.extras, "")
+	var recordErr *RecordError
+	require.True(t, errors.As(err, &recordErr))
+	assert.Equal(t, 1, recordErr.Index)
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+
+	r = NewBSONReader(bytes.NewReader([]byte{1, 0, 0, 0, 0}))
+	assert.EqualError(t, r.Read(reflect.ValueOf(&out), &out.extras, ""), "record 0: Invalid length 1 of the BSON document")
+
+	// the length is checked before reading the document
+	r = NewBSONReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0x7f, 1, 2, 3}))
+	assert.EqualError(t, r.Read(reflect.ValueOf(&out), &out.extras, ""), "record 0: Invalid length 2147483647 of the BSON document")
+	r = NewBSONReader(bytes.NewReader([]byte{0x00, 0x00, 0x00, 0x01, 1, 2, 3}))
+	err = r.Read(reflect.ValueOf(&out), &out.extras, "")
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+
+	err = NewBSONWriter(failingWriter{}).Write(reflect.ValueOf(Car{}), nil, "")
+	require.True(t, errors.As(err, &recordErr))
+}
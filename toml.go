@@ -0,0 +1,611 @@
+// go-dyn-struct
+// Copyright (C) 2020  Andrea Laisa
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+// © 2020 GitHub, Inc.
+
+package godynstruct
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// DynMarshalTOML return the TOML encoding of the dynamic struct _struct
+// The fields of the struct are encoded in declaration order, followed by the extra fields sorted by key, or in their order if they are OrderedExtras,
+// except the tables, that are encoded after the other values as TOML requires
+// The nested dynamic structs and the objects in the extra fields are encoded as tables
+// If an extra field has the same name of a field of the struct, the value of the extra field is used in place of the field
+// _struct contains the reflect.Value of the struct
+// extraFields contains the extra fields, it can be a map[string]interface{}, Extras or OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func DynMarshalTOML(_struct reflect.Value, extraFields interface{}, extraFieldsName string) ([]byte, error) {
+	return Options{}.DynMarshalTOML(_struct, extraFields, extraFieldsName)
+}
+
+// DynMarshalTOML is like the function DynMarshalTOML, but it uses the options o
+func (o Options) DynMarshalTOML(_struct reflect.Value, extraFields interface{}, extraFieldsName string) ([]byte, error) {
+	table, err := o.encodeTOMLStruct(_struct, extraFields, extraFieldsName)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	writeTOMLTable(&buf, nil, table)
+	return buf.Bytes(), nil
+}
+
+// encodeTOMLStruct return the dynamic struct _struct as a table converted by tomlTable
+func (o Options) encodeTOMLStruct(_struct reflect.Value, extraFields interface{}, extraFieldsName string) (OrderedExtras, error) {
+	members, err := o.dynMembers(_struct, extraFields, extraFieldsName, "toml")
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := make(OrderedExtras, len(members))
+	for i, m := range members {
+		pairs[i] = ExtraField{Key: m.key, Value: m.value}
+	}
+
+	return o.tomlTable(pairs)
+}
+
+// tomlLeaf is the TOML encoding of a value that isn't a table or an array of tables
+type tomlLeaf string
+
+// tomlTable return the pairs with their values converted by tomlValue, without the values that aren't encoded
+func (o Options) tomlTable(pairs OrderedExtras) (OrderedExtras, error) {
+	out := make(OrderedExtras, 0, len(pairs))
+	for _, f := range pairs {
+		v, ok, err := o.tomlValue(f.Value)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out = append(out, ExtraField{Key: f.Key, Value: v})
+		}
+	}
+
+	return out, nil
+}
+
+// tomlValue return v ready to be written by writeTOMLTable: the tables, including the dynamic structs, as OrderedExtras,
+// the arrays of tables as []OrderedExtras and the other values as tomlLeaf
+// ok is false if v isn't encoded, like nil
+// The dynamic structs are found only inside the interfaces, pointers, slices, arrays and maps, not inside the other structs
+func (o Options) tomlValue(v interface{}) (out interface{}, ok bool, err error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, false, nil
+	case OrderedExtras:
+		out, err = o.tomlTable(v)
+		return out, err == nil, err
+	case Extras:
+		return o.tomlValue(map[string]interface{}(v))
+	case map[string]interface{}:
+		pairs := make(OrderedExtras, 0, len(v))
+		for _, k := range sortedKeys(v) {
+			pairs = append(pairs, ExtraField{Key: k, Value: v[k]})
+		}
+		return o.tomlValue(pairs)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Struct:
+		if rv.Type().Implements(dynWrapperType) && (rv.Kind() != reflect.Ptr || !rv.IsNil()) {
+			ptrStruct, err := dynStruct(v)
+			if err != nil {
+				return nil, false, err
+			}
+			extraFields, name, err := extrasField(ptrStruct.Elem(), "toml")
+			if err != nil {
+				return nil, false, err
+			}
+			out, err = o.encodeTOMLStruct(ptrStruct, extraFields.Interface(), name)
+			return out, err == nil, err
+		}
+	case reflect.Slice, reflect.Array:
+		if mayContainDyn(rv.Type().Elem()) && (rv.Kind() != reflect.Slice || !rv.IsNil()) {
+			return o.tomlArray(rv)
+		}
+	case reflect.Map:
+		if mayContainDyn(rv.Type().Elem()) && rv.Type().Key().Kind() == reflect.String && !rv.IsNil() {
+			m := make(map[string]interface{}, rv.Len())
+			iter := rv.MapRange()
+			for iter.Next() {
+				m[iter.Key().String()] = iter.Value().Interface()
+			}
+			return o.tomlValue(m)
+		}
+	}
+
+	return o.encodeTOMLValue(v)
+}
+
+// tomlArray return the array rv converted like tomlValue, as []OrderedExtras if all its values are tables, otherwise as an inline array
+func (o Options) tomlArray(rv reflect.Value) (interface{}, bool, error) {
+	values := make([]interface{}, rv.Len())
+	tables := len(values) > 0
+	for i := range values {
+		v, ok, err := o.tomlValue(rv.Index(i).Interface())
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			return nil, false, errors.New("The array contains a nil value, that can't be encoded in TOML")
+		}
+		_, isTable := v.(OrderedExtras)
+		tables = tables && isTable
+		values[i] = v
+	}
+
+	if tables {
+		out := make([]OrderedExtras, len(values))
+		for i, v := range values {
+			out[i] = v.(OrderedExtras)
+		}
+		return out, true, nil
+	}
+
+	return tomlLeaf(inlineTOML(values)), true, nil
+}
+
+// encodeTOMLValue return the encoding of v by the toml package as a tomlLeaf or, if v is encoded as a table or an array of tables,
+// v decoded again as OrderedExtras or []OrderedExtras, so it's written with the keys in the same order
+func (o Options) encodeTOMLValue(v interface{}) (interface{}, bool, error) {
+	data, err := toml.Marshal(map[string]interface{}{"v": v})
+	if err != nil {
+		return nil, false, err
+	}
+	if len(data) == 0 {
+		// the toml package doesn't encode the nil values
+		return nil, false, nil
+	}
+
+	if bytes.HasPrefix(data, []byte("v = ")) {
+		return tomlLeaf(bytes.TrimSuffix(data[len("v = "):], []byte("\n"))), true, nil
+	}
+
+	var table map[string]interface{}
+	md, err := toml.Decode(string(data), &table)
+	if err != nil {
+		return nil, false, err
+	}
+	return o.tomlValue(orderedFromTOML(&md, toml.Key{"v"}, table["v"]))
+}
+
+// writeTOMLTable writes to buf the pairs of the table at path, converted by tomlTable, indented like the toml package does
+// The values are written before the tables and the arrays of tables, as TOML requires
+func writeTOMLTable(buf *bytes.Buffer, path []string, pairs OrderedExtras) {
+	indent := strings.Repeat("  ", len(path))
+	for _, f := range pairs {
+		if leaf, ok := f.Value.(tomlLeaf); ok {
+			buf.WriteString(indent + tomlKey(f.Key) + " = " + string(leaf) + "\n")
+		}
+	}
+
+	for _, f := range pairs {
+		keyPath := append(path[:len(path):len(path)], f.Key)
+		switch v := f.Value.(type) {
+		case OrderedExtras:
+			writeTOMLHeader(buf, keyPath, "[", "]")
+			writeTOMLTable(buf, keyPath, v)
+		case []OrderedExtras:
+			for _, table := range v {
+				writeTOMLHeader(buf, keyPath, "[[", "]]")
+				writeTOMLTable(buf, keyPath, table)
+			}
+		}
+	}
+}
+
+// writeTOMLHeader writes to buf the header of the table at path, enclosed by open and close
+func writeTOMLHeader(buf *bytes.Buffer, path []string, open string, close string) {
+	if (len(path) == 1 || open == "[[") && buf.Len() > 0 {
+		// like the toml package, the top level tables and the arrays of tables are separated by an empty line
+		buf.WriteString("\n")
+	}
+
+	keys := make([]string, len(path))
+	for i, k := range path {
+		keys[i] = tomlKey(k)
+	}
+	buf.WriteString(strings.Repeat("  ", len(path)-1) + open + strings.Join(keys, ".") + close + "\n")
+}
+
+// inlineTOML return the values converted by tomlValue as an inline array, with the tables as inline tables
+func inlineTOML(values []interface{}) string {
+	items := make([]string, len(values))
+	for i, v := range values {
+		items[i] = inlineTOMLValue(v)
+	}
+
+	return "[" + strings.Join(items, ", ") + "]"
+}
+
+// inlineTOMLValue return the value v converted by tomlValue as an inline value
+func inlineTOMLValue(v interface{}) string {
+	switch v := v.(type) {
+	case OrderedExtras:
+		pairs := make([]string, len(v))
+		for i, f := range v {
+			pairs[i] = tomlKey(f.Key) + " = " + inlineTOMLValue(f.Value)
+		}
+		return "{" + strings.Join(pairs, ", ") + "}"
+	case []OrderedExtras:
+		tables := make([]interface{}, len(v))
+		for i, t := range v {
+			tables[i] = t
+		}
+		return inlineTOML(tables)
+	}
+
+	return string(v.(tomlLeaf))
+}
+
+// tomlKey return the key k, quoted if it isn't a bare key
+func tomlKey(k string) string {
+	bare := k != ""
+	for _, r := range k {
+		if !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			bare = false
+			break
+		}
+	}
+	if bare {
+		return k
+	}
+
+	var buf strings.Builder
+	buf.WriteByte('"')
+	for _, r := range k {
+		switch {
+		case r == '"' || r == '\\':
+			buf.WriteString("\\" + string(r))
+		case r == '\b':
+			buf.WriteString(`\b`)
+		case r == '\t':
+			buf.WriteString(`\t`)
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r == '\f':
+			buf.WriteString(`\f`)
+		case r == '\r':
+			buf.WriteString(`\r`)
+		case r < 0x20 || r == 0x7f:
+			buf.WriteString(fmt.Sprintf(`\u%04X`, r))
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	buf.WriteByte('"')
+
+	return buf.String()
+}
+
+// mayContainDyn return true if the values of type typ can contain a dynamic struct or OrderedExtras, that must be converted by tomlValue
+func mayContainDyn(typ reflect.Type) bool {
+	if typ == orderedExtrasType || typ.Implements(dynWrapperType) {
+		return true
+	}
+
+	switch typ.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return mayContainDyn(typ.Elem())
+	default:
+		return false
+	}
+}
+
+// ToTOML return the TOML encoding of the dynamic struct v, that can be a struct, a Dyn or a pointer to one of them
+// The extra fields are the ones in the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func ToTOML(v interface{}) ([]byte, error) {
+	return Options{}.ToTOML(v)
+}
+
+// ToTOML is like the function ToTOML, but it uses the options o
+func (o Options) ToTOML(v interface{}) ([]byte, error) {
+	ptrStruct, err := dynStruct(v)
+	if err != nil {
+		return nil, err
+	}
+
+	extraFields, name, err := extrasField(ptrStruct.Elem(), "toml")
+	if err != nil {
+		return nil, err
+	}
+
+	return o.DynMarshalTOML(ptrStruct, extraFields.Interface(), name)
+}
+
+// DynUnmarshalTOML parses the TOML encoded data and store the result into the dynamic struct pointed by ptrStruct
+// The keys that aren't part of the struct, including the tables, are set inside the extras, in order if they are OrderedExtras
+// The option RawExtras is ignored, because the TOML values can't be decoded without the rest of the document
+// data is the TOML encoded data
+// ptrStruct contains the reflect.Value of the pointer to the struct
+// extraFieldsPtr is the pointer to the extra fields, it can be a *map[string]interface{}, *Extras or *OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func DynUnmarshalTOML(data []byte, ptrStruct reflect.Value, extraFieldsPtr interface{}, extraFieldsName string) error {
+	return Options{}.DynUnmarshalTOML(data, ptrStruct, extraFieldsPtr, extraFieldsName)
+}
+
+// DynUnmarshalTOML is like the function DynUnmarshalTOML, but it uses the options o
+func (o Options) DynUnmarshalTOML(data []byte, ptrStruct reflect.Value, extraFieldsPtr interface{}, extraFieldsName string) error {
+	dest, err := newDynDest(ptrStruct, extraFieldsPtr, extraFieldsName, "toml", o.Merge)
+	if err != nil {
+		return err
+	}
+
+	var table map[string]toml.Primitive
+	md, err := toml.Decode(string(data), &table)
+	if err != nil {
+		return err
+	}
+
+	return o.decodeTOMLStruct(&md, nil, table, dest)
+}
+
+// decodeTOMLStruct stores the TOML table at path, whose values are still undecoded, into the dynamic struct dest
+func (o Options) decodeTOMLStruct(md *toml.MetaData, path toml.Key, table map[string]toml.Primitive, dest *dynDest) error {
+	keys := tomlKeys(md, path, table)
+
+	if o.DisallowUnknownFields {
+		paths, err := unknownTOMLStructFields(md, keys, table, dest.fields, dest.extraFieldsName, "", nil)
+		if err != nil {
+			return err
+		}
+		if len(paths) > 0 {
+			return &UnknownFieldsError{Paths: paths}
+		}
+	}
+
+	// for each key/value pair, in the order of the document, set it to a field of struct or to extras
+	for _, k := range keys {
+		v := table[k]
+		keyPath := append(path[:len(path):len(path)], k)
+
+		if field, ok := dest.field(k); ok {
+			// the field k is part of the struct, so the value will be set inside
+			fieldValue, err := dest.fieldValue(field)
+			if err != nil {
+				return err
+			}
+
+			if d, ok := nestedDyn(fieldValue, md.Type(keyPath...) == "Hash"); ok {
+				// the nested dynamic struct is unmarshalled with the same options
+				var nested map[string]toml.Primitive
+				err = md.PrimitiveDecode(v, &nested)
+				if err == nil {
+					err = d.unmarshalTOML(md, keyPath, nested, o)
+				}
+			} else {
+				err = md.PrimitiveDecode(v, fieldValue.Addr().Interface())
+			}
+			if err != nil {
+				return err
+			}
+		} else {
+			// the field k is not part of the struct, so the value is decoded into extras
+			var out interface{}
+			err := md.PrimitiveDecode(v, &out)
+			if err != nil {
+				return err
+			}
+			if dest.extras.isOrdered() {
+				out = orderedFromTOML(md, keyPath, out)
+			}
+			dest.extras.set(k, out)
+		}
+	}
+
+	return nil
+}
+
+// FromTOML parses the TOML encoded data and store the result into the dynamic struct pointed by v, that can be a pointer to a struct or to a Dyn
+// The keys that aren't part of the struct are set inside the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func FromTOML(data []byte, v interface{}) error {
+	return Options{}.FromTOML(data, v)
+}
+
+// FromTOML is like the function FromTOML, but it uses the options o
+func (o Options) FromTOML(data []byte, v interface{}) error {
+	ptrStruct, err := dynStructPtr(v)
+	if err != nil {
+		return err
+	}
+
+	extraFields, name, err := extrasField(ptrStruct.Elem(), "toml")
+	if err != nil {
+		return err
+	}
+
+	return o.DynUnmarshalTOML(data, ptrStruct, extraFields.Addr().Interface(), name)
+}
+
+// tomlKeys return the keys of the table at path in the order they appear in the document
+func tomlKeys[V any](md *toml.MetaData, path toml.Key, table map[string]V) []string {
+	out := make([]string, 0, len(table))
+	found := make(map[string]bool, len(table))
+	for _, key := range md.Keys() {
+		if len(key) != len(path)+1 || !tomlKeyHasPrefix(key, path) {
+			continue
+		}
+
+		k := key[len(path)]
+		if _, ok := table[k]; ok && !found[k] {
+			found[k] = true
+			out = append(out, k)
+		}
+	}
+
+	// the keys not found in the document, like the ones of the tables in an array, are added sorted
+	rest := make([]string, 0, len(table)-len(out))
+	for k := range table {
+		if !found[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+
+	return append(out, rest...)
+}
+
+// tomlKeyHasPrefix return true if key starts with prefix
+func tomlKeyHasPrefix(key toml.Key, prefix toml.Key) bool {
+	for i := range prefix {
+		if key[i] != prefix[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// orderedFromTOML return v, the decoded value at path, with the tables nested inside converted to OrderedExtras in the order of the document
+func orderedFromTOML(md *toml.MetaData, path toml.Key, v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := tomlKeys(md, path, v)
+		out := make(OrderedExtras, len(keys))
+		for i, k := range keys {
+			out[i] = ExtraField{Key: k, Value: orderedFromTOML(md, append(path[:len(path):len(path)], k), v[k])}
+		}
+		return out
+	case []map[string]interface{}:
+		out := make([]interface{}, len(v))
+		for i := range v {
+			out[i] = orderedFromTOML(md, path, v[i])
+		}
+		return out
+	case []interface{}:
+		for i := range v {
+			v[i] = orderedFromTOML(md, path, v[i])
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// unknownTOMLStructFields appends to paths the path of each key of the table that isn't a field of the struct, also inside the values of the fields
+func unknownTOMLStructFields(md *toml.MetaData, keys []string, table map[string]toml.Primitive, fields *typeFields, extraFieldsName string, path string, paths []string) ([]string, error) {
+	for _, k := range keys {
+		field, ok := fields.fieldByName(k, extraFieldsName)
+		if !ok {
+			paths = append(paths, joinPath(path, k))
+			continue
+		}
+
+		var v interface{}
+		err := md.PrimitiveDecode(table[k], &v)
+		if err != nil {
+			return nil, err
+		}
+
+		fieldType := fields.typ.FieldByIndex(field.index).Type
+		paths, err = unknownTOMLFields(v, fieldType, joinPath(path, k), paths)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return paths, nil
+}
+
+// unknownTOMLFields appends to paths the path of each key of the decoded TOML value v that isn't part of the type typ
+// The values that don't match typ are ignored, because they are reported by the unmarshalling
+func unknownTOMLFields(v interface{}, typ reflect.Type, path string, paths []string) ([]string, error) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	if typ.Kind() != reflect.Struct && (typ.Implements(tomlUnmarshalerType) || reflect.PtrTo(typ).Implements(tomlUnmarshalerType)) {
+		return paths, nil
+	}
+
+	var err error
+	switch typ.Kind() {
+	case reflect.Slice, reflect.Array:
+		rv := reflect.ValueOf(v)
+		if rv.Kind() != reflect.Slice {
+			return paths, nil
+		}
+
+		for i := 0; i < rv.Len(); i++ {
+			paths, err = unknownTOMLFields(rv.Index(i).Interface(), typ.Elem(), indexPath(path, i), paths)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case reflect.Map:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return paths, nil
+		}
+
+		for _, k := range sortedKeys(m) {
+			paths, err = unknownTOMLFields(m[k], typ.Elem(), joinPath(path, k), paths)
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		fields, extraFieldsName, ok, err := nestedStructFields(typ, "toml", tomlUnmarshalerType)
+		if err != nil || !ok {
+			return paths, err
+		}
+
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return paths, nil
+		}
+
+		for _, k := range sortedKeys(m) {
+			field, ok := fields.fieldByName(k, extraFieldsName)
+			if !ok {
+				paths = append(paths, joinPath(path, k))
+				continue
+			}
+
+			paths, err = unknownTOMLFields(m[k], fields.typ.FieldByIndex(field.index).Type, joinPath(path, k), paths)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return paths, nil
+}
+
+// sortedKeys return the keys of m sorted
+func sortedKeys(m map[string]interface{}) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+
+	return out
+}
+
+var tomlUnmarshalerType = reflect.TypeOf((*toml.Unmarshaler)(nil)).Elem()
@@ -0,0 +1,186 @@
+// go-dyn-struct
+// Copyright (C) 2020  Andrea Laisa
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+// © 2020 GitHub, Inc.
+
+package godynstruct
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type Service struct {
+	Name     string            `toml:"name"`
+	Port     int               `toml:"port,omitempty"`
+	Secret   string            `toml:"-"`
+	Database *Dyn[Database]    `toml:"database"`
+	Replicas []Dyn[Database]   `toml:"replicas"`
+	Labels   map[string]string `toml:"labels,omitempty"`
+	others   OrderedExtras
+}
+
+type Database struct {
+	Host   string `toml:"host"`
+	extras Extras
+}
+
+func TestDynMarshalTOML(t *testing.T) {
+	s := Service{
+		Name:   "api",
+		Secret: "secret",
+		Database: &Dyn[Database]{
+			Value: Database{Host: "db1", extras: Extras{"pool": 10}},
+		},
+		Replicas: []Dyn[Database]{{Value: Database{Host: "db2"}}},
+		others: OrderedExtras{
+			{"zeta", OrderedExtras{{"y", 1}, {"b", "x"}}},
+			{"alpha", "last"},
+			{"timeout", 1.5},
+		},
+	}
+
+	raw, err := DynMarshalTOML(reflect.ValueOf(s), s.others, "others")
+	require.NoError(t, err)
+	expected := `name = "api"
+alpha = "last"
+timeout = 1.5
+
+[database]
+  host = "db1"
+  pool = 10
+
+[[replicas]]
+  host = "db2"
+
+[zeta]
+  y = 1
+  b = "x"
+`
+	assert.Equal(t, expected, string(raw))
+}
+
+func TestDynTOMLQuotedKeys(t *testing.T) {
+	data := `name = "api"
+"a,b" = 1
+"" = 2
+- = 3
+"back\\slash" = 4
+"q\"uote" = 5
+"tick` + "`" + `" = 6
+"tab\t" = [{"x.y" = 1, z = [1, 2]}, 7]
+
+["dotted.table"]
+  "z w" = 1
+
+  [["dotted.table".list]]
+    a = 1
+
+  [["dotted.table".list]]
+    a = 2
+`
+
+	var s Service
+	require.NoError(t, DynUnmarshalTOML([]byte(data), reflect.ValueOf(&s), &s.others, "others"))
+	assert.Equal(t, OrderedExtras{
+		{"a,b", int64(1)},
+		{"", int64(2)},
+		{"-", int64(3)},
+		{"back\\slash", int64(4)},
+		{"q\"uote", int64(5)},
+		{"tick`", int64(6)},
+		{"tab\t", []interface{}{OrderedExtras{{"x.y", int64(1)}, {"z", []interface{}{int64(1), int64(2)}}}, int64(7)}},
+		{"dotted.table", OrderedExtras{
+			{"z w", int64(1)},
+			{"list", []interface{}{OrderedExtras{{"a", int64(1)}}, OrderedExtras{{"a", int64(2)}}}},
+		}},
+	}, s.others)
+
+	// the keys are quoted when they aren't bare keys, so they are decoded again in the same way
+	raw, err := DynMarshalTOML(reflect.ValueOf(s), s.others, "others")
+	require.NoError(t, err)
+	assert.Equal(t, data, string(raw))
+
+	_, err = DynMarshalTOML(reflect.ValueOf(s), OrderedExtras{{"list", []interface{}{1, nil}}}, "others")
+	assert.Error(t, err)
+}
+
+func TestDynUnmarshalTOML(t *testing.T) {
+	data := `
+name = "api"
+zeta = 3
+port = 8080
+alpha = "last"
+Secret = "visible"
+
+[database]
+host = "db1"
+pool = 10
+
+[[replicas]]
+host = "db2"
+
+[labels]
+env = "prod"
+
+[tls]
+cert = "a.pem"
+key = "a.key"
+`
+
+	var s Service
+	require.NoError(t, DynUnmarshalTOML([]byte(data), reflect.ValueOf(&s), &s.others, "others"))
+	assert.Equal(t, "api", s.Name)
+	assert.Equal(t, 8080, s.Port)
+	assert.Equal(t, "", s.Secret)
+	assert.Equal(t, Database{Host: "db1", extras: Extras{"pool": int64(10)}}, s.Database.Value)
+	assert.Equal(t, []Dyn[Database]{{Value: Database{Host: "db2", extras: Extras{}}}}, s.Replicas)
+	assert.Equal(t, map[string]string{"env": "prod"}, s.Labels)
+	assert.Equal(t, OrderedExtras{
+		{"zeta", int64(3)},
+		{"alpha", "last"},
+		{"Secret", "visible"},
+		{"tls", OrderedExtras{{"cert", "a.pem"}, {"key", "a.key"}}},
+	}, s.others)
+
+	// the unknown keys and tables are written back
+	raw, err := DynMarshalTOML(reflect.ValueOf(s), s.others, "others")
+	require.NoError(t, err)
+	var out Service
+	require.NoError(t, DynUnmarshalTOML(raw, reflect.ValueOf(&out), &out.others, "others"))
+	assert.Equal(t, s, out)
+
+	assert.Error(t, DynUnmarshalTOML([]byte("name = "), reflect.ValueOf(&s), &s.others, "others"))
+	assert.Error(t, DynUnmarshalTOML([]byte("name = 1"), reflect.ValueOf(&s), &s.others, "others"))
+}
+
+func TestDynTOMLOptions(t *testing.T) {
+	data := "name = \"api\"\nowner = \"amreo\"\n[database]\nhost = \"db1\"\npool = 10\n"
+
+	var s Service
+	err := Options{DisallowUnknownFields: true}.DynUnmarshalTOML([]byte(data), reflect.ValueOf(&s), &s.others, "others")
+	assert.Equal(t, &UnknownFieldsError{Paths: []string{"owner", "database.pool"}}, err)
+
+	s.others = OrderedExtras{{"owner", "amreo"}, {"tls", OrderedExtras{{"cert", "a.pem"}}}}
+	require.NoError(t, Options{Merge: true}.DynUnmarshalTOML([]byte("[tls]\nkey = \"a.key\"\n"), reflect.ValueOf(&s), &s.others, "others"))
+	assert.Equal(t, OrderedExtras{{"owner", "amreo"}, {"tls", OrderedExtras{{"cert", "a.pem"}, {"key", "a.key"}}}}, s.others)
+
+	raw, err := Options{Collisions: StructWins}.DynMarshalTOML(reflect.ValueOf(Service{Name: "api"}), Extras{"name": "other"}, "others")
+	require.NoError(t, err)
+	assert.Equal(t, "name = \"api\"\n", string(raw))
+}
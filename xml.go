@@ -0,0 +1,1364 @@
+// go-dyn-struct
+// Copyright (C) 2020  Andrea Laisa
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+// © 2020 GitHub, Inc.
+
+package godynstruct
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// XMLElement is an XML element kept in the extra fields as it was encoded, with its attributes, its content and its name space prefixes
+// The prefixes declared by the ancestors of the element aren't declared again, they are kept in the extra fields of the dynamic struct that declares them
+type XMLElement []byte
+
+// MarshalXML writes the element x to e as it is, ignoring start
+func (x XMLElement) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	dec := xml.NewDecoder(bytes.NewReader(x))
+	var content []byte
+	depth := 0
+	for {
+		// the raw tokens keep the prefixes, that the encoder writes as part of the names
+		off := dec.InputOffset()
+		tok, err := dec.RawToken()
+		if err != nil {
+			return err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				start = xml.StartElement{Name: rawXMLName(t.Name), Attr: make([]xml.Attr, len(t.Attr))}
+				for i, a := range t.Attr {
+					start.Attr[i] = xml.Attr{Name: rawXMLName(a.Name), Value: a.Value}
+				}
+				content = x[dec.InputOffset():]
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+			if depth == 0 {
+				// the content is written as it is, so the CDATA sections are kept
+				return e.EncodeElement(xmlInner{Content: content[:len(content)-len(x[off:])]}, start)
+			}
+		}
+	}
+}
+
+// UnmarshalXML stores into x the element started by start
+func (x *XMLElement) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	el, err := encodeXMLElement(d, start, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	*x = el
+	return nil
+}
+
+// rawXMLName return the name n read with RawToken as a name without name space, whose local part contains the prefix
+func rawXMLName(n xml.Name) xml.Name {
+	if n.Space == "" {
+		return n
+	}
+	return xml.Name{Local: n.Space + ":" + n.Local}
+}
+
+// XMLOrder is the order of the attributes and of the child elements of the element of a dynamic struct, kept by DynUnmarshalXML in the extra field #order
+// when an unknown attribute, element, comment or CDATA section comes before a field of the struct, so DynMarshalXML writes them back in the same order
+// Each item is the key of an attribute or of a child element, like @id, item, #comment or #cdata, once for each of them in the element
+type XMLOrder []string
+
+// DynMarshalXML return the XML encoding of the dynamic struct _struct
+// The fields of the struct are encoded following their xml tags like encoding/xml does for a pointer to the struct, except that the names in the name spaces
+// declared by the extra fields @xmlns and @xmlns:prefix use those declarations, so they aren't declared again. Then the extra fields are added to the element:
+// the keys that start with @ are attributes, like @id or @xmlns:soap, #comment and #cdata are comments and CDATA sections,
+// the other keys are child elements and the XMLElement values are encoded as they are
+// If the extra field #order is an XMLOrder, the attributes and the child elements are written in its order, followed by the ones that aren't part of it
+// The name of the element is the one of the XMLName field or the name of the type of the struct
+// If an extra field has the same name of a field of the struct, the value of the extra field is used in place of the field
+// _struct contains the reflect.Value of the struct
+// extraFields contains the extra fields, it can be a map[string]interface{}, Extras or OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func DynMarshalXML(_struct reflect.Value, extraFields interface{}, extraFieldsName string) ([]byte, error) {
+	return Options{}.DynMarshalXML(_struct, extraFields, extraFieldsName)
+}
+
+// DynMarshalXML is like the function DynMarshalXML, but it uses the options o
+func (o Options) DynMarshalXML(_struct reflect.Value, extraFields interface{}, extraFieldsName string) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := xml.NewEncoder(&buf)
+
+	err := o.encodeXMLStruct(enc, xml.StartElement{}, _struct, extraFields, extraFieldsName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = enc.Flush()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// xmlItem is an attribute or a child element of the element of a dynamic struct
+type xmlItem struct {
+	// key is the key of the item in XMLOrder, empty if the item is never part of it
+	key string
+	// field is true if the item is a field of the struct
+	field bool
+	// attrs contains the attributes written by the item
+	attrs []xml.Attr
+	// parents contains the names of the parent elements of the child element, that are shared with the previous item
+	parents []string
+	// empty is true if the child element writes nothing, so its missing parents aren't written
+	empty bool
+	// write writes the child element to w
+	write func(w xmlWriter) error
+}
+
+// encodeXMLStruct writes to enc the dynamic struct _struct as the element started by start, or by the default start element of the struct if start has no name
+func (o Options) encodeXMLStruct(enc *xml.Encoder, start xml.StartElement, _struct reflect.Value, extraFields interface{}, extraFieldsName string) error {
+	members, err := o.dynMembers(_struct, extraFields, extraFieldsName, "xml")
+	if err != nil {
+		return err
+	}
+
+	_struct, err = indirectStruct(_struct)
+	if err != nil {
+		return err
+	}
+	if start.Name.Local == "" {
+		name, ok := xmlStructName(_struct)
+		if !ok {
+			name = xml.Name{Local: _struct.Type().Name()}
+		}
+		start.Name = name
+	}
+	// the names in the name spaces declared by the extra fields use their prefixes, so encoding/xml doesn't declare them again
+	decls := xmlExtrasDecls(members)
+	start.Name = xmlDeclaredName(start.Name, decls, false)
+
+	var attrs, children []xmlItem
+	var order XMLOrder
+	for _, m := range members {
+		var items []xmlItem
+		switch {
+		case m.field.is("XMLName"):
+			// the name of the element is in start
+			continue
+		case m.field.index != nil && m.extra:
+			items, err = xmlFieldItems(m.field, xmlValue(m.value), decls)
+		case m.field.index != nil:
+			items, err = xmlFieldItems(m.field, m.value, decls)
+		case m.key == "#order":
+			if v, ok := m.value.(XMLOrder); ok {
+				order = v
+				continue
+			}
+			items, err = xmlExtraItems(m.key, xmlValue(m.value))
+		default:
+			items, err = xmlExtraItems(m.key, xmlValue(m.value))
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, it := range items {
+			if it.write == nil {
+				attrs = append(attrs, it)
+			} else {
+				children = append(children, it)
+			}
+		}
+	}
+
+	for _, it := range sortXMLItems(attrs, order) {
+		start.Attr = append(start.Attr, it.attrs...)
+	}
+
+	// the content is written apart, so the CDATA sections can be written as they are
+	w := newXMLWriter()
+	// parents contains the parent elements that are open, like encoding/xml does for the fields named a>b
+	var parents []string
+	for _, it := range sortXMLItems(children, order) {
+		n := 0
+		for n < len(parents) && n < len(it.parents) && parents[n] == it.parents[n] {
+			n++
+		}
+		err = closeXMLParents(w.enc, parents[n:])
+		if err != nil {
+			return err
+		}
+		parents = parents[:n]
+		if it.empty {
+			continue
+		}
+
+		for _, p := range it.parents[n:] {
+			err = w.enc.EncodeToken(xml.StartElement{Name: xml.Name{Local: p}})
+			if err != nil {
+				return err
+			}
+			parents = append(parents, p)
+		}
+
+		err = it.write(w)
+		if err != nil {
+			return err
+		}
+	}
+	err = closeXMLParents(w.enc, parents)
+	if err != nil {
+		return err
+	}
+
+	content, err := w.content()
+	if err != nil {
+		return err
+	}
+	return enc.EncodeElement(xmlInner{Content: content}, start)
+}
+
+// xmlInner is an element whose content is written as it is
+type xmlInner struct {
+	Content []byte `xml:",innerxml"`
+}
+
+// xmlWriter writes the content of an element: the tokens with enc, and the CDATA sections, that encoding/xml can't write as tokens, directly to buf
+type xmlWriter struct {
+	enc *xml.Encoder
+	buf *bytes.Buffer
+}
+
+// newXMLWriter return an xmlWriter that writes to a new buffer
+func newXMLWriter() xmlWriter {
+	buf := &bytes.Buffer{}
+	return xmlWriter{enc: xml.NewEncoder(buf), buf: buf}
+}
+
+// cdata writes text as a CDATA section like encoding/xml does for the cdata fields, splitting it where it contains ]]>
+func (w xmlWriter) cdata(text []byte) error {
+	err := w.enc.Flush()
+	if err != nil {
+		return err
+	}
+
+	w.buf.WriteString("<![CDATA[")
+	for {
+		i := bytes.Index(text, []byte("]]>"))
+		if i < 0 {
+			break
+		}
+		w.buf.Write(text[:i])
+		w.buf.WriteString("]]]]><![CDATA[>")
+		text = text[i+len("]]>"):]
+	}
+	w.buf.Write(text)
+	w.buf.WriteString("]]>")
+
+	return nil
+}
+
+// content return what has been written
+func (w xmlWriter) content() ([]byte, error) {
+	err := w.enc.Flush()
+	if err != nil {
+		return nil, err
+	}
+	return w.buf.Bytes(), nil
+}
+
+// closeXMLParents writes to enc the end of the parent elements, from the last one
+func closeXMLParents(enc *xml.Encoder, parents []string) error {
+	for i := len(parents) - 1; i >= 0; i-- {
+		err := enc.EncodeToken(xml.EndElement{Name: xml.Name{Local: parents[i]}})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// xmlFieldItems return the items of the field fi of the struct, whose value is v, like encoding/xml encodes them following the xml tag of the field
+// The names in the name spaces declared in decls use their prefixes
+func xmlFieldItems(fi fieldInfo, v interface{}, decls []xmlDecl) ([]xmlItem, error) {
+	space, local, parents := xmlFieldName(fi)
+	item := xmlItem{key: xmlFieldKey(fi), field: true}
+
+	// the value is copied in an addressable value, so its methods with a pointer receiver are used like encoding/xml does for the fields
+	rv := reflect.ValueOf(v)
+	if rv.IsValid() {
+		copied := reflect.New(rv.Type()).Elem()
+		copied.Set(rv)
+		rv = copied
+	}
+
+	switch {
+	case fi.attr:
+		var err error
+		item.attrs, err = xmlAttrs(xmlDeclaredName(xml.Name{Space: space, Local: local}, decls, true), rv)
+		if err != nil {
+			return nil, err
+		}
+		return []xmlItem{item}, nil
+	case fi.xmlContent == "chardata" || fi.xmlContent == "cdata":
+		text, err := xmlText(rv)
+		if _, ok := err.(*xml.UnsupportedTypeError); ok {
+			// like encoding/xml, the values that aren't text are ignored
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		item.write = func(w xmlWriter) error {
+			if fi.xmlContent == "cdata" {
+				if text == "" {
+					// like encoding/xml, the empty CDATA sections aren't written
+					return nil
+				}
+				return w.cdata([]byte(text))
+			}
+			return w.enc.EncodeToken(xml.CharData(text))
+		}
+	case fi.xmlContent == "comment":
+		text, ok := xmlRawText(rv)
+		if !ok {
+			return nil, errors.New("The comment field " + fi.name + " isn't a string or a []byte")
+		}
+		if text == "" {
+			return nil, nil
+		}
+		item.write = func(w xmlWriter) error {
+			return w.enc.EncodeToken(xml.Comment(text))
+		}
+	case fi.xmlContent == "innerxml":
+		text, ok := xmlRawText(rv)
+		if !ok {
+			return nil, nil
+		}
+		item.write = func(w xmlWriter) error {
+			err := w.enc.Flush()
+			if err != nil {
+				return err
+			}
+			w.buf.WriteString(text)
+			return nil
+		}
+	default:
+		name := xmlDeclaredName(xml.Name{Space: space, Local: local}, decls, false)
+		item.write = func(w xmlWriter) error {
+			return encodeXMLElements(w.enc, rv, name)
+		}
+		// like encoding/xml, the parents aren't written for the nil values, but the ones shared with the previous field are kept open
+		item.parents = parents
+		item.empty = isNilXMLValue(rv)
+	}
+
+	return []xmlItem{item}, nil
+}
+
+// xmlExtraItems return the items of the extra field key, whose value is v: an attribute if key starts with @, comments for #comment,
+// CDATA sections for #cdata, otherwise child elements, one for each value of the XMLElement, []XMLElement and []interface{} values
+func xmlExtraItems(key string, v interface{}) ([]xmlItem, error) {
+	if key == "#comment" || key == "#cdata" {
+		texts, ok := xmlTexts(v)
+		if !ok {
+			return nil, errors.New("The value of the key " + key + " isn't a string or a []string")
+		}
+
+		items := make([]xmlItem, len(texts))
+		for i, text := range texts {
+			text := text
+			items[i] = xmlItem{key: key, write: func(w xmlWriter) error {
+				if key == "#cdata" {
+					return w.cdata([]byte(text))
+				}
+				return w.enc.EncodeToken(xml.Comment(text))
+			}}
+		}
+		return items, nil
+	}
+
+	attr := strings.HasPrefix(key, "@")
+	name, ok := xmlKeyName(strings.TrimPrefix(key, "@"))
+	if !ok {
+		return nil, errors.New("The key " + strconv.Quote(key) + " can't be encoded in XML")
+	}
+
+	if attr {
+		attrs, err := xmlAttrs(name, reflect.ValueOf(v))
+		if err != nil {
+			return nil, err
+		}
+		return []xmlItem{{key: key, attrs: attrs}}, nil
+	}
+
+	var values []interface{}
+	switch v := v.(type) {
+	case []XMLElement:
+		for _, el := range v {
+			values = append(values, el)
+		}
+	case []interface{}:
+		values = v
+	default:
+		values = []interface{}{v}
+	}
+
+	items := make([]xmlItem, len(values))
+	for i, value := range values {
+		rv := reflect.ValueOf(value)
+		items[i] = xmlItem{key: key, write: func(w xmlWriter) error {
+			return encodeXMLElements(w.enc, rv, name)
+		}}
+	}
+	return items, nil
+}
+
+// sortXMLItems return the items in the order of the keys in order, taking for each key all the fields of the struct with that key
+// or, if there aren't any, the next extra field with that key
+// The fields of the struct that aren't part of order keep their position before the following fields, the other items that aren't part of order are at the end
+func sortXMLItems(items []xmlItem, order XMLOrder) []xmlItem {
+	if order == nil {
+		return items
+	}
+
+	listed := make(map[string]bool, len(order))
+	for _, k := range order {
+		listed[k] = true
+	}
+
+	out := make([]xmlItem, 0, len(items))
+	done := make([]bool, len(items))
+	add := func(i int) {
+		if !done[i] {
+			done[i] = true
+			out = append(out, items[i])
+		}
+	}
+
+	for _, k := range order {
+		found := false
+		for i, it := range items {
+			if done[i] || !it.field || it.key != k {
+				continue
+			}
+			for j := 0; j < i; j++ {
+				if items[j].field && !listed[items[j].key] {
+					add(j)
+				}
+			}
+			add(i)
+			found = true
+		}
+		if found {
+			continue
+		}
+
+		for i, it := range items {
+			if !done[i] && it.key == k {
+				add(i)
+				break
+			}
+		}
+	}
+
+	for i := range items {
+		add(i)
+	}
+	return out
+}
+
+// encodeXMLElements writes to enc the value v as the elements named name, like encoding/xml does for a field
+// The slices are written as an element for each value, and the structs that aren't marshalers are named after their XMLName field if they have one
+func encodeXMLElements(enc *xml.Encoder, v reflect.Value, name xml.Name) error {
+	if !v.IsValid() {
+		return nil
+	}
+
+	elem := v
+	for !isXMLMarshaler(elem) && (elem.Kind() == reflect.Ptr || elem.Kind() == reflect.Interface) {
+		if elem.IsNil() {
+			return nil
+		}
+		elem = elem.Elem()
+	}
+
+	if !isXMLMarshaler(elem) {
+		switch elem.Kind() {
+		case reflect.Slice, reflect.Array:
+			if elem.Type().Elem().Kind() != reflect.Uint8 {
+				for i := 0; i < elem.Len(); i++ {
+					err := encodeXMLElements(enc, elem.Index(i), name)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+		case reflect.Struct:
+			if n, ok := xmlStructName(elem); ok {
+				name = n
+			}
+		}
+	}
+
+	if v.CanAddr() {
+		// the methods with a pointer receiver are used too
+		return enc.EncodeElement(v.Addr().Interface(), xml.StartElement{Name: name})
+	}
+	return enc.EncodeElement(v.Interface(), xml.StartElement{Name: name})
+}
+
+// isXMLMarshaler return true if v, or its address, implements xml.Marshaler or encoding.TextMarshaler, so encoding/xml names it after its field
+func isXMLMarshaler(v reflect.Value) bool {
+	_, ok := xmlImplementer(v, xmlMarshalerType)
+	if !ok {
+		_, ok = xmlImplementer(v, textMarshalerType)
+	}
+	return ok
+}
+
+// xmlImplementer return v, or its address if v is addressable, if it implements the interface typ
+func xmlImplementer(v reflect.Value, typ reflect.Type) (interface{}, bool) {
+	if !v.IsValid() || v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil, false
+	}
+	if v.Type().Implements(typ) {
+		return v.Interface(), true
+	}
+	if v.CanAddr() && v.Addr().Type().Implements(typ) {
+		return v.Addr().Interface(), true
+	}
+
+	return nil, false
+}
+
+// isNilXMLValue return true if v is nil, a nil pointer or a nil interface
+func isNilXMLValue(v reflect.Value) bool {
+	return !v.IsValid() || (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil()
+}
+
+// xmlAttrs return the attributes named name for the value v, like encoding/xml does for the attribute fields:
+// the xml.MarshalerAttr values return their attribute, the slices an attribute for each value and the other values an attribute with their text
+func xmlAttrs(name xml.Name, v reflect.Value) ([]xml.Attr, error) {
+	for {
+		if m, ok := xmlImplementer(v, xmlMarshalerAttrType); ok {
+			attr, err := m.(xml.MarshalerAttr).MarshalXMLAttr(name)
+			if err != nil || attr.Name.Local == "" {
+				return nil, err
+			}
+			return []xml.Attr{attr}, nil
+		}
+		if _, ok := xmlImplementer(v, textMarshalerType); ok || v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface {
+			break
+		}
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+
+	if !v.IsValid() {
+		return nil, nil
+	}
+	if attr, ok := v.Interface().(xml.Attr); ok {
+		return []xml.Attr{attr}, nil
+	}
+	if _, ok := xmlImplementer(v, textMarshalerType); !ok && v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+		var attrs []xml.Attr
+		for i := 0; i < v.Len(); i++ {
+			a, err := xmlAttrs(name, v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			attrs = append(attrs, a...)
+		}
+		return attrs, nil
+	}
+
+	text, err := xmlText(v)
+	if err != nil {
+		return nil, err
+	}
+	return []xml.Attr{{Name: name, Value: text}}, nil
+}
+
+// xmlText return the text of the value v, like encoding/xml does for the attributes and the character data
+// The nil values have no text, the values that aren't text marshalers, numbers, booleans, strings or bytes return an *xml.UnsupportedTypeError
+func xmlText(v reflect.Value) (string, error) {
+	for {
+		if m, ok := xmlImplementer(v, textMarshalerType); ok {
+			text, err := m.(encoding.TextMarshaler).MarshalText()
+			return string(text), err
+		}
+		if isNilXMLValue(v) {
+			return "", nil
+		}
+		if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface {
+			break
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits()), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			text := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(text), v)
+			return string(text), nil
+		}
+	}
+
+	return "", &xml.UnsupportedTypeError{Type: v.Type()}
+}
+
+// xmlRawText return the value v of a comment or innerxml field, ok is false if v isn't a string or a []byte
+func xmlRawText(v reflect.Value) (text string, ok bool) {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && !v.IsNil() {
+		v = v.Elem()
+	}
+
+	switch {
+	case isNilXMLValue(v):
+		return "", true
+	case v.Kind() == reflect.String:
+		return v.String(), true
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		return string(v.Bytes()), true
+	}
+	return "", false
+}
+
+// xmlTexts return the texts of the value v of the extra fields #comment and #cdata, that can be a string, a []string or a []interface{} of strings
+func xmlTexts(v interface{}) ([]string, bool) {
+	switch v := v.(type) {
+	case string:
+		return []string{v}, true
+	case []string:
+		return v, true
+	case []interface{}:
+		out := make([]string, len(v))
+		for i, x := range v {
+			s, ok := x.(string)
+			if !ok {
+				return nil, false
+			}
+			out[i] = s
+		}
+		return out, true
+	}
+
+	return nil, false
+}
+
+// isXMLCDATA return true if the token at the offset off of the XML encoded data src is a CDATA section, false if src isn't known
+func isXMLCDATA(src []byte, off int64) bool {
+	return off < int64(len(src)) && bytes.HasPrefix(src[off:], []byte("<![CDATA["))
+}
+
+var (
+	xmlMarshalerType     = reflect.TypeOf((*xml.Marshaler)(nil)).Elem()
+	xmlMarshalerAttrType = reflect.TypeOf((*xml.MarshalerAttr)(nil)).Elem()
+	textMarshalerType    = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// xmlStructName return the name of the element of the struct _struct set by its XMLName field, like encoding/xml does, whatever the type of the field
+// ok is false if the struct has no XMLName field or the field doesn't set a name
+func xmlStructName(_struct reflect.Value) (name xml.Name, ok bool) {
+	sf, ok := _struct.Type().FieldByName("XMLName")
+	if !ok {
+		return xml.Name{}, false
+	}
+
+	if tag := strings.Split(sf.Tag.Get("xml"), ",")[0]; tag != "" {
+		if i := strings.Index(tag, " "); i >= 0 {
+			return xml.Name{Space: tag[:i], Local: tag[i+1:]}, true
+		}
+		return xml.Name{Local: tag}, true
+	}
+
+	if sf.Type == xmlNameType {
+		if fieldValue, ok := fieldByIndex(addressableStruct(_struct), sf.Index); ok {
+			if name := fieldValue.Interface().(xml.Name); name.Local != "" {
+				return name, true
+			}
+		}
+	}
+	return xml.Name{}, false
+}
+
+var xmlNameType = reflect.TypeOf(xml.Name{})
+
+// xmlExtrasDecls return the name space declarations contained in the extra fields @xmlns and @xmlns:prefix of members
+func xmlExtrasDecls(members []dynMember) []xmlDecl {
+	var decls []xmlDecl
+	for _, m := range members {
+		switch {
+		case m.field.index != nil:
+			continue
+		case m.key == "@xmlns":
+			decls = append(decls, xmlDecl{url: fmt.Sprint(m.value)})
+		case strings.HasPrefix(m.key, "@xmlns:"):
+			decls = append(decls, xmlDecl{prefix: m.key[len("@xmlns:"):], url: fmt.Sprint(m.value)})
+		}
+	}
+
+	return decls
+}
+
+// xmlDeclaredName return the name n without name space and with the prefix declared in decls as part of the local name, if its name space is declared
+// The default name space is used only if n isn't the name of an attribute
+func xmlDeclaredName(n xml.Name, decls []xmlDecl, attr bool) xml.Name {
+	if n.Space == "" {
+		return n
+	}
+
+	prefix, ok := xmlPrefix(decls, n.Space, !attr)
+	switch {
+	case !ok:
+		return n
+	case prefix == "":
+		return xml.Name{Local: n.Local}
+	}
+	return xml.Name{Local: prefix + ":" + n.Local}
+}
+
+// xmlKeyName return the name of the element or of the attribute key, that is a name, optionally with a prefix, or {space}name
+// ok is false if the key isn't a valid name
+func xmlKeyName(key string) (name xml.Name, ok bool) {
+	space, local := "", key
+	if strings.HasPrefix(key, "{") {
+		i := strings.Index(key, "}")
+		if i < 0 {
+			return xml.Name{}, false
+		}
+		space, local = key[1:i], key[i+1:]
+		if space == "" {
+			return xml.Name{}, false
+		}
+	}
+
+	for i, r := range local {
+		if !unicode.IsLetter(r) && r != '_' && r != ':' && (i == 0 || !unicode.IsDigit(r) && r != '-' && r != '.') {
+			return xml.Name{}, false
+		}
+	}
+	if local == "" {
+		return xml.Name{}, false
+	}
+
+	return xml.Name{Space: space, Local: local}, true
+}
+
+// xmlValue return v with the maps nested inside the slices converted to OrderedExtras sorted by key, that encoding/xml can encode
+func xmlValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case Extras:
+		return xmlValue(map[string]interface{}(v))
+	case map[string]interface{}:
+		out := make(OrderedExtras, 0, len(v))
+		for _, k := range sortedKeys(v) {
+			out = append(out, ExtraField{Key: k, Value: v[k]})
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, x := range v {
+			out[i] = xmlValue(x)
+		}
+		return out
+	}
+
+	return v
+}
+
+// ToXML return the XML encoding of the dynamic struct v, that can be a struct, a Dyn or a pointer to one of them
+// The extra fields are the ones in the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func ToXML(v interface{}) ([]byte, error) {
+	return Options{}.ToXML(v)
+}
+
+// ToXML is like the function ToXML, but it uses the options o
+func (o Options) ToXML(v interface{}) ([]byte, error) {
+	ptrStruct, err := dynStruct(v)
+	if err != nil {
+		return nil, err
+	}
+
+	extraFields, name, err := extrasField(ptrStruct.Elem(), "xml")
+	if err != nil {
+		return nil, err
+	}
+
+	return o.DynMarshalXML(ptrStruct, extraFields.Interface(), name)
+}
+
+// DynUnmarshalXML parses the XML encoded data and store the result into the dynamic struct pointed by ptrStruct
+// The attributes and the child elements that match the xml tags of the fields are decoded by encoding/xml, the others are set inside the extras in order:
+// the attributes with the key @name, or @prefix:name if they have a name space, with their value as string,
+// the child elements with their name as key and the element encoded again as value, as an XMLElement or as []XMLElement if they are repeated
+// The values of the extra fields are always kept encoded, so RawExtras has no effect, and the innerxml fields aren't filled
+// data is the XML encoded data, that must contain an element
+// ptrStruct contains the reflect.Value of the pointer to the struct
+// extraFieldsPtr is the pointer to the extra fields, it can be a *map[string]interface{}, *Extras or *OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func DynUnmarshalXML(data []byte, ptrStruct reflect.Value, extraFieldsPtr interface{}, extraFieldsName string) error {
+	return Options{}.DynUnmarshalXML(data, ptrStruct, extraFieldsPtr, extraFieldsName)
+}
+
+// DynUnmarshalXML is like the function DynUnmarshalXML, but it uses the options o
+func (o Options) DynUnmarshalXML(data []byte, ptrStruct reflect.Value, extraFieldsPtr interface{}, extraFieldsName string) error {
+	dest, err := newDynDest(ptrStruct, extraFieldsPtr, extraFieldsName, "xml", o.Merge)
+	if err != nil {
+		return err
+	}
+
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		if start, ok := tok.(xml.StartElement); ok {
+			return o.decodeXMLStruct(dec, start, nil, data, dest)
+		}
+	}
+}
+
+// FromXML parses the XML encoded data and store the result into the dynamic struct pointed by v, that can be a pointer to a struct or to a Dyn
+// The attributes and the elements that aren't part of the struct are set inside the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func FromXML(data []byte, v interface{}) error {
+	return Options{}.FromXML(data, v)
+}
+
+// FromXML is like the function FromXML, but it uses the options o
+func (o Options) FromXML(data []byte, v interface{}) error {
+	ptrStruct, err := dynStructPtr(v)
+	if err != nil {
+		return err
+	}
+
+	extraFields, name, err := extrasField(ptrStruct.Elem(), "xml")
+	if err != nil {
+		return err
+	}
+
+	return o.DynUnmarshalXML(data, ptrStruct, extraFields.Addr().Interface(), name)
+}
+
+// decodeXMLStruct reads from dec the content of the element started by start and store it into dest
+// scope contains the name space declarations of the ancestors of the element, src contains the data read by dec, if it's known, to find the CDATA sections
+func (o Options) decodeXMLStruct(dec *xml.Decoder, start xml.StartElement, scope []xmlDecl, src []byte, dest *dynDest) error {
+	scope = xmlDecls(scope, start.Attr)
+
+	// paths contains the unknown attributes and elements found with DisallowUnknownFields
+	var paths []string
+	extras := make(OrderedExtras, 0)
+	add := func(key string, v interface{}) {
+		switch current, _ := extras.Get(key); current := current.(type) {
+		case nil:
+			extras.Set(key, v)
+		case XMLElement:
+			extras.Set(key, []XMLElement{current, v.(XMLElement)})
+		case []XMLElement:
+			extras.Set(key, append(current, v.(XMLElement)))
+		case string:
+			extras.Set(key, []string{current, v.(string)})
+		case []string:
+			extras.Set(key, append(current, v.(string)))
+		}
+	}
+
+	// order contains the keys of the attributes and of the child elements in the order of the document,
+	// it's kept only if an unknown one comes before a field of the struct, because otherwise they are encoded in the same order
+	var order XMLOrder
+	ordered, unknown := false, false
+	known := func(fi fieldInfo) {
+		order = append(order, xmlFieldKey(fi))
+		ordered = ordered || unknown
+	}
+
+	for _, a := range start.Attr {
+		if field, ok := xmlAttrField(dest.fields, dest.extraFieldsName, a.Name); ok {
+			known(field)
+			continue
+		}
+
+		key := "@" + xmlAttrKey(a.Name, scope)
+		if o.DisallowUnknownFields {
+			// the declarations of the name spaces aren't unknown fields
+			if key != "@xmlns" && !strings.HasPrefix(key, "@xmlns:") {
+				paths = append(paths, key)
+			}
+		} else {
+			extras = append(extras, ExtraField{Key: key, Value: a.Value})
+			order, unknown = append(order, key), true
+		}
+	}
+	// the attributes are always written before the child elements
+	unknown = false
+
+	// encoding/xml decodes the element without the unknown child elements, that are stored by child
+	child := func(t xml.StartElement) (bool, error) {
+		key := t.Name.Local
+		field, ok := xmlChildField(dest.fields, dest.extraFieldsName, t.Name)
+		if ok {
+			known(field)
+			if !field.any && !strings.Contains(field.actualFieldName, ">") {
+				fieldValue, err := dest.fieldValue(field)
+				if err != nil {
+					return false, err
+				}
+
+				if d, ok := nestedDyn(fieldValue, true); ok {
+					// the nested dynamic struct is unmarshalled with the same options
+					err = d.unmarshalXML(dec, t, scope, src, o)
+					if e, ok := err.(*UnknownFieldsError); ok {
+						for _, p := range e.Paths {
+							paths = append(paths, joinPath(key, p))
+						}
+						return true, nil
+					}
+					return true, err
+				}
+			}
+			return false, nil
+		}
+
+		if o.DisallowUnknownFields {
+			paths = append(paths, key)
+			return true, dec.Skip()
+		}
+
+		el, err := encodeXMLElement(dec, t, scope, src)
+		if err != nil {
+			return false, err
+		}
+
+		add(key, el)
+		order, unknown = append(order, key), true
+		return true, nil
+	}
+
+	// the comments and the CDATA sections are kept in the extra fields if the struct has no field for them
+	comments, text := false, false
+	for _, fi := range dest.fields.list {
+		comments = comments || fi.xmlContent == "comment"
+		text = text || fi.xmlContent == "chardata" || fi.xmlContent == "cdata"
+	}
+	content := func(tok xml.Token, cdata bool) bool {
+		var key, value string
+		switch t := tok.(type) {
+		case xml.Comment:
+			key, value = "#comment", string(t)
+			if comments {
+				return false
+			}
+		case xml.CharData:
+			key, value = "#cdata", string(t)
+			if !cdata || text {
+				return false
+			}
+		}
+
+		if !o.DisallowUnknownFields {
+			add(key, value)
+			order, unknown = append(order, key), true
+		}
+		return true
+	}
+
+	filter := &xmlFilter{dec: dec, src: src, start: start, child: child, content: content}
+	err := xml.NewTokenDecoder(filter).Decode(dest.ptrStruct.Interface())
+	if err != nil {
+		return err
+	}
+
+	if len(paths) > 0 {
+		return &UnknownFieldsError{Paths: paths}
+	}
+
+	if ordered {
+		extras.Set("#order", order)
+	}
+	for _, f := range extras {
+		dest.extras.set(f.Key, f.Value)
+	}
+
+	return nil
+}
+
+// xmlFilter is the xml.TokenReader of the element of a dynamic struct that passes the child elements to child and the comments and the character data to content,
+// omitting the ones that they have read
+type xmlFilter struct {
+	dec *xml.Decoder
+	// src contains the data read by dec, if it's known
+	src     []byte
+	start   xml.StartElement
+	child   func(start xml.StartElement) (bool, error)
+	content func(tok xml.Token, cdata bool) bool
+	// depth is the depth of the current token, 0 for the start element
+	depth int
+}
+
+// Token return the next token of the element
+func (f *xmlFilter) Token() (xml.Token, error) {
+	if f.depth < 0 {
+		return nil, io.EOF
+	}
+	if f.depth == 0 {
+		f.depth++
+		return f.start, nil
+	}
+
+	for {
+		off := f.dec.InputOffset()
+		tok, err := f.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		tok = xml.CopyToken(tok)
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if f.depth == 1 {
+				skip, err := f.child(t)
+				if err != nil {
+					return nil, err
+				}
+				if skip {
+					continue
+				}
+			}
+			f.depth++
+		case xml.EndElement:
+			f.depth--
+			if f.depth == 0 {
+				// the element is ended
+				f.depth = -1
+			}
+		case xml.Comment, xml.CharData:
+			if f.depth == 1 && f.content(t, isXMLCDATA(f.src, off)) {
+				continue
+			}
+		}
+
+		return tok, nil
+	}
+}
+
+// xmlFieldKey return the key of the field fi in XMLOrder: @name for the attributes, the name of the element, or of its first parent, for the child elements
+func xmlFieldKey(fi fieldInfo) string {
+	_, local, parents := xmlFieldName(fi)
+	switch {
+	case fi.attr:
+		return "@" + local
+	case len(parents) > 0:
+		return parents[0]
+	}
+	return local
+}
+
+// xmlFieldName return the name space, the name and the parents of the element or attribute of the field fi, parsing its name like encoding/xml does
+func xmlFieldName(fi fieldInfo) (space string, local string, parents []string) {
+	local = fi.actualFieldName
+	if i := strings.Index(local, " "); i >= 0 {
+		space, local = local[:i], local[i+1:]
+	}
+
+	parents = strings.Split(local, ">")
+	return space, parents[len(parents)-1], parents[:len(parents)-1]
+}
+
+// xmlAttrField return the field of the struct where the attribute name is decoded
+func xmlAttrField(fields *typeFields, extraFieldsName string, name xml.Name) (fieldInfo, bool) {
+	for _, fi := range fields.list {
+		if !fi.attr || fi.is(extraFieldsName) {
+			continue
+		}
+		if fi.any {
+			return fi, true
+		}
+
+		space, local, _ := xmlFieldName(fi)
+		if local == name.Local && (space == "" || space == name.Space) {
+			return fi, true
+		}
+	}
+
+	return fieldInfo{}, false
+}
+
+// xmlChildField return the field of the struct where the child element name is decoded
+func xmlChildField(fields *typeFields, extraFieldsName string, name xml.Name) (fieldInfo, bool) {
+	var anyField *fieldInfo
+	for i, fi := range fields.list {
+		if fi.attr || fi.xmlContent != "" || fi.is(extraFieldsName) || fi.is("XMLName") {
+			continue
+		}
+		if fi.any {
+			anyField = &fields.list[i]
+			continue
+		}
+
+		space, local, parents := xmlFieldName(fi)
+		if len(parents) > 0 {
+			if parents[0] == name.Local {
+				return fi, true
+			}
+		} else if local == name.Local && (space == "" || space == name.Space) {
+			return fi, true
+		}
+	}
+
+	if anyField != nil {
+		return *anyField, true
+	}
+	return fieldInfo{}, false
+}
+
+// xmlDecl is the declaration of the name space url with prefix, that is empty for the default name space
+type xmlDecl struct {
+	prefix string
+	url    string
+}
+
+// xmlDecls return a copy of scope with the name space declarations inside attrs appended
+func xmlDecls(scope []xmlDecl, attrs []xml.Attr) []xmlDecl {
+	out := append([]xmlDecl(nil), scope...)
+	for _, a := range attrs {
+		switch {
+		case a.Name.Space == "xmlns":
+			out = append(out, xmlDecl{prefix: a.Name.Local, url: a.Value})
+		case a.Name.Space == "" && a.Name.Local == "xmlns":
+			out = append(out, xmlDecl{url: a.Value})
+		}
+	}
+
+	return out
+}
+
+// xmlLookup return the name space bound to prefix in scope
+func xmlLookup(scope []xmlDecl, prefix string) string {
+	for i := len(scope) - 1; i >= 0; i-- {
+		if scope[i].prefix == prefix {
+			return scope[i].url
+		}
+	}
+
+	return ""
+}
+
+// xmlPrefix return the prefix bound to the name space url in scope, ok is false if url isn't bound to any prefix
+// The default name space is considered only if allowDefault is true
+func xmlPrefix(scope []xmlDecl, url string, allowDefault bool) (prefix string, ok bool) {
+	for i := len(scope) - 1; i >= 0; i-- {
+		d := scope[i]
+		if d.url == url && (d.prefix != "" || allowDefault) && xmlLookup(scope, d.prefix) == url {
+			return d.prefix, true
+		}
+	}
+
+	return "", false
+}
+
+// xmlAttrKey return the name of the attribute n with the prefix of its name space, or as {space}name if the prefix isn't declared in scope
+func xmlAttrKey(n xml.Name, scope []xmlDecl) string {
+	switch n.Space {
+	case "":
+		return n.Local
+	case "xmlns":
+		return "xmlns:" + n.Local
+	case xmlNamespace:
+		return "xml:" + n.Local
+	}
+
+	if prefix, ok := xmlPrefix(scope, n.Space, false); ok {
+		return prefix + ":" + n.Local
+	}
+	return "{" + n.Space + "}" + n.Local
+}
+
+// xmlNamespace is the name space bound to the prefix xml
+const xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+
+// encodeXMLElement reads from dec the content of the element started by start and return the element encoded again
+// The names use the prefixes declared in scope or inside the element, the name spaces without a prefix are declared again
+// The CDATA sections are kept if src contains the data read by dec
+func encodeXMLElement(dec *xml.Decoder, start xml.StartElement, scope []xmlDecl, src []byte) (XMLElement, error) {
+	w := newXMLWriter()
+	err := writeXMLElement(w, dec, start, scope, src)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := w.content()
+	return XMLElement(content), err
+}
+
+// writeXMLElement reads from dec the content of the element started by start and writes it to w, with the prefixes as part of the names
+func writeXMLElement(w xmlWriter, dec *xml.Decoder, start xml.StartElement, scope []xmlDecl, src []byte) error {
+	scope = xmlDecls(scope, start.Attr)
+	out := xml.StartElement{Attr: make([]xml.Attr, 0, len(start.Attr))}
+
+	switch prefix, ok := xmlPrefix(scope, start.Name.Space, true); {
+	case start.Name.Space == "" && xmlLookup(scope, "") != "":
+		// the element has no name space, so the default one is removed
+		scope = append(scope, xmlDecl{})
+		out.Attr = append(out.Attr, xml.Attr{Name: xml.Name{Local: "xmlns"}})
+		out.Name.Local = start.Name.Local
+	case start.Name.Space == "" || ok && prefix == "":
+		out.Name.Local = start.Name.Local
+	case ok:
+		out.Name.Local = prefix + ":" + start.Name.Local
+	default:
+		// the name space has been declared by an unknown ancestor
+		scope = append(scope, xmlDecl{url: start.Name.Space})
+		out.Attr = append(out.Attr, xml.Attr{Name: xml.Name{Local: "xmlns"}, Value: start.Name.Space})
+		out.Name.Local = start.Name.Local
+	}
+
+	for _, a := range start.Attr {
+		key := xmlAttrKey(a.Name, scope)
+		if strings.HasPrefix(key, "{") {
+			// the name space has been declared by an unknown ancestor
+			prefix := "ns"
+			for i := 1; xmlLookup(scope, prefix) != ""; i++ {
+				prefix = "ns" + strconv.Itoa(i)
+			}
+			scope = append(scope, xmlDecl{prefix: prefix, url: a.Name.Space})
+			out.Attr = append(out.Attr, xml.Attr{Name: xml.Name{Local: "xmlns:" + prefix}, Value: a.Name.Space})
+			key = prefix + ":" + a.Name.Local
+		}
+		out.Attr = append(out.Attr, xml.Attr{Name: xml.Name{Local: key}, Value: a.Value})
+	}
+
+	err := w.enc.EncodeToken(out)
+	if err != nil {
+		return err
+	}
+
+	for {
+		off := dec.InputOffset()
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			err = writeXMLElement(w, dec, t, scope, src)
+		case xml.EndElement:
+			return w.enc.EncodeToken(out.End())
+		case xml.CharData:
+			if isXMLCDATA(src, off) {
+				err = w.cdata(t)
+			} else {
+				err = w.enc.EncodeToken(xml.CopyToken(t))
+			}
+		default:
+			err = w.enc.EncodeToken(xml.CopyToken(t))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// decodeOrderedXML parses the XML encoded element data like decodeXMLValue
+func decodeOrderedXML(data []byte) (interface{}, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		if start, ok := tok.(xml.StartElement); ok {
+			return decodeXMLValue(dec, start)
+		}
+	}
+}
+
+// decodeXMLValue reads from dec the content of the element started by start and return it as a string, if it contains only text,
+// otherwise as OrderedExtras with the attributes as @name, the child elements, as []interface{} if they are repeated, and the text as #text
+func decodeXMLValue(dec *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	out := make(OrderedExtras, 0)
+	for _, a := range start.Attr {
+		// the declarations of the name spaces aren't values
+		if a.Name.Space != "xmlns" && (a.Name.Space != "" || a.Name.Local != "xmlns") {
+			out.Set("@"+a.Name.Local, a.Value)
+		}
+	}
+
+	var text []byte
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			v, err := decodeXMLValue(dec, t)
+			if err != nil {
+				return nil, err
+			}
+
+			switch current, _ := out.Get(t.Name.Local); current := current.(type) {
+			case nil:
+				out.Set(t.Name.Local, v)
+			case []interface{}:
+				out.Set(t.Name.Local, append(current, v))
+			default:
+				out.Set(t.Name.Local, []interface{}{current, v})
+			}
+		case xml.CharData:
+			text = append(text, t...)
+		case xml.EndElement:
+			if len(out) == 0 {
+				return string(text), nil
+			}
+			if s := strings.TrimSpace(string(text)); s != "" {
+				out.Set("#text", s)
+			}
+			return out, nil
+		}
+	}
+}
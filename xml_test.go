@@ -0,0 +1,437 @@
+// go-dyn-struct
+// Copyright (C) 2020  Andrea Laisa
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+// © 2020 GitHub, Inc.
+
+package godynstruct
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type Invoice struct {
+	ID       int    `xml:"id,attr"`
+	Number   int    `xml:"number"`
+	Note     string `xml:"note,omitempty"`
+	Local    string `xml:"-"`
+	Customer *Dyn[Driver]
+	others   OrderedExtras
+}
+
+func TestDynXML(t *testing.T) {
+	raw := `<Invoice xmlns:ext="urn:ext" id="7" ext:channel="web" priority="high">` +
+		`<number>42</number>` +
+		`<ext:gift lang="en">wrap <b>it</b></ext:gift>` +
+		`<Customer vip="yes"><Name>amreo</Name><License>B</License></Customer>` +
+		`<tag>a</tag><tag>b</tag>` +
+		`</Invoice>`
+
+	var o Invoice
+	require.NoError(t, DynUnmarshalXML([]byte(raw), reflect.ValueOf(&o), &o.others, "others"))
+	assert.Equal(t, Invoice{
+		ID:     7,
+		Number: 42,
+		Customer: &Dyn[Driver]{Value: Driver{Name: "amreo", Extras: Extras{
+			"@vip":    "yes",
+			"License": XMLElement(`<License>B</License>`),
+		}}},
+		others: OrderedExtras{
+			{"@xmlns:ext", "urn:ext"},
+			{"@ext:channel", "web"},
+			{"@priority", "high"},
+			{"gift", XMLElement(`<ext:gift lang="en">wrap <b>it</b></ext:gift>`)},
+			{"tag", []XMLElement{XMLElement(`<tag>a</tag>`), XMLElement(`<tag>b</tag>`)}},
+			{"#order", XMLOrder{"@xmlns:ext", "@id", "@ext:channel", "@priority", "number", "gift", "Customer", "tag", "tag"}},
+		},
+	}, o)
+
+	// the unknown attributes and elements are written back in their position
+	o.Local = "ignored"
+	again, err := DynMarshalXML(reflect.ValueOf(o), o.others, "others")
+	require.NoError(t, err)
+	assert.Equal(t, raw, string(again))
+
+	var gift OrderedExtras
+	require.NoError(t, o.others.Decode("gift", &gift))
+	assert.Equal(t, OrderedExtras{{"@lang", "en"}, {"b", "it"}, {"#text", "wrap"}}, gift)
+
+	var d Driver
+	require.NoError(t, DynUnmarshalXML(again, reflect.ValueOf(&d), &d.Extras, ""))
+	assert.Equal(t, XMLElement(`<number>42</number>`), d.Extras["number"])
+	assert.Equal(t, "7", d.Extras["@id"])
+
+	assert.Error(t, DynUnmarshalXML([]byte(`<Invoice><number>x</number></Invoice>`), reflect.ValueOf(&o), &o.others, "others"))
+	assert.Error(t, DynUnmarshalXML([]byte(`<Invoice><number>`), reflect.ValueOf(&o), &o.others, "others"))
+	assert.Error(t, DynUnmarshalXML([]byte(``), reflect.ValueOf(&o), &o.others, "others"))
+
+	_, err = DynMarshalXML(reflect.ValueOf(Invoice{}), OrderedExtras{{"bad key", 1}}, "others")
+	assert.EqualError(t, err, `The key "bad key" can't be encoded in XML`)
+}
+
+type Envelope struct {
+	XMLName xml.Name     `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Body    *Dyn[Driver] `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	others  OrderedExtras
+}
+
+func TestDynXMLNamespaces(t *testing.T) {
+	raw := `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:wsa="http://www.w3.org/2005/08/addressing">` +
+		`<soap:Header><wsa:Action soap:mustUnderstand="1">urn:ping</wsa:Action></soap:Header>` +
+		`<soap:Body><Name>amreo</Name><ping xmlns="urn:partner"><id>1</id></ping></soap:Body>` +
+		`</soap:Envelope>`
+
+	var e Envelope
+	require.NoError(t, DynUnmarshalXML([]byte(raw), reflect.ValueOf(&e), &e.others, "others"))
+	assert.Equal(t, "amreo", e.Body.Value.Name)
+	assert.Equal(t, Extras{"ping": XMLElement(`<ping xmlns="urn:partner"><id>1</id></ping>`)}, e.Body.Value.Extras)
+	assert.Equal(t, OrderedExtras{
+		{"@xmlns:soap", "http://schemas.xmlsoap.org/soap/envelope/"},
+		{"@xmlns:wsa", "http://www.w3.org/2005/08/addressing"},
+		{"Header", XMLElement(`<soap:Header><wsa:Action soap:mustUnderstand="1">urn:ping</wsa:Action></soap:Header>`)},
+		{"#order", XMLOrder{"@xmlns:soap", "@xmlns:wsa", "Header", "Body"}},
+	}, e.others)
+
+	// the prefixes declared in the extra fields are used for the elements of the struct
+	again, err := ToXML(e)
+	require.NoError(t, err)
+	assert.Equal(t, raw, string(again))
+
+	var out Envelope
+	require.NoError(t, FromXML(again, &out))
+	assert.Equal(t, e, out)
+
+	// the element declares again the name spaces declared by the ancestors without a prefix
+	var d Driver
+	require.NoError(t, DynUnmarshalXML([]byte(`<a xmlns="urn:a" xmlns:b="urn:b" b:x="1"><Name>amreo</Name><c b:y="2"/></a>`), reflect.ValueOf(&d), &d.Extras, ""))
+	assert.Equal(t, Extras{
+		"@xmlns":   "urn:a",
+		"@xmlns:b": "urn:b",
+		"@b:x":     "1",
+		"c":        XMLElement(`<c b:y="2"></c>`),
+	}, d.Extras)
+
+	var c XMLElement
+	require.NoError(t, xml.Unmarshal([]byte(`<a xmlns="urn:a" xmlns:b="urn:b"><c b:y="2"><d xmlns=""/></c></a>`), &struct {
+		C *XMLElement `xml:"c"`
+	}{&c}))
+	assert.Equal(t, XMLElement(`<c xmlns="urn:a" xmlns:ns="urn:b" ns:y="2"><d xmlns=""></d></c>`), c)
+}
+
+func TestDynXMLOptions(t *testing.T) {
+	raw := []byte(`<Invoice xmlns:ext="urn:ext" id="7" ext:channel="web"><number>42</number><Customer><Name>amreo</Name><License>B</License></Customer><extra/></Invoice>`)
+
+	var o Invoice
+	err := Options{DisallowUnknownFields: true}.DynUnmarshalXML(raw, reflect.ValueOf(&o), &o.others, "others")
+	assert.Equal(t, &UnknownFieldsError{Paths: []string{"@ext:channel", "Customer.License", "extra"}}, err)
+
+	o = Invoice{others: OrderedExtras{{"kept", "yes"}}}
+	require.NoError(t, Options{Merge: true}.DynUnmarshalXML(raw, reflect.ValueOf(&o), &o.others, "others"))
+	assert.Equal(t, OrderedExtras{
+		{"kept", "yes"},
+		{"@xmlns:ext", "urn:ext"},
+		{"@ext:channel", "web"},
+		{"extra", XMLElement(`<extra></extra>`)},
+		{"#order", XMLOrder{"@xmlns:ext", "@id", "@ext:channel", "number", "Customer", "extra"}},
+	}, o.others)
+
+	// the elements are decoded when they are encoded in another format
+	json, err := DynMarshalJSON(reflect.ValueOf(Event{Name: "login"}), OrderedExtras{
+		{"extra", XMLElement(`<extra id="1"><v>a</v><v>b</v></extra>`)},
+		{"tags", []XMLElement{XMLElement(`<tags>x</tags>`), XMLElement(`<tags/>`)}},
+	}, "")
+	require.NoError(t, err)
+	assert.Equal(t, `{"name":"login","source":"","extra":{"@id":"1","v":["a","b"]},"tags":["x",""]}`, string(json))
+
+	// the values of the other formats are encoded as elements
+	out, err := DynMarshalXML(reflect.ValueOf(Event{Name: "login"}), Extras{"device": map[string]interface{}{"os": "linux", "@id": 3}, "n": []interface{}{1, 2}}, "")
+	require.NoError(t, err)
+	assert.Equal(t, `<Event><Name>login</Name><Source></Source><device id="3"><os>linux</os></device><n>1</n><n>2</n></Event>`, string(out))
+
+	var e OrderedExtras
+	require.NoError(t, xml.Unmarshal([]byte(`<e b="1"><a>x</a>text</e>`), &e))
+	assert.Equal(t, OrderedExtras{{"@b", "1"}, {"a", "x"}, {"#text", "text"}}, e)
+	again, err := xml.Marshal(e)
+	require.NoError(t, err)
+	assert.Equal(t, `<OrderedExtras b="1"><a>x</a>text</OrderedExtras>`, string(again))
+}
+
+type Entry struct {
+	XMLName struct{} `xml:"item"`
+	A       string   `xml:"a"`
+	B       string   `xml:"b"`
+	Code    string   `xml:"code,attr"`
+	extras  OrderedExtras
+}
+
+func TestDynXMLOrder(t *testing.T) {
+	// the unknown attributes, elements, comments and CDATA sections keep their position between the fields of the struct
+	raw := `<item lang="en" code="x"><!-- first --><a>1</a><extra/><![CDATA[<raw> & "text"]]><b>2</b><!-- last --></item>`
+
+	var it Entry
+	require.NoError(t, DynUnmarshalXML([]byte(raw), reflect.ValueOf(&it), &it.extras, "extras"))
+	assert.Equal(t, Entry{A: "1", B: "2", Code: "x", extras: OrderedExtras{
+		{"@lang", "en"},
+		{"#comment", []string{" first ", " last "}},
+		{"extra", XMLElement(`<extra></extra>`)},
+		{"#cdata", `<raw> & "text"`},
+		{"#order", XMLOrder{"@lang", "@code", "#comment", "a", "extra", "#cdata", "b", "#comment"}},
+	}}, it)
+
+	again, err := ToXML(it)
+	require.NoError(t, err)
+	assert.Equal(t, `<item lang="en" code="x"><!-- first --><a>1</a><extra></extra><![CDATA[<raw> & "text"]]><b>2</b><!-- last --></item>`, string(again))
+
+	// the items that aren't part of the order are written in the position of the struct, or after the others if they are extra fields
+	it.extras = OrderedExtras{{"@new", "1"}, {"extra", XMLElement(`<extra/>`)}, {"added", 3}, {"#order", XMLOrder{"b", "extra", "missing"}}}
+	again, err = ToXML(it)
+	require.NoError(t, err)
+	assert.Equal(t, `<item code="x" new="1"><a>1</a><b>2</b><extra></extra><added>3</added></item>`, string(again))
+
+	// without unknown items before the fields of the struct the order isn't kept, because it's the same
+	var d Driver
+	require.NoError(t, DynUnmarshalXML([]byte(`<Driver><Name>amreo</Name><!--c--><x/></Driver>`), reflect.ValueOf(&d), &d.Extras, ""))
+	assert.Equal(t, Extras{"#comment": "c", "x": XMLElement(`<x></x>`)}, d.Extras)
+
+	// the order is used only by XML
+	json, err := ToJSON(Entry{A: "1", extras: OrderedExtras{{"#order", XMLOrder{"b", "a"}}}})
+	require.NoError(t, err)
+	assert.Equal(t, `{"XMLName":{},"A":"1","B":"","Code":""}`, string(json))
+
+	_, err = ToXML(Entry{extras: OrderedExtras{{"#comment", 1}}})
+	assert.EqualError(t, err, "The value of the key #comment isn't a string or a []string")
+	_, err = ToXML(Entry{extras: OrderedExtras{{"#comment", "a-->b"}}})
+	assert.Error(t, err)
+}
+
+type XMLTime struct{ time.Time }
+
+func (x XMLTime) MarshalXMLAttr(name xml.Name) (xml.Attr, error) {
+	return xml.Attr{Name: name, Value: x.Format("2006-01-02")}, nil
+}
+
+type Shipment struct {
+	XMLName  xml.Name     `xml:"shipment"`
+	Date     XMLTime      `xml:"date,attr"`
+	Updated  time.Time    `xml:"updated,attr"`
+	Sizes    []int        `xml:"size,attr"`
+	Missing  *string      `xml:"missing,attr"`
+	Street   string       `xml:"address>street"`
+	City     string       `xml:"address>city"`
+	Box      *Box         `xml:"box"`
+	Boxes    []Box        `xml:"boxes>box"`
+	Note     string       `xml:",comment"`
+	Text     string       `xml:",chardata"`
+	Dyn      *Dyn[Driver] `xml:"driver"`
+	Disabled bool         `xml:"-"`
+	extras   OrderedExtras
+}
+
+type Box struct {
+	Weight float32 `xml:"weight,attr,omitempty"`
+}
+
+func TestDynXMLFields(t *testing.T) {
+	// the fields are written like encoding/xml does
+	s := Shipment{
+		Date:    XMLTime{time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)},
+		Updated: time.Date(2020, 5, 2, 10, 0, 0, 0, time.UTC),
+		Sizes:   []int{1, 2},
+		Street:  "Main",
+		City:    "Rome",
+		Box:     &Box{Weight: 1.5},
+		Boxes:   []Box{{}, {Weight: 2}},
+		Note:    "fragile",
+		Text:    "a & b",
+		Dyn:     &Dyn[Driver]{Value: Driver{Name: "amreo", Extras: Extras{"license": "B"}}},
+	}
+
+	expected, err := xml.Marshal(s)
+	require.NoError(t, err)
+
+	again, err := ToXML(s)
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), string(again))
+	assert.Equal(t, `<shipment date="2020-05-01" updated="2020-05-02T10:00:00Z" size="1" size="2">`+
+		`<address><street>Main</street><city>Rome</city></address><box weight="1.5"></box><boxes><box></box><box weight="2"></box></boxes>`+
+		`<!--fragile-->a &amp; b<driver><Name>amreo</Name><license>B</license></driver></shipment>`, string(again))
+
+	// the extra fields replace the fields of the struct with the same name
+	again, err = DynMarshalXML(reflect.ValueOf(Entry{A: "1"}), OrderedExtras{{"a", []interface{}{"x", "y"}}, {"code", 7}}, "extras")
+	require.NoError(t, err)
+	assert.Equal(t, `<item code="7"><a>x</a><a>y</a><b></b></item>`, string(again))
+}
+
+type Script struct {
+	XMLName xml.Name `xml:"script"`
+	Code    string   `xml:",cdata"`
+	extras  Extras
+}
+
+func TestDynXMLCDATA(t *testing.T) {
+	// the CDATA sections are written as they are, also inside the unknown elements
+	raw := `<item code="1"><a>1</a><![CDATA[x<y & z]]><n><![CDATA[if a < b && c]]></n><b></b></item>`
+
+	var it Dyn[Entry]
+	require.NoError(t, FromXML([]byte(raw), &it))
+	assert.Equal(t, OrderedExtras{
+		{"#cdata", "x<y & z"},
+		{"n", XMLElement(`<n><![CDATA[if a < b && c]]></n>`)},
+		{"#order", XMLOrder{"@code", "a", "#cdata", "n", "b"}},
+	}, it.Value.extras)
+
+	again, err := ToXML(it)
+	require.NoError(t, err)
+	assert.Equal(t, raw, string(again))
+
+	// the same happens when the dynamic struct is written by encoding/xml
+	again, err = xml.Marshal(struct {
+		XMLName xml.Name `xml:"list"`
+		Items   []Dyn[Entry]
+	}{Items: []Dyn[Entry]{it}})
+	require.NoError(t, err)
+	assert.Equal(t, `<list><Items code="1"><a>1</a><![CDATA[x<y & z]]><n><![CDATA[if a < b && c]]></n><b></b></Items></list>`, string(again))
+
+	// the text that contains the end of a CDATA section is split like encoding/xml does
+	again, err = ToXML(Entry{extras: OrderedExtras{{"#cdata", []string{"a]]>b", ""}}}})
+	require.NoError(t, err)
+	assert.Equal(t, `<item code=""><a></a><b></b><![CDATA[a]]]]><![CDATA[>b]]><![CDATA[]]></item>`, string(again))
+
+	// the cdata fields are written like encoding/xml does
+	for _, code := range []string{"x < y && y ]]> z", ""} {
+		expected, err := xml.Marshal(Script{Code: code})
+		require.NoError(t, err)
+		again, err = ToXML(Script{Code: code})
+		require.NoError(t, err)
+		assert.Equal(t, string(expected), string(again))
+	}
+}
+
+type XMLCode int
+
+func (c *XMLCode) MarshalText() ([]byte, error) {
+	return []byte("code-" + strconv.Itoa(int(*c))), nil
+}
+
+type XMLBold string
+
+func (b XMLBold) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	return enc.EncodeElement(struct {
+		B string `xml:"b"`
+	}{string(b)}, start)
+}
+
+type Named struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+type Tagged struct {
+	XMLName struct{} `xml:"tagged"`
+	ID      int      `xml:"id,attr"`
+}
+
+type Base struct {
+	Kind  string `xml:"kind,attr"`
+	Label string `xml:"label"`
+}
+
+type Extra struct {
+	More string
+}
+
+type Rules struct {
+	XMLName xml.Name    `xml:"rules"`
+	Time    XMLTime     `xml:"time,attr"`
+	Code    XMLCode     `xml:"code,attr"`
+	Tags    []string    `xml:"tag,attr"`
+	Nil     *int        `xml:"nil,attr"`
+	Empty   string      `xml:"empty,attr,omitempty"`
+	Any     interface{} `xml:"any,attr"`
+	Bytes   []byte      `xml:"bytes,attr"`
+	Flag    bool        `xml:"flag,attr"`
+	Ratio   float32     `xml:"ratio,attr"`
+	Spaced  string      `xml:"urn:y id,attr"`
+	Base
+	*Extra
+	First   string  `xml:"a>b>first"`
+	Missing *string `xml:"a>b>missing"`
+	Second  string  `xml:"a>second"`
+	Omitted string  `xml:"omitted,omitempty"`
+	Names   []Named `xml:"named"`
+	Tagged  Tagged
+	Raw     []byte      `xml:"raw"`
+	Iface   interface{} `xml:"iface"`
+	Text    XMLCode     `xml:"text"`
+	Bold    XMLBold     `xml:"bold"`
+	NS      string      `xml:"urn:x item"`
+	Hidden  string      `xml:"-"`
+	Comment []byte      `xml:",comment"`
+	Number  int         `xml:",chardata"`
+	Inner   string      `xml:",innerxml"`
+	extras  Extras
+}
+
+func TestDynXMLEncodingRules(t *testing.T) {
+	// without extra fields the struct is written in the same way of encoding/xml, each field following the rules of its xml tag
+	n := 3
+	values := []Rules{
+		{},
+		{
+			Time:    XMLTime{time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)},
+			Code:    7,
+			Tags:    []string{"x", "y"},
+			Nil:     &n,
+			Empty:   "e",
+			Any:     42,
+			Bytes:   []byte("by"),
+			Flag:    true,
+			Ratio:   0.5,
+			Spaced:  "s",
+			Base:    Base{Kind: "k", Label: "l"},
+			Extra:   &Extra{More: "m"},
+			First:   "f",
+			Second:  "s",
+			Omitted: "o",
+			Names:   []Named{{XMLName: xml.Name{Local: "one"}, Value: "1"}, {Value: "2"}},
+			Tagged:  Tagged{ID: 1},
+			Raw:     []byte("r"),
+			Iface:   Base{Kind: "i"},
+			Text:    9,
+			Bold:    "b",
+			NS:      "ns",
+			Hidden:  "h",
+			Comment: []byte("c"),
+			Number:  5,
+			Inner:   "<in>x</in>",
+		},
+	}
+
+	for _, v := range values {
+		// the methods with a pointer receiver are always used, like encoding/xml does for a pointer to the struct
+		expected, err := xml.Marshal(&v)
+		require.NoError(t, err)
+
+		again, err := ToXML(v)
+		require.NoError(t, err)
+		assert.Equal(t, string(expected), string(again))
+	}
+}
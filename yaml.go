@@ -0,0 +1,440 @@
+// go-dyn-struct
+// Copyright (C) 2020  Andrea Laisa
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+// © 2020 GitHub, Inc.
+
+package godynstruct
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DynMarshalYAML return the YAML encoding of the dynamic struct _struct
+// The fields of the struct are encoded in declaration order, followed by the extra fields sorted by key, or in their order if they are OrderedExtras
+// The comments of the extra fields stored as *yaml.Node, like DynUnmarshalYAML does with the option RawExtras, are encoded too
+// If an extra field has the same name of a field of the struct, the value of the extra field is used in place of the field
+// _struct contains the reflect.Value of the struct
+// extraFields contains the extra fields, it can be a map[string]interface{}, Extras or OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func DynMarshalYAML(_struct reflect.Value, extraFields interface{}, extraFieldsName string) ([]byte, error) {
+	return Options{}.DynMarshalYAML(_struct, extraFields, extraFieldsName)
+}
+
+// DynMarshalYAML is like the function DynMarshalYAML, but it uses the options o
+func (o Options) DynMarshalYAML(_struct reflect.Value, extraFields interface{}, extraFieldsName string) ([]byte, error) {
+	node, err := o.encodeYAMLStruct(_struct, extraFields, extraFieldsName)
+	if err != nil {
+		return nil, err
+	}
+
+	return yaml.Marshal(node)
+}
+
+// encodeYAMLStruct return the dynamic struct _struct as a YAML mapping node
+func (o Options) encodeYAMLStruct(_struct reflect.Value, extraFields interface{}, extraFieldsName string) (*yaml.Node, error) {
+	members, err := o.dynMembers(_struct, extraFields, extraFieldsName, "yaml")
+	if err != nil {
+		return nil, err
+	}
+
+	// out is the mapping that will be marshalled
+	out := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, m := range members {
+		err = addYAMLPair(out, m.key, m.value, m.field.flow)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// addYAMLPair appends the key/value pair to the mapping node out
+// If flow is true the value is encoded in the flow style
+func addYAMLPair(out *yaml.Node, key string, value interface{}, flow bool) error {
+	keyNode := &yaml.Node{}
+	err := keyNode.Encode(key)
+	if err != nil {
+		return err
+	}
+
+	var valueNode *yaml.Node
+	switch v := value.(type) {
+	case *yaml.Node:
+		valueNode = yamlValueNode(keyNode, v)
+	case yaml.Node:
+		valueNode = yamlValueNode(keyNode, &v)
+	default:
+		valueNode = &yaml.Node{}
+		err = valueNode.Encode(value)
+		if err != nil {
+			return err
+		}
+	}
+
+	if flow {
+		valueNode.Style |= yaml.FlowStyle
+	}
+
+	out.Content = append(out.Content, keyNode, valueNode)
+	return nil
+}
+
+// yamlValueNode return a copy of the node v, stored by DynUnmarshalYAML with the option RawExtras, moving back to keyNode the comments of the key
+func yamlValueNode(keyNode *yaml.Node, v *yaml.Node) *yaml.Node {
+	out := *v
+	keyNode.HeadComment, out.HeadComment = out.HeadComment, ""
+	keyNode.FootComment, out.FootComment = out.FootComment, ""
+	if out.Kind != yaml.ScalarNode {
+		// the line comment of a collection is placed after the key
+		keyNode.LineComment, out.LineComment = out.LineComment, ""
+	}
+
+	return &out
+}
+
+// ToYAML return the YAML encoding of the dynamic struct v, that can be a struct, a Dyn or a pointer to one of them
+// The extra fields are the ones in the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func ToYAML(v interface{}) ([]byte, error) {
+	return Options{}.ToYAML(v)
+}
+
+// ToYAML is like the function ToYAML, but it uses the options o
+func (o Options) ToYAML(v interface{}) ([]byte, error) {
+	ptrStruct, err := dynStruct(v)
+	if err != nil {
+		return nil, err
+	}
+
+	extraFields, name, err := extrasField(ptrStruct.Elem(), "yaml")
+	if err != nil {
+		return nil, err
+	}
+
+	return o.DynMarshalYAML(ptrStruct, extraFields.Interface(), name)
+}
+
+// DynUnmarshalYAML parses the YAML encoded data and store the result into the dynamic struct pointed by ptrStruct
+// The keys of the mapping that aren't part of the struct are set inside the extras, in order if they are OrderedExtras
+// With the option RawExtras the values of the extra fields are stored as *yaml.Node, keeping the comments that DynMarshalYAML encodes again
+// data is the YAML encoded data, that must contain a mapping or null
+// ptrStruct contains the reflect.Value of the pointer to the struct
+// extraFieldsPtr is the pointer to the extra fields, it can be a *map[string]interface{}, *Extras or *OrderedExtras
+// extraFieldsName is the name of the field in the struct that contains the extra fields, if empty it's the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func DynUnmarshalYAML(data []byte, ptrStruct reflect.Value, extraFieldsPtr interface{}, extraFieldsName string) error {
+	return Options{}.DynUnmarshalYAML(data, ptrStruct, extraFieldsPtr, extraFieldsName)
+}
+
+// DynUnmarshalYAML is like the function DynUnmarshalYAML, but it uses the options o
+func (o Options) DynUnmarshalYAML(data []byte, ptrStruct reflect.Value, extraFieldsPtr interface{}, extraFieldsName string) error {
+	dest, err := newDynDest(ptrStruct, extraFieldsPtr, extraFieldsName, "yaml", o.Merge)
+	if err != nil {
+		return err
+	}
+
+	var node yaml.Node
+	err = yaml.Unmarshal(data, &node)
+	if err != nil {
+		return err
+	}
+
+	return o.decodeYAMLStruct(&node, dest)
+}
+
+// decodeYAMLStruct stores the YAML mapping node into the dynamic struct dest
+func (o Options) decodeYAMLStruct(node *yaml.Node, dest *dynDest) error {
+	node = resolveYAMLNode(node)
+	if node == nil || (node.Kind == yaml.ScalarNode && node.ShortTag() == "!!null") {
+		// like the yaml package, an empty document or null leaves the struct as it is
+		return nil
+	}
+	if node.Kind != yaml.MappingNode {
+		return errors.New("yaml: line " + strconv.Itoa(node.Line) + ": cannot unmarshal a value that isn't a mapping into " + dest.fields.typ.String())
+	}
+
+	pairs := yamlMappingPairs(node)
+
+	if o.DisallowUnknownFields {
+		paths, err := unknownYAMLStructFields(pairs, dest.fields, dest.extraFieldsName, "", nil)
+		if err != nil {
+			return err
+		}
+		if len(paths) > 0 {
+			return &UnknownFieldsError{Paths: paths}
+		}
+	}
+
+	// for each key/value pair, set it to a field of struct or to extras
+	for _, p := range pairs {
+		k, v := p.key.Value, p.value
+		if field, ok := dest.field(k); ok {
+			// the field k is part of the struct, so the value will be set inside
+			fieldValue, err := dest.fieldValue(field)
+			if err != nil {
+				return err
+			}
+
+			resolved := resolveYAMLNode(v)
+			if d, ok := nestedDyn(fieldValue, resolved != nil && resolved.Kind == yaml.MappingNode); ok {
+				// the nested dynamic struct is unmarshalled with the same options
+				err = d.unmarshalYAML(v, o)
+			} else {
+				err = v.Decode(fieldValue.Addr().Interface())
+			}
+			if err != nil {
+				return err
+			}
+		} else if o.RawExtras {
+			dest.extras.set(k, rawYAMLNode(p.key, v))
+		} else {
+			// the field k is not part of the struct, so the value is decoded into extras
+			var out interface{}
+			var err error
+			if dest.extras.isOrdered() {
+				out, err = decodeOrderedYAML(v)
+			} else {
+				err = v.Decode(&out)
+			}
+			if err != nil {
+				return err
+			}
+			dest.extras.set(k, out)
+		}
+	}
+
+	return nil
+}
+
+// rawYAMLNode return a copy of the value node v that also contains the comments of its key node, so they are encoded again by DynMarshalYAML
+func rawYAMLNode(key *yaml.Node, v *yaml.Node) *yaml.Node {
+	out := *v
+	if key.HeadComment != "" {
+		out.HeadComment = key.HeadComment
+	}
+	if key.FootComment != "" {
+		out.FootComment = key.FootComment
+	}
+	if key.LineComment != "" && out.Kind != yaml.ScalarNode {
+		out.LineComment = key.LineComment
+	}
+
+	return &out
+}
+
+// FromYAML parses the YAML encoded data and store the result into the dynamic struct pointed by v, that can be a pointer to a struct or to a Dyn
+// The keys that aren't part of the struct are set inside the field of type Extras, OrderedExtras or tagged with dyn:",extras"
+func FromYAML(data []byte, v interface{}) error {
+	return Options{}.FromYAML(data, v)
+}
+
+// FromYAML is like the function FromYAML, but it uses the options o
+func (o Options) FromYAML(data []byte, v interface{}) error {
+	ptrStruct, err := dynStructPtr(v)
+	if err != nil {
+		return err
+	}
+
+	extraFields, name, err := extrasField(ptrStruct.Elem(), "yaml")
+	if err != nil {
+		return err
+	}
+
+	return o.DynUnmarshalYAML(data, ptrStruct, extraFields.Addr().Interface(), name)
+}
+
+// clearYAMLStyle removes the style of node and of the nodes nested inside, so they are encoded in the default style
+func clearYAMLStyle(node *yaml.Node) *yaml.Node {
+	if node == nil {
+		return nil
+	}
+
+	node.Style = 0
+	for _, c := range node.Content {
+		clearYAMLStyle(c)
+	}
+
+	return node
+}
+
+// yamlPair is a key/value pair of a YAML mapping node
+type yamlPair struct {
+	key   *yaml.Node
+	value *yaml.Node
+}
+
+// resolveYAMLNode return the node that contains the value of node, skipping the documents and the aliases
+// It return nil if the document is empty
+func resolveYAMLNode(node *yaml.Node) *yaml.Node {
+	for {
+		switch {
+		case node.Kind == yaml.DocumentNode && len(node.Content) > 0:
+			node = node.Content[0]
+		case node.Kind == yaml.AliasNode && node.Alias != nil:
+			node = node.Alias
+		case node.Kind == 0 || node.Kind == yaml.DocumentNode:
+			return nil
+		default:
+			return node
+		}
+	}
+}
+
+// yamlMappingPairs return the key/value pairs of the mapping node, in order
+// The pairs of the mappings merged with the << key come first, so they are overwritten by the explicit ones
+func yamlMappingPairs(node *yaml.Node) []yamlPair {
+	var merged, pairs []yamlPair
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], node.Content[i+1]
+		if k.Kind != yaml.ScalarNode || k.ShortTag() != "!!merge" {
+			pairs = append(pairs, yamlPair{key: k, value: v})
+			continue
+		}
+
+		v = resolveYAMLNode(v)
+		switch {
+		case v == nil:
+		case v.Kind == yaml.MappingNode:
+			merged = append(merged, yamlMappingPairs(v)...)
+		case v.Kind == yaml.SequenceNode:
+			// the first mappings of the sequence have the precedence, so they are merged last
+			for j := len(v.Content) - 1; j >= 0; j-- {
+				if m := resolveYAMLNode(v.Content[j]); m != nil && m.Kind == yaml.MappingNode {
+					merged = append(merged, yamlMappingPairs(m)...)
+				}
+			}
+		}
+	}
+
+	return append(merged, pairs...)
+}
+
+// decodeOrderedYAML decodes the YAML node like yaml.Node.Decode into an interface{}, but the mappings are decoded as OrderedExtras
+func decodeOrderedYAML(node *yaml.Node) (interface{}, error) {
+	resolved := resolveYAMLNode(node)
+	if resolved == nil {
+		return nil, nil
+	}
+
+	switch resolved.Kind {
+	case yaml.MappingNode:
+		pairs := yamlMappingPairs(resolved)
+		out := make(OrderedExtras, 0, len(pairs))
+		for _, p := range pairs {
+			v, err := decodeOrderedYAML(p.value)
+			if err != nil {
+				return nil, err
+			}
+			out.Set(p.key.Value, v)
+		}
+		return out, nil
+	case yaml.SequenceNode:
+		out := make([]interface{}, len(resolved.Content))
+		for i, c := range resolved.Content {
+			v, err := decodeOrderedYAML(c)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = v
+		}
+		return out, nil
+	default:
+		var out interface{}
+		err := resolved.Decode(&out)
+		return out, err
+	}
+}
+
+// unknownYAMLStructFields appends to paths the path of each key that isn't a field of the struct, also inside the values of the fields
+func unknownYAMLStructFields(pairs []yamlPair, fields *typeFields, extraFieldsName string, path string, paths []string) ([]string, error) {
+	for _, p := range pairs {
+		field, ok := fields.fieldByName(p.key.Value, extraFieldsName)
+		if !ok {
+			paths = append(paths, joinPath(path, p.key.Value))
+			continue
+		}
+
+		fieldType := fields.typ.FieldByIndex(field.index).Type
+		var err error
+		paths, err = unknownYAMLFields(p.value, fieldType, joinPath(path, p.key.Value), paths)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return paths, nil
+}
+
+// unknownYAMLFields appends to paths the path of each key of the YAML node that isn't part of the type typ
+// The values that don't match typ are ignored, because they are reported by the unmarshalling
+func unknownYAMLFields(node *yaml.Node, typ reflect.Type, path string, paths []string) ([]string, error) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	if typ.Kind() != reflect.Struct && (typ.Implements(yamlUnmarshalerType) || reflect.PtrTo(typ).Implements(yamlUnmarshalerType)) {
+		return paths, nil
+	}
+
+	node = resolveYAMLNode(node)
+	if node == nil {
+		return paths, nil
+	}
+
+	switch typ.Kind() {
+	case reflect.Slice, reflect.Array:
+		if node.Kind != yaml.SequenceNode {
+			return paths, nil
+		}
+
+		var err error
+		for i, c := range node.Content {
+			paths, err = unknownYAMLFields(c, typ.Elem(), indexPath(path, i), paths)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return paths, nil
+		}
+
+		var err error
+		for _, p := range yamlMappingPairs(node) {
+			paths, err = unknownYAMLFields(p.value, typ.Elem(), joinPath(path, p.key.Value), paths)
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		fields, extraFieldsName, ok, err := nestedStructFields(typ, "yaml", yamlUnmarshalerType)
+		if err != nil || !ok {
+			return paths, err
+		}
+
+		if node.Kind != yaml.MappingNode {
+			return paths, nil
+		}
+
+		return unknownYAMLStructFields(yamlMappingPairs(node), fields, extraFieldsName, path, paths)
+	}
+
+	return paths, nil
+}
+
+var yamlUnmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
@@ -0,0 +1,276 @@
+// go-dyn-struct
+// Copyright (C) 2020  Andrea Laisa
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+// © 2020 GitHub, Inc.
+
+package godynstruct
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+type Server struct {
+	Name    string
+	Ports   []int `yaml:"ports,flow"`
+	Address `yaml:",inline"`
+	Hidden  string `yaml:"-"`
+	Notes   string `yaml:"notes,omitempty"`
+	others  OrderedExtras
+}
+
+func TestDynMarshalYAML(t *testing.T) {
+	s := Server{
+		Name:    "web",
+		Ports:   []int{80, 443},
+		Address: Address{City: "Rome"},
+		Hidden:  "secret",
+		others: OrderedExtras{
+			{"zeta", OrderedExtras{{"y", 1}, {"b", []interface{}{2, 3}}}},
+			{"alpha", "last"},
+		},
+	}
+
+	raw, err := DynMarshalYAML(reflect.ValueOf(s), s.others, "others")
+	require.NoError(t, err)
+	expected := `name: web
+ports: [80, 443]
+city: Rome
+street: ""
+zeta:
+    "y": 1
+    b:
+        - 2
+        - 3
+alpha: last
+`
+	assert.Equal(t, expected, string(raw))
+
+	// the keys of Extras are sorted
+	d := Driver{Name: "amreo", Extras: Extras{"z": 1, "a": 2}}
+	raw, err = DynMarshalYAML(reflect.ValueOf(d), d.Extras, "")
+	require.NoError(t, err)
+	assert.Equal(t, "name: amreo\na: 2\nz: 1\n", string(raw))
+}
+
+func TestDynUnmarshalYAML(t *testing.T) {
+	data := `
+name: web
+zeta:
+  y: 1
+  b: [2, {d: 3, c: 4}]
+ports: [80, 443]
+city: Rome
+alpha: last
+Hidden: visible
+`
+
+	var s Server
+	require.NoError(t, DynUnmarshalYAML([]byte(data), reflect.ValueOf(&s), &s.others, "others"))
+	assert.Equal(t, "web", s.Name)
+	assert.Equal(t, []int{80, 443}, s.Ports)
+	assert.Equal(t, "Rome", s.City)
+	assert.Equal(t, "", s.Hidden)
+	assert.Equal(t, OrderedExtras{
+		{"zeta", OrderedExtras{{"y", 1}, {"b", []interface{}{2, OrderedExtras{{"d", 3}, {"c", 4}}}}}},
+		{"alpha", "last"},
+		{"Hidden", "visible"},
+	}, s.others)
+
+	var d Driver
+	require.NoError(t, DynUnmarshalYAML([]byte("name: amreo\nlicense: {type: B}\n"), reflect.ValueOf(&d), &d.Extras, ""))
+	assert.Equal(t, Driver{Name: "amreo", Extras: Extras{"license": map[string]interface{}{"type": "B"}}}, d)
+
+	// an empty document or null leave the struct as it is
+	require.NoError(t, DynUnmarshalYAML([]byte(""), reflect.ValueOf(&d), &d.Extras, ""))
+	require.NoError(t, DynUnmarshalYAML([]byte("~"), reflect.ValueOf(&d), &d.Extras, ""))
+	assert.Equal(t, "amreo", d.Name)
+
+	assert.EqualError(t, DynUnmarshalYAML([]byte("\n- foo"), reflect.ValueOf(&d), &d.Extras, ""),
+		"yaml: line 2: cannot unmarshal a value that isn't a mapping into godynstruct.Driver")
+	assert.Error(t, DynUnmarshalYAML([]byte("name: [1"), reflect.ValueOf(&d), &d.Extras, ""))
+	assert.Error(t, DynUnmarshalYAML([]byte("name: [1]"), reflect.ValueOf(&d), &d.Extras, ""))
+}
+
+func TestDynUnmarshalYAMLMergeKeys(t *testing.T) {
+	data := `
+base: &base
+  name: base
+  color: red
+other: &other
+  color: blue
+  size: 2
+web:
+  <<: [*base, *other]
+  name: web
+`
+
+	var root map[string]yaml.Node
+	require.NoError(t, yaml.Unmarshal([]byte(data), &root))
+	web := root["web"]
+
+	var s Server
+	require.NoError(t, s.unmarshalYAMLNode(&web))
+	assert.Equal(t, "web", s.Name)
+	assert.Equal(t, OrderedExtras{{"color", "red"}, {"size", 2}}, s.others)
+}
+
+// unmarshalYAMLNode stores the YAML node into s
+func (s *Server) unmarshalYAMLNode(node *yaml.Node) error {
+	dest, err := newDynDest(reflect.ValueOf(s), &s.others, "others", "yaml", false)
+	if err != nil {
+		return err
+	}
+
+	return Options{}.decodeYAMLStruct(node, dest)
+}
+
+func TestDynYAMLComments(t *testing.T) {
+	data := `# the name
+name: web
+# the owner
+owner: amreo # line
+labels: # labels
+    # the first label
+    env: prod
+# foot of labels
+`
+
+	var s Server
+	require.NoError(t, Options{RawExtras: true}.DynUnmarshalYAML([]byte(data), reflect.ValueOf(&s), &s.others, "others"))
+	assert.Equal(t, "web", s.Name)
+
+	var owner string
+	require.NoError(t, s.others.Decode("owner", &owner))
+	assert.Equal(t, "amreo", owner)
+
+	// the comments of the extra fields are encoded again
+	raw, err := DynMarshalYAML(reflect.ValueOf(s), s.others, "others")
+	require.NoError(t, err)
+	assert.Equal(t, `name: web
+ports: []
+city: ""
+street: ""
+# the owner
+owner: amreo # line
+labels: # labels
+    # the first label
+    env: prod
+# foot of labels
+`, string(raw))
+}
+
+func TestDynYAMLOptions(t *testing.T) {
+	data := "name: web\nowner: amreo\naddress: {zip: 1}\n"
+
+	var s Server
+	err := Options{DisallowUnknownFields: true}.DynUnmarshalYAML([]byte(data), reflect.ValueOf(&s), &s.others, "others")
+	assert.Equal(t, &UnknownFieldsError{Paths: []string{"owner", "address"}}, err)
+
+	var car Car
+	err = Options{DisallowUnknownFields: true}.FromYAML([]byte("model: Panda\ndriver: {name: amreo, license: B}\n"), &car)
+	assert.Equal(t, &UnknownFieldsError{Paths: []string{"driver.license"}}, err)
+
+	s.others = OrderedExtras{{"owner", "amreo"}, {"labels", OrderedExtras{{"env", "prod"}}}}
+	require.NoError(t, Options{Merge: true}.DynUnmarshalYAML([]byte("labels: {tier: db}\n"), reflect.ValueOf(&s), &s.others, "others"))
+	assert.Equal(t, OrderedExtras{{"owner", "amreo"}, {"labels", OrderedExtras{{"env", "prod"}, {"tier", "db"}}}}, s.others)
+
+	s.others = OrderedExtras{{"name", "overwritten"}}
+	_, err = Options{Collisions: CollisionError}.DynMarshalYAML(reflect.ValueOf(s), s.others, "others")
+	assert.EqualError(t, err, "The extra field name has the same name of a field of the struct godynstruct.Server")
+}
+
+func TestDynYAML(t *testing.T) {
+	car := Dyn[Car]{
+		Value: Car{
+			Model: "Panda",
+			Year:  2003,
+			Driver: &Dyn[Driver]{
+				Value: Driver{
+					Name:   "amreo",
+					Extras: Extras{"license": "B"},
+				},
+			},
+			extras: Extras{"color": "red"},
+		},
+	}
+
+	raw, err := yaml.Marshal(car)
+	require.NoError(t, err)
+	expected := `model: Panda
+year: 2003
+driver:
+    name: amreo
+    license: B
+color: red
+`
+	assert.Equal(t, expected, string(raw))
+
+	var out Dyn[Car]
+	require.NoError(t, yaml.Unmarshal(raw, &out))
+	assert.Equal(t, car, out)
+
+	raw, err = ToYAML(car)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(raw))
+
+	out = Dyn[Car]{}
+	require.NoError(t, FromYAML(raw, &out))
+	assert.Equal(t, car, out)
+}
+
+func TestOrderedExtrasYAML(t *testing.T) {
+	data := "z: 1\na:\n    \"y\": true\n    b: null\nm:\n    - k: v\n      c: d\n"
+
+	var e OrderedExtras
+	require.NoError(t, yaml.Unmarshal([]byte(data), &e))
+	assert.Equal(t, OrderedExtras{
+		{"z", 1},
+		{"a", OrderedExtras{{"y", true}, {"b", nil}}},
+		{"m", []interface{}{OrderedExtras{{"k", "v"}, {"c", "d"}}}},
+	}, e)
+
+	raw, err := yaml.Marshal(e)
+	require.NoError(t, err)
+	assert.Equal(t, data, string(raw))
+
+	assert.EqualError(t, yaml.Unmarshal([]byte("[1]"), &e), "yaml: line 1: cannot unmarshal a value that isn't a mapping into OrderedExtras")
+}
+
+func TestRawExtrasAcrossFormats(t *testing.T) {
+	var e Event
+	require.NoError(t, Options{RawExtras: true}.DynUnmarshalJSON([]byte(`{"name":"login","zeta":{"x":1,"b":2},"big":12345678901234567890}`), reflect.ValueOf(&e), &e.others, ""))
+
+	raw, err := DynMarshalYAML(reflect.ValueOf(e), e.others, "")
+	require.NoError(t, err)
+	assert.Equal(t, "name: login\nsource: \"\"\nzeta:\n    x: 1\n    b: 2\nbig: 12345678901234567890\n", string(raw))
+
+	e.others = nil
+	require.NoError(t, Options{RawExtras: true}.DynUnmarshalYAML(raw, reflect.ValueOf(&e), &e.others, ""))
+
+	raw, err = DynMarshalJSON(reflect.ValueOf(e), e.others, "")
+	require.NoError(t, err)
+	assert.Equal(t, `{"name":"login","source":"","zeta":{"x":1,"b":2},"big":12345678901234567890}`, string(raw))
+
+	data, err := DynMarshalBSON(reflect.ValueOf(e), OrderedExtras{{"zeta", e.others[0].Value}}, "")
+	require.NoError(t, err)
+	var out Event
+	require.NoError(t, DynUnmarshalBSON(data, reflect.ValueOf(&out), &out.others, ""))
+	assert.Equal(t, OrderedExtras{{"zeta", OrderedExtras{{"x", int32(1)}, {"b", int32(2)}}}}, out.others)
+}